@@ -3,52 +3,128 @@ package main
 import (
 	"github.com/tuvistavie/securerandom"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 )
 
 var WorkerUUID string
 var WorkerUUIDShort string
 
 func main() {
-	logger := Logger{"Main", os.Stdout}
+	if len(os.Args) > 1 && os.Args[1] == "status" {
+		os.Exit(RunStatusCommand(os.Args[2:], os.Stdout))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(RunConfigCommand(os.Args[2:], os.Stdout))
+	}
+
+	logger := Logger{prefix: "Main", writer: os.Stdout}
+
+	config, err := LoadConfig(os.Args[1:], os.Stderr)
+	if config == nil {
+		os.Exit(2)
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Validated with the rest of the config
+	ConfigureLogging(config)
 
-	printLogo(logger)
+	if logFormat == LOG_FORMAT_TEXT {
+		printLogo(logger)
+	}
 
 	if err := setWorkerUuid(); err != nil {
-		logger.Log(err.Error())
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	SetupClientData(config)
+
+	// OTEL_EXPORTER_OTLP_ENDPOINT is not part of the config
+	tracingEndpoint, err := TracingEndpoint(config)
+	if err != nil {
+		logger.Error(err.Error())
 		os.Exit(1)
 	}
+	if tracingEndpoint != "" {
+		tracer = NewTracer(tracingEndpoint, Logger{prefix: "Tracer", writer: os.Stdout})
+		go tracer.Start()
+		logger.Log("Sending traces to " + tracingEndpoint)
+	}
 
-	// Check if env vars are set, use defaults if not (or exit if needed)
-	// and initialize oauth token.
-	if err := SetupClientData(); err != nil {
-		logger.Log(err.Error())
+	gitBackend, _ := GitBackend(config)
+
+	// The builtin git backend doesn't need git to be installed
+	if gitBackend == GIT_BACKEND_SHELL {
+		if err := EnsureGit(config, logger); err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+	} else {
+		logger.Log("Using the builtin git backend")
+	}
+
+	project, err := NewProject(config, logger)
+	if err != nil {
+		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
-	if err := EnsureGit(logger); err != nil {
-		logger.Log(err.Error())
+	if err := project.Preflight(gitBackend, logger); err != nil {
+		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
-	project, err := NewProject(logger)
+	jobLogs, err := NewJobLogs(project.directory, config)
 	if err != nil {
-		logger.Log(err.Error())
+		logger.Error(err.Error())
 		os.Exit(1)
 	}
 
+	history := LoadDurationHistory(DurationHistoryPath(config), project.setupRepositoryUrl, logger)
+
+	cleanupOnSignal(project, history, logger)
+
 	if err := project.Init(logger); err != nil {
-		logger.Log(err.Error())
+		logger.Error(err.Error())
+		project.Cleanup(logger)
 		os.Exit(1)
 	}
 
 	jobsChannel := make(chan *TestJob)
 	reportsChannel := make(chan *TestJob)
 	cancelledTestRunIdsChan := make(chan []int)
-
-	manager := NewManager(jobsChannel, cancelledTestRunIdsChan)
-	worker := NewWorker(jobsChannel, reportsChannel, manager.workerIdlingChannel, project)
-	reporter := NewReporter(reportsChannel, cancelledTestRunIdsChan)
+	setupDataVersionChan := make(chan string, 1)
+
+	manager := NewManager(config, jobsChannel, cancelledTestRunIdsChan, history)
+	if config.WorkStealing {
+		manager.stealer, err = StartWorkStealer(CoordinationDir(config), manager, logger)
+		if err != nil {
+			logger.Warn("Couldn't start sharing jobs with the other agents: " + err.Error())
+		}
+	}
+	manager.jobLogs = jobLogs
+	worker := NewWorker(config, jobsChannel, reportsChannel, manager.workerIdlingChannel, setupDataVersionChan, project)
+	worker.jobLogs = jobLogs
+	reporter := NewReporter(config, reportsChannel, cancelledTestRunIdsChan, setupDataVersionChan)
+
+	serveMetrics := config.Metrics
+	if address := StatusAddress(config); address != "" {
+		if statusServer, err := StartStatusServer(address, manager, reporter, serveMetrics); err != nil {
+			logger.Warn("Couldn't start the status API: " + err.Error())
+		} else {
+			logger.Log("Serving the status on http://" + statusServer.Address() + STATUS_PATH)
+			if serveMetrics {
+				logger.Log("Serving the metrics on http://" + statusServer.Address() + METRICS_PATH)
+			}
+		}
+	} else if serveMetrics {
+		logger.Warn("The metrics are served by the status API which is off. Set status_address.")
+	}
 
 	go worker.Start()
 	go reporter.Start()
@@ -67,6 +143,29 @@ func printLogo(logger Logger) {
 `)
 }
 
+// cleanupOnSignal removes any sensitive files written by the project (e.g. SSH
+// keys), saves the duration history and sends the remaining traces when the
+// agent is interrupted or terminated.
+func cleanupOnSignal(project *Project, history *DurationHistory, logger Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logger.Log("Received " + sig.String() + ". Exiting.")
+		// Commands run in their own process group so they don't get the signal
+		project.Executor().Cancel()
+		project.Cleanup(logger)
+		if err := history.Save(); err != nil {
+			logger.Warn("Couldn't save the duration history: " + err.Error())
+		}
+		if err := tracer.Export(); err != nil {
+			logger.Warn("Couldn't send the traces: " + err.Error())
+		}
+		os.Exit(1)
+	}()
+}
+
 func setWorkerUuid() error {
 	var err error
 	WorkerUUID, err = securerandom.Uuid()
@@ -9,7 +9,7 @@ import (
 func TestSetWorkerUuid(t *testing.T) {
 	setWorkerUuid()
 	var b bytes.Buffer
-	logger := Logger{"test_logger", &b}
+	logger := Logger{prefix: "test_logger", writer: &b}
 	logger.Log("something")
 	result := make([]byte, 100)
 	b.Read(result)
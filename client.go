@@ -9,26 +9,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-const (
-	REQUEST_ERROR_TIMEOUT_SECONDS = 10
-)
-
-// NOTE: On a fresh Ubuntu (e.g. through docker) ca-certificate is not installed
-// and making requests to https urls (like testributor's) is not possible, we
-// see this error: https://github.com/zenazn/goji/issues/126
-// git though seems to install ca-certificates as a dependency so it is not
-// an issue since we always require git to be installed.
-var testributorUrl = os.Getenv("TESTRIBUTOR_URL")
-var apiUrl string
-var appID = os.Getenv("APP_ID")
-var appSecret = os.Getenv("APP_SECRET")
-
 // We build only one tokenSource and use it to create new APIClients
 // (through NewClient() function) to avoid making multiple requests for
 // token generation.
@@ -39,60 +24,51 @@ var appSecret = os.Getenv("APP_SECRET")
 // since it points to an already initialized TokenSource value (with a valid token).
 var tokenSource oauth2.TokenSource
 
-func SetupClientData() error {
-	// Default url if environment var is not set
-	if testributorUrl == "" {
-		testributorUrl = "https://www.testributor.com/"
-	}
-	apiUrl = testributorUrl + "api/v1/"
-
-	if appID == "" {
-		return errors.New("APP_ID environment variable is not set.")
-	}
-
-	if appSecret == "" {
-		return errors.New("APP_SECRET environment variable is not set.")
-	}
-
+// SetupClientData creates the tokenSource with the project's credentials. The
+// config should be valid (see Config.Validate).
+func SetupClientData(config *Config) {
 	conf := &clientcredentials.Config{
-		ClientID:     appID,
-		ClientSecret: appSecret,
+		ClientID:     config.AppId,
+		ClientSecret: config.AppSecret,
 		//Scopes:       []string{"SCOPE1", "SCOPE2"},
-		TokenURL: testributorUrl + "oauth/token",
+		TokenURL: config.TestributorUrl + "oauth/token",
 	}
 	tokenSource = conf.TokenSource(context.Background())
-
-	return nil
 }
 
 type APIClient struct {
 	http.Client
-	logger Logger
+	logger              Logger
+	apiUrl              string
+	requestErrorTimeout time.Duration // How long we wait before retrying
 }
 
 // NewClient should be used to create an APIClient instance. A logger is required
 // in order for the client to print the messages with the correct prefix.
-func NewClient(logger Logger) *APIClient {
+func NewClient(config *Config, logger Logger) *APIClient {
 	return &APIClient{
-		*oauth2.NewClient(context.Background(), tokenSource),
-		logger,
+		Client:              *oauth2.NewClient(context.Background(), tokenSource),
+		logger:              logger,
+		apiUrl:              config.ApiUrl(),
+		requestErrorTimeout: time.Duration(config.RequestErrorTimeoutSeconds) * time.Second,
 	}
 }
 
 // HandleRequest takes an *http.Request, makes the request and returns the
-// result as an empty interface.
+// result as an empty interface. The request is traced as a child of parent
+// (if any) and Testributor gets the trace context in the traceparent header.
 // https://blog.golang.org/json-and-go
-func (c *APIClient) PerformRequest(method string, path string, body string) (interface{}, error) {
+func (c *APIClient) PerformRequest(method string, path string, body string, parent *Span) (interface{}, error) {
 	var request *http.Request
 	var err error
 
 	if body != "" {
-		request, err = http.NewRequest(method, apiUrl+path, strings.NewReader(body))
+		request, err = http.NewRequest(method, c.apiUrl+path, strings.NewReader(body))
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		request, err = http.NewRequest(method, apiUrl+path, nil)
+		request, err = http.NewRequest(method, c.apiUrl+path, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -105,15 +81,35 @@ func (c *APIClient) PerformRequest(method string, path string, body string) (int
 	}
 	request.Header.Add("WORKER_UUID", WorkerUUID)
 
+	var span *Span
+	if parent != nil {
+		span = StartSpan(method+" "+path, parent)
+		span.kind = SPAN_KIND_CLIENT
+		span.SetAttribute("http.method", method)
+		span.SetAttribute("http.url", c.apiUrl+path)
+		request.Header.Add("traceparent", span.Traceparent())
+		defer span.End()
+	}
+
 	requestStart := time.Now()
 	resp, err := c.Do(request)
+	metricApiRequestDuration.Observe(time.Since(requestStart).Seconds(), path)
 	requestDuration := time.Since(requestStart).String()
 	if err != nil {
-		c.logger.Log("Error occured: " + err.Error())
-		c.logger.Log("Error occured after " + requestDuration)
-		c.logger.Log("Retrying in " + strconv.Itoa(REQUEST_ERROR_TIMEOUT_SECONDS) + " seconds")
-		time.Sleep(REQUEST_ERROR_TIMEOUT_SECONDS * time.Second)
-		return c.PerformRequest(method, path, body)
+		metricApiRequestsTotal.Inc(path, "error")
+		span.SetError(err)
+		c.logger.Warn("Error occured: " + err.Error())
+		c.logger.Warn("Error occured after " + requestDuration)
+		c.logger.Log("Retrying in " + c.requestErrorTimeout.String())
+		span.End()
+		time.Sleep(c.requestErrorTimeout)
+		return c.PerformRequest(method, path, body, parent)
+	}
+
+	metricApiRequestsTotal.Inc(path, strconv.Itoa(resp.StatusCode))
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		span.SetError(errors.New(resp.Status))
 	}
 
 	if resp.StatusCode == 401 {
@@ -138,19 +134,19 @@ func (c *APIClient) PerformRequest(method string, path string, body string) (int
 }
 
 func (c *APIClient) ProjectSetupData() (interface{}, error) {
-	return c.PerformRequest("GET", "projects/setup_data", "")
+	return c.PerformRequest("GET", "projects/setup_data", "", nil)
 }
 
-func (c *APIClient) FetchJobs() (interface{}, error) {
-	return c.PerformRequest("PATCH", "test_jobs/bind_next_batch", "")
+func (c *APIClient) FetchJobs(span *Span) (interface{}, error) {
+	return c.PerformRequest("PATCH", "test_jobs/bind_next_batch", "", span)
 }
 
 func (c *APIClient) Beacon() (interface{}, error) {
-	return c.PerformRequest("POST", "projects/beacon", "")
+	return c.PerformRequest("POST", "projects/beacon", "", nil)
 }
 
 // http://codefol.io/posts/How-Does-Rack-Parse-Query-Params-With-parse-nested-query
-func (c *APIClient) UpdateTestJobs(testJobs []TestJob) (interface{}, error) {
+func (c *APIClient) UpdateTestJobs(testJobs []TestJob, span *Span) (interface{}, error) {
 	form := url.Values{}
 	for _, job := range testJobs {
 		jobData, err := json.Marshal(job)
@@ -160,5 +156,38 @@ func (c *APIClient) UpdateTestJobs(testJobs []TestJob) (interface{}, error) {
 		form.Add("jobs["+strconv.Itoa(job.Id)+"]", string(jobData))
 	}
 
-	return c.PerformRequest("PATCH", "test_jobs/batch_update", form.Encode())
+	return c.PerformRequest("PATCH", "test_jobs/batch_update", form.Encode(), span)
+}
+
+// ReassignTestJobs makes workerUuid the worker of the jobs (see WorkStealer).
+// It returns the ids of the jobs Testributor reassigned. Jobs which were
+// cancelled or already reported are not reassigned.
+func (c *APIClient) ReassignTestJobs(ids []int, workerUuid string) (map[int]struct{}, error) {
+	form := url.Values{"worker_uuid": {workerUuid}}
+	for _, id := range ids {
+		form.Add("ids[]", strconv.Itoa(id))
+	}
+
+	result, err := c.PerformRequest("PATCH", "test_jobs/reassign", form.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected response from Testributor")
+	}
+	reassignedIds, ok := response["reassigned_ids"].([]interface{})
+	if !ok {
+		return nil, errors.New("Unexpected response from Testributor")
+	}
+
+	reassigned := make(map[int]struct{})
+	for _, id := range reassignedIds {
+		if id, ok := id.(float64); ok {
+			reassigned[int(id)] = struct{}{}
+		}
+	}
+
+	return reassigned, nil
 }
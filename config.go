@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_TESTRIBUTOR_URL               = "https://www.testributor.com/"
+	DEFAULT_MIN_WORKLOAD_SECONDS          = 10
+	DEFAULT_REPORTING_FREQUENCY_SECONDS   = 5
+	DEFAULT_ACTIVE_SENDERS_LIMIT          = 3
+	DEFAULT_BEACON_THRESHOLD_SECONDS      = 12
+	DEFAULT_REQUEST_ERROR_TIMEOUT_SECONDS = 10
+	// What the config command prints instead of secrets
+	REDACTED_CONFIG_VALUE = "[redacted]"
+)
+
+// Config holds the agent's settings. Each setting comes from (in order of
+// precedence) a command line flag, an env variable, the config file or its
+// default (see LoadConfig and CONFIG_SETTINGS).
+type Config struct {
+	TestributorUrl             string  `yaml:"testributor_url"`
+	AppId                      string  `yaml:"app_id"`
+	AppSecret                  string  `yaml:"app_secret"`
+	MinWorkloadSeconds         float64 `yaml:"min_workload_seconds"`
+	ReportingFrequencySeconds  int     `yaml:"reporting_frequency_seconds"`
+	ActiveSendersLimit         int     `yaml:"active_senders_limit"`
+	BeaconThresholdSeconds     int     `yaml:"beacon_threshold_seconds"`
+	RequestErrorTimeoutSeconds int     `yaml:"request_error_timeout_seconds"`
+	ProjectDirectory           string  `yaml:"project_directory"`
+	GitBackend                 string  `yaml:"git_backend"`
+	DryRunInstall              bool    `yaml:"dry_run_install"`
+	RepositoryUsername         string  `yaml:"repository_username"`
+	RepositoryToken            string  `yaml:"repository_token"`
+	SshAgent                   string  `yaml:"ssh_agent"`
+	SshHostKeyChecking         string  `yaml:"ssh_host_key_checking"`
+	SshKnownHosts              string  `yaml:"ssh_known_hosts"`
+	Executor                   string  `yaml:"executor"`
+	ExecutorSshUrl             string  `yaml:"executor_ssh_url"`
+	ExecutorSshKey             string  `yaml:"executor_ssh_key"`
+	DockerSocket               string  `yaml:"docker_socket"`
+	DockerUser                 string  `yaml:"docker_user"`
+	DockerNetwork              string  `yaml:"docker_network"`
+	WorkerIndex                string  `yaml:"worker_index"`
+	SetupDataRefreshSeconds    int     `yaml:"setup_data_refresh_seconds"`
+	JobOrder                   string  `yaml:"job_order"`
+	JobLogsKeepTestRuns        int     `yaml:"job_logs_keep_test_runs"`
+	JobLogsMaxMegabytes        int     `yaml:"job_logs_max_megabytes"`
+	DurationHistoryPath        string  `yaml:"duration_history_path"`
+	WorkStealing               bool    `yaml:"work_stealing"`
+	CoordinationDir            string  `yaml:"coordination_dir"`
+	StatusAddress              string  `yaml:"status_address"`
+	Metrics                    bool    `yaml:"metrics"`
+	LogLevel                   string  `yaml:"log_level"`
+	LogFormat                  string  `yaml:"log_format"`
+	TracingEndpoint            string  `yaml:"tracing_endpoint"`
+
+	path    string            // The config file (it might not exist)
+	sources map[string]string // Setting name -> where its value came from
+}
+
+// configSetting describes a setting of the Config. The key in the config file
+// is the name and the flag is the name with dashes.
+type configSetting struct {
+	name   string
+	env    string
+	secret bool // Never printed
+	usage  string
+	field  func(config *Config) interface{} // A pointer to the Config's field
+	// Returns an error when the value doesn't make sense. Numbers without a
+	// check must be more than 0.
+	check func(config *Config) error
+}
+
+func (s configSetting) flag() string {
+	return strings.Replace(s.name, "_", "-", -1)
+}
+
+var CONFIG_SETTINGS = []configSetting{
+	{name: "testributor_url", env: "TESTRIBUTOR_URL", usage: "the URL of Testributor",
+		field: func(c *Config) interface{} { return &c.TestributorUrl }},
+	{name: "app_id", env: "APP_ID", usage: "the APP_ID of the project",
+		field: func(c *Config) interface{} { return &c.AppId }},
+	{name: "app_secret", env: "APP_SECRET", secret: true, usage: "the APP_SECRET of the project",
+		field: func(c *Config) interface{} { return &c.AppSecret }},
+	{name: "min_workload_seconds", env: "TESTRIBUTOR_MIN_WORKLOAD_SECONDS",
+		usage: "fetch more jobs when the queued work is expected to take less than this",
+		field: func(c *Config) interface{} { return &c.MinWorkloadSeconds }},
+	{name: "reporting_frequency_seconds", env: "TESTRIBUTOR_REPORTING_FREQUENCY_SECONDS",
+		usage: "how often the results are sent to Testributor",
+		field: func(c *Config) interface{} { return &c.ReportingFrequencySeconds }},
+	{name: "active_senders_limit", env: "TESTRIBUTOR_ACTIVE_SENDERS_LIMIT",
+		usage: "how many reports can be sent at the same time",
+		field: func(c *Config) interface{} { return &c.ActiveSendersLimit }},
+	{name: "beacon_threshold_seconds", env: "TESTRIBUTOR_BEACON_THRESHOLD_SECONDS",
+		usage: "tell Testributor the agent is alive when it hasn't heard from it for this long",
+		field: func(c *Config) interface{} { return &c.BeaconThresholdSeconds }},
+	{name: "request_error_timeout_seconds", env: "TESTRIBUTOR_REQUEST_ERROR_TIMEOUT_SECONDS",
+		usage: "how long to wait before retrying a failed request to Testributor",
+		field: func(c *Config) interface{} { return &c.RequestErrorTimeoutSeconds }},
+	{name: "project_directory", env: "TESTRIBUTOR_PROJECT_DIRECTORY",
+		usage: "the directory the project's repository is cloned in",
+		field: func(c *Config) interface{} { return &c.ProjectDirectory }},
+	{name: "git_backend", env: "TESTRIBUTOR_GIT_BACKEND",
+		usage: "\"" + GIT_BACKEND_SHELL + "\" (runs git) or \"" + GIT_BACKEND_BUILTIN + "\"",
+		field: func(c *Config) interface{} { return &c.GitBackend },
+		check: func(c *Config) error { _, err := GitBackend(c); return err }},
+	{name: "dry_run_install", env: "TESTRIBUTOR_DRY_RUN_INSTALL",
+		usage: "only print the command which would install git",
+		field: func(c *Config) interface{} { return &c.DryRunInstall }},
+	{name: "repository_username", env: "TESTRIBUTOR_REPOSITORY_USERNAME",
+		usage: "the username for HTTPS repositories (instead of the one sent by Testributor)",
+		field: func(c *Config) interface{} { return &c.RepositoryUsername }},
+	{name: "repository_token", env: "TESTRIBUTOR_REPOSITORY_TOKEN", secret: true,
+		usage: "the token for HTTPS repositories (instead of the one sent by Testributor)",
+		field: func(c *Config) interface{} { return &c.RepositoryToken }},
+	{name: "ssh_agent", env: "TESTRIBUTOR_SSH_AGENT",
+		usage: "keep the project's key in an ssh-agent: \"" + SSH_AGENT_MODE_BUILTIN + "\" or \"" +
+			SSH_AGENT_MODE_EXTERNAL + "\" (the key is written to disk when empty)",
+		field: func(c *Config) interface{} { return &c.SshAgent },
+		check: func(c *Config) error { _, err := SshAgentMode(c); return err }},
+	{name: "ssh_host_key_checking", env: "TESTRIBUTOR_SSH_HOST_KEY_CHECKING",
+		usage: "\"" + HOST_KEY_CHECKING_STRICT + "\" or \"" + HOST_KEY_CHECKING_ACCEPT_NEW + "\" (trust unknown hosts)",
+		field: func(c *Config) interface{} { return &c.SshHostKeyChecking },
+		check: func(c *Config) error { _, err := HostKeyChecking(c); return err }},
+	{name: "ssh_known_hosts", env: "TESTRIBUTOR_SSH_KNOWN_HOSTS",
+		usage: "more host keys in known_hosts format",
+		field: func(c *Config) interface{} { return &c.SshKnownHosts }},
+	{name: "executor", env: "TESTRIBUTOR_EXECUTOR",
+		usage: "where the commands run: \"" + EXECUTOR_LOCAL + "\", \"" + EXECUTOR_DOCKER + "\" or \"" + EXECUTOR_SSH + "\"",
+		field: func(c *Config) interface{} { return &c.Executor },
+		check: func(c *Config) error { _, err := ExecutorType(c); return err }},
+	{name: "executor_ssh_url", env: "TESTRIBUTOR_EXECUTOR_SSH_URL",
+		usage: "the machine (and directory) of the ssh executor",
+		field: func(c *Config) interface{} { return &c.ExecutorSshUrl }},
+	{name: "executor_ssh_key", env: "TESTRIBUTOR_EXECUTOR_SSH_KEY",
+		usage: "the private key file of the ssh executor",
+		field: func(c *Config) interface{} { return &c.ExecutorSshKey }},
+	{name: "docker_socket", env: "TESTRIBUTOR_DOCKER_SOCKET",
+		usage: "the Docker (or Podman) API socket (found automatically when empty)",
+		field: func(c *Config) interface{} { return &c.DockerSocket }},
+	{name: "docker_user", env: "TESTRIBUTOR_DOCKER_USER",
+		usage: "the user the commands run as in the container",
+		field: func(c *Config) interface{} { return &c.DockerUser }},
+	{name: "docker_network", env: "TESTRIBUTOR_DOCKER_NETWORK",
+		usage: "the network of the container",
+		field: func(c *Config) interface{} { return &c.DockerNetwork }},
+	{name: "worker_index", env: "TESTRIBUTOR_WORKER_INDEX",
+		usage: "the %{worker_index} of the project's files",
+		field: func(c *Config) interface{} { return &c.WorkerIndex }},
+	{name: "setup_data_refresh_seconds", env: "TESTRIBUTOR_SETUP_DATA_REFRESH_SECONDS",
+		usage: "how often the setup data are fetched again (0 to disable)",
+		field: func(c *Config) interface{} { return &c.SetupDataRefreshSeconds },
+		check: func(c *Config) error { _, err := SetupDataRefreshInterval(c); return err }},
+	{name: "job_order", env: "TESTRIBUTOR_JOB_ORDER",
+		usage: "\"" + JOB_ORDER_FIFO + "\", \"" + JOB_ORDER_LONGEST_FIRST + "\", \"" + JOB_ORDER_SHORTEST_FIRST +
+			"\" or \"" + JOB_ORDER_OLDEST_TEST_RUN_FIRST + "\"",
+		field: func(c *Config) interface{} { return &c.JobOrder },
+		check: func(c *Config) error { _, err := JobOrder(c); return err }},
+	{name: "job_logs_keep_test_runs", env: "TESTRIBUTOR_JOB_LOGS_KEEP_TEST_RUNS",
+		usage: "how many test runs the job logs are kept for (0 disables the job logs)",
+		field: func(c *Config) interface{} { return &c.JobLogsKeepTestRuns },
+		check: func(c *Config) error { _, err := NewJobLogs("", c); return err }},
+	{name: "job_logs_max_megabytes", env: "TESTRIBUTOR_JOB_LOGS_MAX_MEGABYTES",
+		usage: "the size of all the job logs we keep",
+		field: func(c *Config) interface{} { return &c.JobLogsMaxMegabytes },
+		check: func(c *Config) error { _, err := NewJobLogs("", c); return err }},
+	{name: "duration_history_path", env: "TESTRIBUTOR_DURATION_HISTORY_PATH",
+		usage: "the file the durations of the jobs are kept in",
+		field: func(c *Config) interface{} { return &c.DurationHistoryPath }},
+	{name: "work_stealing", env: "TESTRIBUTOR_WORK_STEALING",
+		usage: "share the queued jobs with the other agents of the project on this machine",
+		field: func(c *Config) interface{} { return &c.WorkStealing }},
+	{name: "coordination_dir", env: "TESTRIBUTOR_COORDINATION_DIR",
+		usage: "the directory where the agents sharing jobs find each other",
+		field: func(c *Config) interface{} { return &c.CoordinationDir }},
+	{name: "status_address", env: "TESTRIBUTOR_STATUS_ADDRESS",
+		usage: "the address of the status API (off when empty)",
+		field: func(c *Config) interface{} { return &c.StatusAddress }},
+	{name: "metrics", env: "TESTRIBUTOR_METRICS",
+		usage: "serve Prometheus metrics on the status API",
+		field: func(c *Config) interface{} { return &c.Metrics }},
+	{name: "log_level", env: "TESTRIBUTOR_LOG_LEVEL",
+		usage: "\"" + LOG_LEVEL_DEBUG + "\", \"" + LOG_LEVEL_INFO + "\", \"" + LOG_LEVEL_WARN + "\" or \"" + LOG_LEVEL_ERROR + "\"",
+		field: func(c *Config) interface{} { return &c.LogLevel },
+		check: func(c *Config) error { _, _, err := LogSettings(c); return err }},
+	{name: "log_format", env: "TESTRIBUTOR_LOG_FORMAT",
+		usage: "\"" + LOG_FORMAT_TEXT + "\" or \"" + LOG_FORMAT_JSON + "\"",
+		field: func(c *Config) interface{} { return &c.LogFormat },
+		check: func(c *Config) error { _, _, err := LogSettings(c); return err }},
+	{name: "tracing_endpoint", env: "TESTRIBUTOR_TRACING_ENDPOINT",
+		usage: "the OpenTelemetry collector the traces are sent to (OTEL_EXPORTER_OTLP_ENDPOINT when empty)",
+		field: func(c *Config) interface{} { return &c.TracingEndpoint },
+		check: func(c *Config) error { _, err := TracingEndpoint(c); return err }},
+}
+
+// DefaultConfig returns the config with the default values (without the
+// project's credentials).
+func DefaultConfig() *Config {
+	return &Config{
+		TestributorUrl:             DEFAULT_TESTRIBUTOR_URL,
+		MinWorkloadSeconds:         DEFAULT_MIN_WORKLOAD_SECONDS,
+		ReportingFrequencySeconds:  DEFAULT_REPORTING_FREQUENCY_SECONDS,
+		ActiveSendersLimit:         DEFAULT_ACTIVE_SENDERS_LIMIT,
+		BeaconThresholdSeconds:     DEFAULT_BEACON_THRESHOLD_SECONDS,
+		RequestErrorTimeoutSeconds: DEFAULT_REQUEST_ERROR_TIMEOUT_SECONDS,
+		ProjectDirectory:           DEFAULT_PROJECT_DIRECTORY,
+		GitBackend:                 GIT_BACKEND_SHELL,
+		SshHostKeyChecking:         HOST_KEY_CHECKING_STRICT,
+		Executor:                   EXECUTOR_LOCAL,
+		WorkerIndex:                DEFAULT_WORKER_INDEX,
+		SetupDataRefreshSeconds:    DEFAULT_SETUP_DATA_REFRESH_SECONDS,
+		JobOrder:                   JOB_ORDER_FIFO,
+		JobLogsKeepTestRuns:        DEFAULT_JOB_LOGS_KEEP_TEST_RUNS,
+		JobLogsMaxMegabytes:        DEFAULT_JOB_LOGS_MAX_MEGABYTES,
+		LogLevel:                   LOG_LEVEL_INFO,
+		LogFormat:                  LOG_FORMAT_TEXT,
+		sources:                    make(map[string]string),
+	}
+}
+
+// DefaultConfigPath returns the config file read when none is given with the
+// -config flag or TESTRIBUTOR_CONFIG. It is fine if it doesn't exist.
+func DefaultConfigPath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(configDir, "testributor", "agent.yml")
+}
+
+// LoadConfig reads the config file, the env variables and the flags in args
+// and validates the result. Flag errors (and the usage) are written to out.
+func LoadConfig(args []string, out io.Writer) (*Config, error) {
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	flags.SetOutput(out)
+	configPath := flags.String("config", "", "the config file (default: TESTRIBUTOR_CONFIG or "+DefaultConfigPath()+")")
+	for _, setting := range CONFIG_SETTINGS {
+		// Bool flags can be given without a value (e.g. -metrics)
+		if _, ok := setting.field(&Config{}).(*bool); ok {
+			flags.Bool(setting.flag(), false, setting.usage+" ("+setting.env+")")
+		} else {
+			flags.String(setting.flag(), "", setting.usage+" ("+setting.env+")")
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		// Like the flag errors
+		err := errors.New("Unexpected argument: " + flags.Arg(0))
+		fmt.Fprintln(out, err.Error())
+		flags.Usage()
+		return nil, err
+	}
+
+	config := DefaultConfig()
+
+	config.path = *configPath
+	if config.path == "" {
+		config.path = os.Getenv("TESTRIBUTOR_CONFIG")
+	}
+	if config.path != "" {
+		if err := config.readFile(true); err != nil {
+			return config, err
+		}
+	} else if config.path = DefaultConfigPath(); config.path != "" {
+		if err := config.readFile(false); err != nil {
+			return config, err
+		}
+	}
+
+	for _, setting := range CONFIG_SETTINGS {
+		if value := os.Getenv(setting.env); value != "" {
+			if err := config.set(setting, value, setting.env); err != nil {
+				return config, err
+			}
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range CONFIG_SETTINGS {
+			if f.Name == setting.flag() && err == nil {
+				err = config.set(setting, f.Value.String(), "-"+f.Name)
+			}
+		}
+	})
+	if err != nil {
+		return config, err
+	}
+
+	return config, config.Validate()
+}
+
+// readFile reads the config file. A missing file is an error only when it is
+// required.
+func (c *Config) readFile(required bool) error {
+	contents, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) && !required {
+		return nil
+	} else if err != nil {
+		return errors.New("Couldn't read the config file: " + err.Error())
+	}
+
+	// Strict so that misspelled settings aren't silently ignored
+	if err = yaml.UnmarshalStrict(contents, c); err != nil {
+		return errors.New("Invalid config file " + c.path + ": " + err.Error())
+	}
+
+	var keys map[string]interface{}
+	yaml.Unmarshal(contents, &keys)
+	for _, setting := range CONFIG_SETTINGS {
+		if _, ok := keys[setting.name]; ok {
+			c.sources[setting.name] = c.path
+		}
+	}
+
+	return nil
+}
+
+// set parses the value of the setting. source is where the value came from
+// (an env variable or a flag).
+func (c *Config) set(setting configSetting, value string, source string) error {
+	switch field := setting.field(c).(type) {
+	case *string:
+		*field = value
+	case *int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("Invalid " + source + " value: " + value + ". Use a whole number.")
+		}
+		*field = number
+	case *float64:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("Invalid " + source + " value: " + value + ". Use a number.")
+		}
+		*field = number
+	case *bool:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("Invalid " + source + " value: " + value + ". Use \"true\" or \"false\".")
+		}
+		*field = enabled
+	}
+	c.sources[setting.name] = source
+
+	return nil
+}
+
+// value returns the setting's value as text.
+func (c *Config) value(setting configSetting) string {
+	switch field := setting.field(c).(type) {
+	case *string:
+		return *field
+	case *int:
+		return strconv.Itoa(*field)
+	case *float64:
+		return strconv.FormatFloat(*field, 'f', -1, 64)
+	case *bool:
+		return strconv.FormatBool(*field)
+	}
+
+	return ""
+}
+
+// Validate returns an error for the first setting which doesn't make sense.
+// The URL of Testributor gets a trailing slash if it's missing.
+func (c *Config) Validate() error {
+	parsed, err := url.Parse(c.TestributorUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.New("Invalid testributor_url: " + c.TestributorUrl + ". Use e.g. " + DEFAULT_TESTRIBUTOR_URL)
+	}
+	if !strings.HasSuffix(c.TestributorUrl, "/") {
+		c.TestributorUrl += "/"
+	}
+
+	if c.AppId == "" {
+		return errors.New("APP_ID is not set. Set it in the config file (app_id), APP_ID or -app-id.")
+	}
+	if c.AppSecret == "" {
+		return errors.New("APP_SECRET is not set. Set it in the config file (app_secret), APP_SECRET or -app-secret.")
+	}
+
+	for _, setting := range CONFIG_SETTINGS {
+		if setting.check != nil {
+			if err := setting.check(c); err != nil {
+				return err
+			}
+			continue
+		}
+
+		positive := true
+		switch field := setting.field(c).(type) {
+		case *int:
+			positive = *field > 0
+		case *float64:
+			positive = *field > 0
+		}
+		if !positive {
+			return errors.New("Invalid " + setting.name + ": " + c.value(setting) + ". It must be more than 0.")
+		}
+	}
+
+	return nil
+}
+
+// ApiUrl returns the URL of Testributor's API.
+func (c *Config) ApiUrl() string {
+	return c.TestributorUrl + "api/v1/"
+}
+
+// Print writes the settings and where they came from in the format of the
+// config file. Secrets are redacted.
+func (c *Config) Print(out io.Writer) {
+	if c.path != "" {
+		if _, err := os.Stat(c.path); err != nil {
+			fmt.Fprintln(out, "# "+c.path+" (not found)")
+		} else {
+			fmt.Fprintln(out, "# "+c.path)
+		}
+	}
+
+	for _, setting := range CONFIG_SETTINGS {
+		value := c.value(setting)
+		if setting.secret && value != "" {
+			value = REDACTED_CONFIG_VALUE
+		}
+		if _, ok := setting.field(c).(*string); ok {
+			value = strconv.Quote(value)
+		}
+		source := c.sources[setting.name]
+		if source == "" {
+			source = "default"
+		}
+		fmt.Fprintln(out, setting.name+": "+value+" # "+source)
+	}
+}
+
+// RunConfigCommand implements the "config" subcommand which prints the config
+// the agent would run with. It returns the exit code.
+func RunConfigCommand(args []string, out io.Writer) int {
+	config, err := LoadConfig(args, out)
+	if config == nil {
+		return 2
+	}
+
+	config.Print(out)
+	if err != nil {
+		fmt.Fprintln(out, "Error: "+err.Error())
+		return 1
+	}
+
+	return 0
+}
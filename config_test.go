@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// setConfigEnv sets the env variables of the config (the rest are unset) and
+// returns a function which restores them.
+func setConfigEnv(env map[string]string) func() {
+	names := []string{"TESTRIBUTOR_CONFIG"}
+	for _, setting := range CONFIG_SETTINGS {
+		names = append(names, setting.env)
+	}
+
+	previous := make(map[string]string)
+	for _, name := range names {
+		previous[name] = os.Getenv(name)
+		os.Setenv(name, env[name])
+	}
+
+	return func() {
+		for name, value := range previous {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "testributor_config")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	path := filepath.Join(dir, "agent.yml")
+	if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+app_id: file_id
+app_secret: file_secret
+min_workload_seconds: 20.5
+reporting_frequency_seconds: 7
+git_backend: builtin
+work_stealing: true
+job_order: fifo
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer setConfigEnv(map[string]string{
+		"APP_ID": "env_id",
+		"TESTRIBUTOR_REPORTING_FREQUENCY_SECONDS": "8",
+		"TESTRIBUTOR_URL":                         "http://localhost:3000",
+		"TESTRIBUTOR_JOB_ORDER":                   "longest_first",
+		"TESTRIBUTOR_SETUP_DATA_REFRESH_SECONDS":  "0",
+	})()
+
+	config, err := LoadConfig([]string{"-config", path, "-reporting-frequency-seconds", "9", "-metrics"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expected := DefaultConfig()
+	expected.TestributorUrl = "http://localhost:3000/"
+	expected.AppId = "env_id"
+	expected.AppSecret = "file_secret"
+	expected.MinWorkloadSeconds = 20.5
+	expected.ReportingFrequencySeconds = 9
+	expected.GitBackend = GIT_BACKEND_BUILTIN
+	expected.WorkStealing = true
+	expected.JobOrder = JOB_ORDER_LONGEST_FIRST
+	expected.SetupDataRefreshSeconds = 0
+	expected.Metrics = true
+	config.path, config.sources, expected.sources = "", nil, nil
+	if !reflect.DeepEqual(config, expected) {
+		t.Error("Expected", *expected, "but got:", *config)
+	}
+	if config.ApiUrl() != "http://localhost:3000/api/v1/" {
+		t.Error("Expected the API of the local Testributor but got:", config.ApiUrl())
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	misspelled := writeConfigFile(t, "app_id: id\napp_secret: secret\nreporting_frequency: 3\n")
+	defer os.RemoveAll(filepath.Dir(misspelled))
+	credentials := map[string]string{"APP_ID": "id", "APP_SECRET": "secret"}
+	noFile := []string{"-config", os.DevNull}
+
+	for _, c := range []struct {
+		env      map[string]string
+		args     []string
+		expected string
+	}{
+		{map[string]string{}, noFile, "APP_ID is not set"},
+		{map[string]string{"APP_ID": "id"}, noFile, "APP_SECRET is not set"},
+		{credentials, []string{"-config", misspelled}, "field reporting_frequency not found"},
+		{credentials, []string{"-config", misspelled + ".missing"}, "Couldn't read the config file"},
+		{credentials, append(noFile, "-active-senders-limit", "0"), "Invalid active_senders_limit: 0"},
+		{credentials, append(noFile, "-min-workload-seconds", "ten"), "Invalid -min-workload-seconds value: ten"},
+		{credentials, append(noFile, "-testributor-url", "www.testributor.com"), "Invalid testributor_url"},
+		{map[string]string{"APP_ID": "id", "APP_SECRET": "secret", "TESTRIBUTOR_BEACON_THRESHOLD_SECONDS": "1.5"},
+			noFile, "Invalid TESTRIBUTOR_BEACON_THRESHOLD_SECONDS value: 1.5"},
+		{map[string]string{"APP_ID": "id", "APP_SECRET": "secret", "TESTRIBUTOR_CONFIG": misspelled},
+			nil, "field reporting_frequency not found"},
+		{map[string]string{"APP_ID": "id", "APP_SECRET": "secret", "TESTRIBUTOR_METRICS": "yes please"},
+			noFile, "Invalid TESTRIBUTOR_METRICS value: yes please"},
+		{map[string]string{"APP_ID": "id", "APP_SECRET": "secret", "TESTRIBUTOR_GIT_BACKEND": "libgit2"},
+			noFile, "Invalid git_backend: libgit2"},
+		{credentials, append(noFile, "-work-stealing=sometimes"), "invalid boolean value"},
+		{credentials, append(noFile, "-job-logs-max-megabytes", "-1"), "Invalid job_logs_max_megabytes: -1"},
+		{credentials, append(noFile, "-log-level", "verbose"), "Invalid log_level: verbose"},
+		{credentials, append(noFile, "-tracing-endpoint", "localhost:4318"), "Invalid tracing_endpoint"},
+	} {
+		restore := setConfigEnv(c.env)
+		_, err := LoadConfig(c.args, ioutil.Discard)
+		restore()
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Error("Expected", c.expected, "for", c.env, c.args, "but got:", err)
+		}
+	}
+
+	if config, err := LoadConfig([]string{"-unknown"}, ioutil.Discard); config != nil || err == nil {
+		t.Error("Expected an error for an unknown flag")
+	}
+	var out bytes.Buffer
+	if config, err := LoadConfig([]string{"run"}, &out); config != nil || err == nil ||
+		!strings.HasPrefix(out.String(), "Unexpected argument: run\n") {
+		t.Error("Expected an error printed for an unexpected argument but got:", err, out.String())
+	}
+}
+
+func TestRunConfigCommand(t *testing.T) {
+	defer setConfigEnv(map[string]string{"APP_ID": "id", "APP_SECRET": "very_secret",
+		"TESTRIBUTOR_REPOSITORY_TOKEN": "very_secret_token"})()
+
+	var out bytes.Buffer
+	if code := RunConfigCommand([]string{"-config", os.DevNull, "-active-senders-limit", "5"}, &out); code != 0 {
+		t.Fatal("Expected the config command to succeed but got:", code, out.String())
+	}
+	for _, line := range []string{
+		`testributor_url: "https://www.testributor.com/" # default`,
+		`app_id: "id" # APP_ID`,
+		`app_secret: "[redacted]" # APP_SECRET`,
+		`active_senders_limit: 5 # -active-senders-limit`,
+		`git_backend: "shell" # default`,
+		`repository_token: "[redacted]" # TESTRIBUTOR_REPOSITORY_TOKEN`,
+		`work_stealing: false # default`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Error("Expected", line, "in:", out.String())
+		}
+	}
+	if strings.Contains(out.String(), "very_secret") {
+		t.Error("Expected the secret to be redacted but got:", out.String())
+	}
+
+	// The output is a valid config file
+	path := writeConfigFile(t, out.String())
+	defer os.RemoveAll(filepath.Dir(path))
+	if _, err := LoadConfig([]string{"-config", path}, ioutil.Discard); err != nil {
+		t.Error("Expected the printed config to be readable but got:", err)
+	}
+
+	out.Reset()
+	os.Setenv("APP_ID", "")
+	if code := RunConfigCommand([]string{"-config", os.DevNull}, &out); code != 1 ||
+		!strings.Contains(out.String(), "Error: APP_ID is not set") {
+		t.Error("Expected the config command to report the invalid config but got:", code, out.String())
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/testributor/agent/system_command"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_DOCKER_SOCKET = "/var/run/docker.sock"
+	ROOTFUL_PODMAN_SOCKET = "/run/podman/podman.sock"
+	// The label of the containers we create (the value is the worker's uuid)
+	DOCKER_CONTAINER_LABEL = "com.testributor.worker_uuid"
+	// Keeps the container running until we remove it
+	DOCKER_CONTAINER_COMMAND = "trap 'exit 0' TERM; while :; do sleep 3600 & wait; done"
+)
+
+// DockerSocket returns the path of the Docker (or Podman) API socket. It can be
+// set with the docker_socket setting or DOCKER_HOST (unix sockets only).
+// Otherwise we use the first of the usual Docker and Podman sockets that exists.
+func DockerSocket(config *Config) string {
+	if config.DockerSocket != "" {
+		return config.DockerSocket
+	}
+	if dockerHost := os.Getenv("DOCKER_HOST"); strings.HasPrefix(dockerHost, "unix://") {
+		return strings.TrimPrefix(dockerHost, "unix://")
+	}
+
+	candidates := []string{DEFAULT_DOCKER_SOCKET, ROOTFUL_PODMAN_SOCKET}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		// Rootless Podman
+		candidates = append(candidates, filepath.Join(runtimeDir, "podman", "podman.sock"))
+	}
+	for _, socket := range candidates {
+		if _, err := os.Stat(socket); err == nil {
+			return socket
+		}
+	}
+
+	return DEFAULT_DOCKER_SOCKET
+}
+
+// DockerClient talks to the Docker Engine API over a unix socket. Podman
+// serves the same API so it works with Podman too.
+// https://docs.docker.com/engine/api/
+type DockerClient struct {
+	socket string
+	client http.Client
+}
+
+func NewDockerClient(socket string) *DockerClient {
+	return &DockerClient{
+		socket: socket,
+		client: http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// request makes a request to the API. When result is not nil, the JSON
+// response is decoded in it. Responses with an error status return an error
+// with the API's message.
+func (d *DockerClient) request(method string, path string, body interface{}, result interface{}) error {
+	resp, err := d.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+
+	return nil
+}
+
+func (d *DockerClient) do(method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	// The host is ignored since we always connect to the socket
+	request, err := http.NewRequest(method, "http://docker"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(request)
+	if err != nil {
+		return nil, errors.New("Couldn't connect to the Docker API on " + d.socket + ": " + err.Error())
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var apiError struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiError)
+		return nil, &DockerApiError{StatusCode: resp.StatusCode, Message: apiError.Message}
+	}
+
+	return resp, nil
+}
+
+// DockerApiError is returned when the API responds with an error status.
+type DockerApiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerApiError) Error() string {
+	return "Docker API error (" + strconv.Itoa(e.StatusCode) + "): " + e.Message
+}
+
+// Ping checks that the API is reachable.
+func (d *DockerClient) Ping() error {
+	return d.request("GET", "/_ping", nil, nil)
+}
+
+// PullImage pulls the image unless it already exists.
+func (d *DockerClient) PullImage(image string, logger Logger) error {
+	err := d.request("GET", "/images/"+image+"/json", nil, nil)
+	if err == nil {
+		return nil
+	}
+	if apiError, ok := err.(*DockerApiError); !ok || apiError.StatusCode != http.StatusNotFound {
+		return err
+	}
+
+	logger.Log("Pulling " + image)
+	name, tag := image, ""
+	// The tag follows the last colon unless that colon is part of a
+	// registry's port (e.g. registry.example.com:5000/ruby)
+	if colon := strings.LastIndex(image, ":"); colon > strings.LastIndex(image, "/") {
+		name, tag = image[:colon], image[colon+1:]
+	}
+	query := url.Values{"fromImage": {name}}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	resp, err := d.do("POST", "/images/create?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The progress is streamed as JSON messages. Errors are reported in them.
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return errors.New("Couldn't pull " + image + ": " + message.Error)
+		}
+	}
+}
+
+// DockerContainerOptions are the settings of the container running the
+// project's commands.
+type DockerContainerOptions struct {
+	Image      string
+	WorkingDir string
+	Binds      []string // "host_path:container_path[:ro]"
+	User       string
+	Network    string
+}
+
+// CreateContainer creates and starts a container which keeps running until it
+// is removed. It returns the container's id.
+func (d *DockerClient) CreateContainer(options DockerContainerOptions) (string, error) {
+	config := map[string]interface{}{
+		"Image":      options.Image,
+		"Cmd":        []string{"sh", "-c", DOCKER_CONTAINER_COMMAND},
+		"WorkingDir": options.WorkingDir,
+		"User":       options.User,
+		"Labels":     map[string]string{DOCKER_CONTAINER_LABEL: WorkerUUID},
+		"HostConfig": map[string]interface{}{
+			"Binds":       options.Binds,
+			"NetworkMode": options.Network,
+		},
+	}
+
+	var created struct {
+		Id string `json:"Id"`
+	}
+	if err := d.request("POST", "/containers/create", config, &created); err != nil {
+		return "", err
+	}
+
+	if err := d.request("POST", "/containers/"+created.Id+"/start", nil, nil); err != nil {
+		d.RemoveContainer(created.Id)
+		return "", err
+	}
+
+	return created.Id, nil
+}
+
+// RemoveContainer stops and removes the container.
+func (d *DockerClient) RemoveContainer(id string) error {
+	return d.request("DELETE", "/containers/"+id+"?force=true", nil, nil)
+}
+
+// Exec runs the command with sh in the container and returns a CommandResult
+// like system_command.Run does. The output is written to the logger while the
+// command runs.
+func (d *DockerClient) Exec(id string, command string, env []string, workingDir string, logger io.Writer) (system_command.CommandResult, error) {
+	commandStart := time.Now()
+
+	var exec struct {
+		Id string `json:"Id"`
+	}
+	err := d.request("POST", "/containers/"+id+"/exec", map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          []string{"sh", "-c", command},
+		"Env":          env,
+		"WorkingDir":   workingDir,
+	}, &exec)
+	if err != nil {
+		return system_command.CommandResult{}, err
+	}
+
+	resp, err := d.do("POST", "/exec/"+exec.Id+"/start", map[string]interface{}{"Detach": false, "Tty": false})
+	if err != nil {
+		return system_command.CommandResult{}, err
+	}
+	output, errorOutput, combined, err := demuxDockerStream(resp.Body, logger)
+	resp.Body.Close()
+	if err != nil {
+		return system_command.CommandResult{}, err
+	}
+
+	var inspect struct {
+		ExitCode int `json:"ExitCode"`
+	}
+	if err = d.request("GET", "/exec/"+exec.Id+"/json", nil, &inspect); err != nil {
+		return system_command.CommandResult{}, err
+	}
+
+	return system_command.CommandResult{
+		Output:          output,
+		Errors:          errorOutput,
+		CombinedOutput:  combined,
+		ResultType:      system_command.ResultType(inspect.ExitCode == 0, errorOutput),
+		Success:         inspect.ExitCode == 0,
+		ExitCode:        inspect.ExitCode,
+		DurationSeconds: time.Since(commandStart).Seconds(),
+	}, nil
+}
+
+// demuxDockerStream reads the output of a command run without a TTY. Each
+// frame has an 8 byte header: the stream (1 for stdout, 2 for stderr), 3 zero
+// bytes and the size of the payload (big endian uint32).
+// Like system_command.ReadUntilEOF, each line is written to the logger.
+func demuxDockerStream(stream io.Reader, logger io.Writer) (string, string, string, error) {
+	var output, errorOutput, combined bytes.Buffer
+	var pending [3]bytes.Buffer // Partial lines per stream
+	reader := bufio.NewReader(stream)
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", "", "", err
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return "", "", "", err
+		}
+
+		streamType := header[0]
+		if streamType == 2 {
+			errorOutput.Write(payload)
+		} else {
+			streamType = 1
+			output.Write(payload)
+		}
+		combined.Write(payload)
+
+		pending[streamType].Write(payload)
+		for {
+			line, err := pending[streamType].ReadString('\n')
+			if err != nil {
+				// Not a full line yet. Keep it for the next frame.
+				pending[streamType].Reset()
+				pending[streamType].WriteString(line)
+				break
+			}
+			logger.Write([]byte(strings.TrimSuffix(line, "\n")))
+		}
+	}
+
+	for _, buffer := range pending[1:] {
+		if buffer.Len() > 0 {
+			logger.Write(buffer.Bytes())
+		}
+	}
+
+	return output.String(), errorOutput.String(), combined.String(), nil
+}
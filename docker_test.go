@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// dockerFrame returns a frame of a multiplexed exec stream.
+func dockerFrame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+
+	return append(header, []byte(payload)...)
+}
+
+// fakeDockerApi serves the parts of the Docker API we use on a unix socket.
+// Commands "print" some output and exit with 3.
+type fakeDockerApi struct {
+	sync.Mutex
+	images     map[string]bool
+	containers map[string]map[string]interface{}
+	execs      map[string]map[string]interface{}
+}
+
+func startFakeDockerApi(t *testing.T, socket string) (*fakeDockerApi, func()) {
+	api := &fakeDockerApi{
+		images:     map[string]bool{"ruby:2.3.0": true},
+		containers: make(map[string]map[string]interface{}),
+		execs:      make(map[string]map[string]interface{}),
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	server := &http.Server{Handler: api}
+	go server.Serve(listener)
+
+	return api, func() { server.Close() }
+}
+
+func (api *fakeDockerApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.Lock()
+	defer api.Unlock()
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.URL.Path == "/_ping":
+		w.Write([]byte("OK"))
+	case parts[0] == "images" && r.Method == "GET":
+		if !api.images[strings.Join(parts[1:len(parts)-1], "/")] {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "No such image"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	case r.URL.Path == "/images/create":
+		if r.URL.Query().Get("fromImage") == "missing" {
+			w.Write([]byte(`{"status": "Pulling"}{"error": "manifest unknown"}`))
+			return
+		}
+		api.images[r.URL.Query().Get("fromImage")+":"+r.URL.Query().Get("tag")] = true
+		w.Write([]byte(`{"status": "Pulling"}{"status": "Done"}`))
+	case r.URL.Path == "/containers/create":
+		id := strings.Repeat("c", 64)
+		api.containers[id] = body
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id": "` + id + `"}`))
+	case parts[0] == "containers" && r.Method == "DELETE":
+		delete(api.containers, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "containers" && parts[2] == "start":
+		w.WriteHeader(http.StatusNoContent)
+	case parts[0] == "containers" && parts[2] == "exec":
+		id := strings.Repeat("e", 64)
+		api.execs[id] = body
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id": "` + id + `"}`))
+	case parts[0] == "exec" && parts[2] == "start":
+		w.Header().Set("Content-Type", "application/vnd.docker.raw-stream")
+		w.Write(dockerFrame(1, "first line\nsecond "))
+		w.Write(dockerFrame(2, "an error\n"))
+		w.Write(dockerFrame(1, "line\n"))
+	case parts[0] == "exec" && parts[2] == "json":
+		w.Write([]byte(`{"ExitCode": 3}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "unexpected request"}`))
+	}
+}
+
+func TestDockerSocket(t *testing.T) {
+	defer os.Setenv("DOCKER_HOST", os.Getenv("DOCKER_HOST"))
+	config := DefaultConfig()
+
+	os.Setenv("DOCKER_HOST", "unix:///run/user/1000/docker.sock")
+	if socket := DockerSocket(config); socket != "/run/user/1000/docker.sock" {
+		t.Error("It should use DOCKER_HOST but got: ", socket)
+	}
+
+	config.DockerSocket = "/tmp/podman.sock"
+	if socket := DockerSocket(config); socket != "/tmp/podman.sock" {
+		t.Error("It should use docker_socket but got: ", socket)
+	}
+}
+
+func TestDemuxDockerStream(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(dockerFrame(1, "out 1\nout"))
+	stream.Write(dockerFrame(2, "err 1\n"))
+	stream.Write(dockerFrame(1, " 2\nout 3"))
+
+	var logged []string
+	logger := writerFunc(func(p []byte) (int, error) {
+		logged = append(logged, string(p))
+		return len(p), nil
+	})
+	output, errorOutput, combined, err := demuxDockerStream(&stream, logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if output != "out 1\nout 2\nout 3" || errorOutput != "err 1\n" || combined != "out 1\nouterr 1\n 2\nout 3" {
+		t.Error("Unexpected output: ", output, errorOutput, combined)
+	}
+	if expected := []string{"out 1", "err 1", "out 2", "out 3"}; !reflect.DeepEqual(logged, expected) {
+		t.Error("Expected ", expected, " to be logged but got ", logged)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
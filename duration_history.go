@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How many of the latest durations we keep per command
+	DURATION_HISTORY_SAMPLES = 20
+	// How often (at most) the history is written to the disk
+	DURATION_HISTORY_SAVE_INTERVAL_SECONDS = 30
+	// Locks of the history file without a pid older than this were left behind
+	// by an agent which crashed while taking the lock
+	DURATION_HISTORY_STALE_LOCK_SECONDS = 10
+)
+
+// DurationHistoryPath returns the file the durations of the jobs are kept in.
+// It can be set with the duration_history_path setting. By default it lives in
+// the user's cache directory so it survives restarts and git clean.
+func DurationHistoryPath(config *Config) string {
+	if config.DurationHistoryPath != "" {
+		return config.DurationHistoryPath
+	}
+
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+
+	return filepath.Join(cacheDir, "testributor", "durations.json")
+}
+
+// DurationHistory keeps the latest durations of the jobs we ran, per
+// repository and command. The Manager uses them to estimate the jobs
+// and reports them with the jobs so Testributor's predictions improve. All
+// the methods work on a nil history (nothing is kept).
+//
+// The agents on a machine share the file. Each one adds the durations it
+// recorded to the ones in the file when it saves (see Save).
+type DurationHistory struct {
+	path       string
+	repository string
+	logger     Logger
+	mutex      sync.Mutex
+	// repository -> command -> durations in seconds (oldest first)
+	durations map[string]map[string][]float64
+	// command -> durations recorded since the last save (oldest first)
+	pending map[string][]float64
+	savedAt time.Time
+	saving  bool // Record started a Save which hasn't finished
+}
+
+// LoadDurationHistory reads the history in path. The durations of repository
+// are the ones used and recorded. A missing or broken file starts an empty
+// history.
+func LoadDurationHistory(path string, repository string, logger Logger) *DurationHistory {
+	history := &DurationHistory{
+		path:       path,
+		repository: repository,
+		logger:     logger,
+		durations:  make(map[string]map[string][]float64),
+		savedAt:    time.Now(),
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history
+	}
+	if err == nil {
+		err = json.Unmarshal(contents, &history.durations)
+	}
+	if err != nil {
+		logger.Warn("Couldn't read the duration history in " + path + ". Starting a new one: " + err.Error())
+		history.durations = make(map[string]map[string][]float64)
+	}
+
+	return history
+}
+
+// Record adds the duration of a command's run. The history is saved in the
+// background if DURATION_HISTORY_SAVE_INTERVAL_SECONDS have passed since the
+// last save so the caller never waits for the lock of the file.
+func (h *DurationHistory) Record(command string, seconds float64) {
+	if h == nil || command == "" || seconds <= 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	commands := h.durations[h.repository]
+	if commands == nil {
+		commands = make(map[string][]float64)
+		h.durations[h.repository] = commands
+	}
+	commands[command] = appendSamples(commands[command], seconds)
+	if h.pending == nil {
+		h.pending = make(map[string][]float64)
+	}
+	h.pending[command] = appendSamples(h.pending[command], seconds)
+	saveNeeded := !h.saving && time.Since(h.savedAt) >= DURATION_HISTORY_SAVE_INTERVAL_SECONDS*time.Second
+	if saveNeeded {
+		h.saving = true
+	}
+	h.mutex.Unlock()
+
+	if saveNeeded {
+		go func() {
+			if err := h.Save(); err != nil {
+				h.logger.Warn("Couldn't save the duration history: " + err.Error())
+			}
+			h.mutex.Lock()
+			h.saving = false
+			h.mutex.Unlock()
+		}()
+	}
+}
+
+// Percentiles returns the median and the 95th percentile of the command's
+// durations. ok is false when we never ran the command.
+func (h *DurationHistory) Percentiles(command string) (p50 float64, p95 float64, ok bool) {
+	if h == nil {
+		return 0, 0, false
+	}
+
+	h.mutex.Lock()
+	samples := append([]float64(nil), h.durations[h.repository][command]...)
+	h.mutex.Unlock()
+
+	if len(samples) == 0 {
+		return 0, 0, false
+	}
+	sort.Float64s(samples)
+
+	return percentile(samples, 50), percentile(samples, 95), true
+}
+
+// appendSamples appends the durations and keeps the latest
+// DURATION_HISTORY_SAMPLES.
+func appendSamples(samples []float64, seconds ...float64) []float64 {
+	samples = append(samples, seconds...)
+	if len(samples) > DURATION_HISTORY_SAMPLES {
+		samples = samples[len(samples)-DURATION_HISTORY_SAMPLES:]
+	}
+
+	return samples
+}
+
+// percentile returns the nearest-rank percentile of the sorted samples.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
+
+// Save adds the durations recorded since the last save to the ones in the
+// file (other agents might have saved theirs in the meantime) and writes the
+// result. The file is locked while it is updated and replaced atomically so a
+// crash never leaves half of it. Durations recorded while saving are kept for
+// the next save.
+func (h *DurationHistory) Save() error {
+	if h == nil {
+		return nil
+	}
+
+	h.mutex.Lock()
+	saving := h.pending
+	h.pending = nil
+	h.mutex.Unlock()
+
+	if len(saving) == 0 {
+		return nil
+	}
+
+	durations, err := h.merge(saving)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err != nil {
+		// Keep them for the next save (before the ones recorded meanwhile)
+		for command, samples := range h.pending {
+			saving[command] = appendSamples(saving[command], samples...)
+		}
+		h.pending = saving
+		return err
+	}
+
+	commands := durations[h.repository]
+	for command, samples := range h.pending {
+		commands[command] = appendSamples(commands[command], samples...)
+	}
+	h.durations = durations
+	h.savedAt = time.Now()
+
+	return nil
+}
+
+// merge adds the pending durations to the ones in the file and writes it. It
+// returns all the durations in the file.
+func (h *DurationHistory) merge(pending map[string][]float64) (map[string]map[string][]float64, error) {
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(h.path+".lock", DURATION_HISTORY_STALE_LOCK_SECONDS*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// A broken file is replaced like LoadDurationHistory does
+	durations := make(map[string]map[string][]float64)
+	contents, err := ioutil.ReadFile(h.path)
+	if err == nil && json.Unmarshal(contents, &durations) != nil {
+		durations = make(map[string]map[string][]float64)
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	commands := durations[h.repository]
+	if commands == nil {
+		commands = make(map[string][]float64)
+		durations[h.repository] = commands
+	}
+	for command, samples := range pending {
+		commands[command] = appendSamples(commands[command], samples...)
+	}
+
+	contents, err = json.Marshal(durations)
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(h.path), ".durations_")
+	if err != nil {
+		return nil, err
+	}
+	_, err = file.Write(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), h.path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	return durations, nil
+}
+
+// lockFile creates the lock file at path with our pid in it, waiting while
+// another process holds it. A lock is only taken over when the process whose
+// pid it has is gone (it crashed before removing it) or, for a lock without a
+// pid, when it is older than stale. It returns the function which releases
+// the lock.
+func lockFile(path string, stale time.Duration) (func(), error) {
+	deadline := time.Now().Add(2 * stale)
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, err = file.WriteString(strconv.Itoa(os.Getpid()))
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		if lockAbandoned(path, stale) {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("Timed out waiting for the lock " + path)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// lockAbandoned returns true when the process which created the lock file is
+// gone. The pid is written right after the file is created so a lock without
+// one is only abandoned when it's older than stale.
+func lockAbandoned(path string, stale time.Duration) bool {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(contents))); err == nil {
+		return !processAlive(pid)
+	}
+	info, err := os.Stat(path)
+
+	return err == nil && time.Since(info.ModTime()) > stale
+}
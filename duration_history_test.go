@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDurationHistoryPercentiles(t *testing.T) {
+	history := LoadDurationHistory(filepath.Join(os.TempDir(), "missing", "durations.json"),
+		"git@github.com:testributor/katana.git", Logger{prefix: "", writer: ioutil.Discard})
+
+	if _, _, ok := history.Percentiles("bin/rspec"); ok {
+		t.Error("Expected no durations for a command we never ran")
+	}
+
+	for i := 1; i <= 30; i++ {
+		history.Record("bin/rspec", float64(i))
+	}
+	// Only the latest 20 (11 to 30) are kept
+	p50, p95, ok := history.Percentiles("bin/rspec")
+	if !ok || p50 != 20 || p95 != 29 {
+		t.Error("Expected a p50 of 20 and a p95 of 29 but got:", p50, p95, ok)
+	}
+
+	// Durations which don't make sense are ignored
+	history.Record("bin/cucumber", 0)
+	if _, _, ok := history.Percentiles("bin/cucumber"); ok {
+		t.Error("Expected no durations for bin/cucumber")
+	}
+
+	var nilHistory *DurationHistory
+	nilHistory.Record("bin/rspec", 1)
+	if _, _, ok := nilHistory.Percentiles("bin/rspec"); ok || nilHistory.Save() != nil {
+		t.Error("A nil history should keep nothing")
+	}
+}
+
+func TestDurationHistorySave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_history_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testributor", "durations.json")
+	logger := Logger{prefix: "", writer: ioutil.Discard}
+
+	history := LoadDurationHistory(path, "katana", logger)
+	history.Record("bin/rspec", 3)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected the history to be saved after DURATION_HISTORY_SAVE_INTERVAL_SECONDS")
+	}
+	if err := history.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Durations are kept per repository
+	if p50, _, ok := LoadDurationHistory(path, "katana", logger).Percentiles("bin/rspec"); !ok || p50 != 3 {
+		t.Error("Expected the saved durations to be loaded but got:", p50, ok)
+	}
+	if _, _, ok := LoadDurationHistory(path, "other", logger).Percentiles("bin/rspec"); ok {
+		t.Error("Expected no durations for another repository")
+	}
+
+	// A broken file starts a new history
+	ioutil.WriteFile(path, []byte("{"), 0600)
+	if _, _, ok := LoadDurationHistory(path, "katana", logger).Percentiles("bin/rspec"); ok {
+		t.Error("Expected an empty history")
+	}
+
+	// Durations which couldn't be saved are kept for the next save
+	unsaved := LoadDurationHistory(filepath.Join(path, "durations.json"), "katana", logger)
+	unsaved.Record("bin/rspec", 5)
+	if err := unsaved.Save(); err == nil || len(unsaved.pending["bin/rspec"]) != 1 {
+		t.Error("Expected an error and the duration to be kept but got:", err, unsaved.pending)
+	}
+}
+
+func TestDurationHistorySaveMergesAgents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_history_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "durations.json")
+	logger := Logger{prefix: "", writer: ioutil.Discard}
+
+	// Two agents of the same project and one of another project start with
+	// the same file
+	first := LoadDurationHistory(path, "katana", logger)
+	second := LoadDurationHistory(path, "katana", logger)
+	other := LoadDurationHistory(path, "other", logger)
+	first.Record("bin/rspec", 2)
+	second.Record("bin/rspec", 4)
+	second.Record("bin/cucumber", 10)
+	other.Record("bin/rspec", 100)
+	for _, history := range []*DurationHistory{first, second, other} {
+		if err := history.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history := LoadDurationHistory(path, "katana", logger)
+	if p50, p95, ok := history.Percentiles("bin/rspec"); !ok || p50 != 2 || p95 != 4 {
+		t.Error("Expected the durations of both agents but got:", p50, p95, ok)
+	}
+	if _, _, ok := history.Percentiles("bin/cucumber"); !ok {
+		t.Error("Expected the durations of bin/cucumber")
+	}
+	if p50, _, ok := LoadDurationHistory(path, "other", logger).Percentiles("bin/rspec"); !ok || p50 != 100 {
+		t.Error("Expected the durations of the other project but got:", p50, ok)
+	}
+	// The agent which saved last sees the durations of the others too
+	if p50, p95, _ := other.Percentiles("bin/rspec"); p50 != 100 || p95 != 100 {
+		t.Error("Expected only the other project's durations but got:", p50, p95)
+	}
+	if p50, p95, _ := second.Percentiles("bin/rspec"); p50 != 2 || p95 != 4 {
+		t.Error("Expected the second agent to get the first one's durations but got:", p50, p95)
+	}
+
+	// Saving twice doesn't add the durations again
+	if err := first.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if p50, p95, _ := LoadDurationHistory(path, "katana", logger).Percentiles("bin/rspec"); p50 != 2 || p95 != 4 {
+		t.Error("Expected the durations to be saved once but got:", p50, p95)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_lock_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "durations.json.lock")
+
+	// A lock of a process which is still running is never taken over
+	if _, err = lockFile(path, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := ioutil.ReadFile(path); string(contents) != strconv.Itoa(os.Getpid()) {
+		t.Error("Expected our pid in the lock but got:", string(contents))
+	}
+	if _, err = lockFile(path, 100*time.Millisecond); err == nil {
+		t.Error("Expected to time out waiting for the lock of a running process")
+	}
+
+	// A lock of a process which is gone (like a crashed agent) is taken at once
+	exited := exec.Command("true")
+	if err = exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, []byte(strconv.Itoa(exited.Process.Pid)), 0600)
+	start := time.Now()
+	unlock, err := lockFile(path, time.Minute)
+	if err != nil || time.Since(start) > time.Second {
+		t.Fatal("Expected to take the lock of the exited process but got:", err)
+	}
+	unlock()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected the lock file to be removed")
+	}
+
+	// A lock without a pid is taken when it's stale
+	ioutil.WriteFile(path, nil, 0600)
+	start = time.Now()
+	if _, err = lockFile(path, 100*time.Millisecond); err != nil || time.Since(start) < 100*time.Millisecond {
+		t.Fatal("Expected to take the stale lock after waiting but got:", err)
+	}
+}
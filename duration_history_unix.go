@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import (
+	"syscall"
+)
+
+// processAlive returns true when a process with the pid exists. Signal 0
+// only checks whether the process could be signalled (EPERM means it exists
+// but belongs to another user).
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || err == syscall.EPERM
+}
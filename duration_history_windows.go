@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+)
+
+// processAlive returns true when a process with the pid exists. On Windows
+// FindProcess opens the process so it fails for processes which are gone.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+
+	return true
+}
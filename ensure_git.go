@@ -4,14 +4,60 @@ import (
 	"errors"
 	"github.com/testributor/agent/system_command"
 	"io/ioutil"
+	"os"
 	"os/exec"
 	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
 )
 
+const (
+	// We need a version greater or equal to 2.3 in order to use the
+	// GIT_SSH_COMMAND feature. We need this feature to be able to use our custom
+	// ssh config file when pulling the repo from the VCS (GitHub, Bitbucket, etc).
+	MIN_GIT_VERSION = "2.3"
+	// HTTPS repositories need GIT_CONFIG_COUNT to configure our credential helper.
+	MIN_GIT_VERSION_FOR_HTTPS = "2.31"
+
+	OS_RELEASE_PATH = "/etc/os-release"
+)
+
+// The commands used to install git with each package manager.
+var GIT_INSTALL_COMMANDS = map[string]string{
+	"apt-get": "apt-get update && apt-get install -y git",
+	"pacman":  "pacman -S --noconfirm git",
+	"apk":     "apk add --no-cache git",
+	"dnf":     "dnf install -y git",
+	"yum":     "yum install -y git",
+	"zypper":  "zypper --non-interactive install git",
+}
+
+// The package managers to try (in order) for each distribution ID. The IDs
+// are the ones found in the ID and ID_LIKE fields of /etc/os-release.
+var DISTRO_PACKAGE_MANAGERS = map[string][]string{
+	"debian":    {"apt-get"},
+	"ubuntu":    {"apt-get"},
+	"arch":      {"pacman"},
+	"alpine":    {"apk"},
+	"fedora":    {"dnf", "yum"},
+	"rhel":      {"dnf", "yum"},
+	"centos":    {"dnf", "yum"},
+	"amzn":      {"dnf", "yum"},
+	"suse":      {"zypper"},
+	"opensuse":  {"zypper"},
+	"sles":      {"zypper"},
+	"almalinux": {"dnf", "yum"},
+	"rocky":     {"dnf", "yum"},
+}
+
+// lookPath is exec.LookPath. It is a variable so tests can pretend some
+// commands exist.
+var lookPath = exec.LookPath
+
 // This function checks if Git is installed. If not it tries to install it.
 // It will return an error if unsuccessful.
-func EnsureGit(logger Logger) error {
+func EnsureGit(config *Config, logger Logger) error {
 	foundGit, err := CheckForGit(logger)
 	if err != nil {
 		return err
@@ -24,31 +70,92 @@ func EnsureGit(logger Logger) error {
 		case "windows":
 			return WindowsInstallGit(logger)
 		case "linux":
-			return LinuxInstallGit(logger)
+			err = LinuxInstallGit(config, logger)
 		case "darwin":
 			return MacInstallGit(logger)
 		}
+		if err != nil {
+			return err
+		}
+
+		return CheckGitVersion(MIN_GIT_VERSION, logger)
 	}
 
 	return nil
 }
 
-// CheckForSuitableGitVersion checks if a suitable Git version (> 2.3) is present on the
-// current operating system.
-// We need a version greater or equal to 2.3 in order to use the SSH_GIT_COMMAND
-// feature. We need this feature to be able to use our custom ssh config file
-// when pulling the repo from the VCS (GitHub, Bitbucket, etc).
+// CheckForGit checks if a suitable Git version (>= MIN_GIT_VERSION) is present
+// on the current operating system. It returns false when git is not found
+// and an error when the version found is too old.
 func CheckForGit(logger Logger) (bool, error) {
 	logger.Log("Checking if git command is available...")
 
-	path, err := exec.LookPath("git")
-	if err == nil {
-		logger.Log("Found git executable: " + path)
-		return true, nil
-	} else {
-		logger.Log("Couldn't find git executable")
+	path, err := lookPath("git")
+	if err != nil {
+		logger.Warn("Couldn't find git executable")
 		return false, nil
 	}
+	logger.Log("Found git executable: " + path)
+
+	return true, CheckGitVersion(MIN_GIT_VERSION, logger)
+}
+
+// GitVersion returns the version of the installed git (e.g. "2.39.2").
+func GitVersion() (string, error) {
+	res, err := system_command.Run("git --version", ioutil.Discard)
+	if err != nil {
+		return "", err
+	}
+
+	return ParseGitVersion(res.Output)
+}
+
+// ParseGitVersion extracts the version from the output of `git --version`
+// (e.g. "git version 2.39.2" or "git version 2.37.1 (Apple Git-137.1)").
+func ParseGitVersion(output string) (string, error) {
+	match := regexp.MustCompile(`git version (\d+(\.\d+)*)`).FindStringSubmatch(output)
+	if match == nil {
+		return "", errors.New("Couldn't find the git version in: " + output)
+	}
+
+	return match[1], nil
+}
+
+// VersionAtLeast returns true when version is greater or equal to minimum.
+// Both are dot separated numbers (e.g. "2.3" or "2.39.2").
+func VersionAtLeast(version string, minimum string) bool {
+	versionParts := strings.Split(version, ".")
+	minimumParts := strings.Split(minimum, ".")
+
+	for i, minimumPart := range minimumParts {
+		wanted, _ := strconv.Atoi(minimumPart)
+		found := 0
+		if i < len(versionParts) {
+			found, _ = strconv.Atoi(versionParts[i])
+		}
+
+		if found != wanted {
+			return found > wanted
+		}
+	}
+
+	return true
+}
+
+// CheckGitVersion returns an error if the installed git is older than minimum.
+func CheckGitVersion(minimum string, logger Logger) error {
+	version, err := GitVersion()
+	if err != nil {
+		return err
+	}
+
+	if !VersionAtLeast(version, minimum) {
+		return errors.New("Found git " + version + " but git " + minimum +
+			" or newer is needed. Please upgrade it and run the agent again.")
+	}
+	logger.Log("Git version " + version + " is suitable.")
+
+	return nil
 }
 
 func WindowsInstallGit(logger Logger) error {
@@ -61,90 +168,140 @@ func MacInstallGit(logger Logger) error {
 
 // This function assumes we are on a linux system and tries to find the distro
 // type (debian based, fedora based etc). If "git" command is not available,
-// it will try to install git using the system's package manager. If that is
-// not possible (e.g. permission denied), it will simply return and error.
+// it will try to install git using the system's package manager (through sudo
+// when we are not root). If that is not possible (e.g. permission denied),
+// it will simply return and error.
+// With the dry_run_install setting, the command is only printed.
 // This list of commands can be useful: https://git-scm.com/download/linux
-func LinuxInstallGit(logger Logger) error {
-	distribution, _ := DetectLinuxDistro(logger)
+func LinuxInstallGit(config *Config, logger Logger) error {
+	distroIds := DetectLinuxDistro(logger)
 
-	distroFuncMap := map[string](func(Logger) error){
-		"Debian": InstallGitOnDebian,
-		"Ubuntu": InstallGitOnDebian,
-		"Arch":   InstallGitOnArch,
+	packageManager := PackageManagerFor(distroIds)
+	if packageManager == "" {
+		packageManager = GuessPackageManager(logger)
+	}
+	if packageManager == "" {
+		return errors.New("I don't know how to install git on your distribution.\n Please install Git and run the agent again.")
 	}
 
-	for distro, function := range distroFuncMap {
-		matched, err := regexp.MatchString(distro, distribution)
-		if err != nil {
-			return err
-		}
+	command, err := InstallCommand(packageManager, os.Geteuid())
+	if err != nil {
+		return err
+	}
 
-		if matched {
-			return function(logger)
-		}
+	if config.DryRunInstall {
+		logger.Log("Dry run. I would install git with: " + command)
+		return errors.New("Git was not installed (dry run).")
+	}
+
+	logger.Log("Trying with " + packageManager + ".")
+	res, err := system_command.Run(command, logger)
+	if err == nil && !res.Success {
+		// Stderr is already written no need to return it.
+		return errors.New("I wasn't able to install git. Please install it manually and run the agent again.")
 	}
 
-	return errors.New("I don't know how to install git on your distribution.\n Please install Git and run the agent again.")
+	return err
 }
 
-// DetectLinuxDistro tryied to find the current linux distribution name using
-// lsb_release if present or else guesses a distribution based on the package
-// manager found (e.g. apt-get -> Debian). Even if wrong, it will work in most
-// cases. E.g. `apt-get install -y git` will work both on Ubuntu and Debian.
-func DetectLinuxDistro(logger Logger) (string, error) {
-	distribution := ""
-	if _, err := exec.LookPath("lsb_release"); err == nil {
+// DetectLinuxDistro returns the IDs of the current linux distribution and the
+// ones it is based on (e.g. ["ubuntu", "debian"]) as found in /etc/os-release.
+// When that file doesn't exist, it tries lsb_release.
+func DetectLinuxDistro(logger Logger) []string {
+	if contents, err := ioutil.ReadFile(OS_RELEASE_PATH); err == nil {
+		osRelease := ParseOsRelease(string(contents))
+		ids := append([]string{osRelease["ID"]}, strings.Fields(osRelease["ID_LIKE"])...)
+		logger.Log("We seem to be on " + osRelease["PRETTY_NAME"] + " (" + strings.Join(ids, ", ") + ").")
+		return ids
+	}
+
+	if _, err := lookPath("lsb_release"); err == nil {
 		distributorID, err := system_command.Run("lsb_release -i", ioutil.Discard)
 		if err == nil {
-			re := regexp.MustCompile(`Distributor ID:	(.*)`)
-			match := re.FindAllStringSubmatch(distributorID.Output, -1)
-			if match != nil && match[0][1] != "" {
-				distribution = match[0][1]
-				logger.Log("We seem to be on " + distribution + ".")
-				return distribution, nil
-			} else {
-				return "", nil
+			re := regexp.MustCompile(`Distributor ID:\s*(.*)`)
+			if match := re.FindStringSubmatch(distributorID.Output); match != nil && match[1] != "" {
+				logger.Log("We seem to be on " + match[1] + ".")
+				return []string{strings.ToLower(strings.TrimSpace(match[1]))}
 			}
-		} else {
-			return "", err
 		}
-	} else {
-		logger.Log("Could not determine the Linux distribution.")
-
-		// Try blindly with package managers
-		if _, err := exec.LookPath("apt-get"); err == nil {
-			logger.Log("Found apt-get. I will assume we are on Debian and see how it goes.")
-			return "Debian", nil
-		} else if _, err := exec.LookPath("pacman"); err == nil {
-			logger.Log("Found apt-get. I will assume we are on Arch and see how it goes.")
-			return "Arch", nil
+	}
+
+	logger.Log("Could not determine the Linux distribution.")
+	return nil
+}
+
+// ParseOsRelease parses the contents of an os-release file.
+// https://www.freedesktop.org/software/systemd/man/os-release.html
+func ParseOsRelease(contents string) map[string]string {
+	result := make(map[string]string)
+
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value := parts[1]
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
 		} else {
-			logger.Log("Didn't find a package manager I can use either.")
-			return "", nil
+			value = strings.Trim(value, `'"`)
 		}
+		result[parts[0]] = value
 	}
 
-	return "", nil
+	return result
 }
 
-func InstallGitOnDebian(logger Logger) error {
-	logger.Log("Trying with apt-get.")
-	res, err := system_command.Run("apt-get update && apt-get install -y git", logger)
-	if err == nil && !res.Success {
-		// Stderr is already written no need to return it.
-		return errors.New("I wasn't able to install git. Please install it manually and run the agent again.")
+// PackageManagerFor returns the first package manager available for the
+// given distribution IDs or an empty string if none is found.
+func PackageManagerFor(distroIds []string) string {
+	for _, id := range distroIds {
+		// e.g. "opensuse-leap" or "opensuse-tumbleweed"
+		id = strings.Split(strings.ToLower(id), "-")[0]
+
+		for _, packageManager := range DISTRO_PACKAGE_MANAGERS[id] {
+			if _, err := lookPath(packageManager); err == nil {
+				return packageManager
+			}
+		}
 	}
 
-	return err
+	return ""
 }
 
-func InstallGitOnArch(logger Logger) error {
-	logger.Log("Trying with pacman.")
-	res, err := system_command.Run("pacman -S --noconfirm git", logger)
-	if err == nil && !res.Success {
-		// Stderr is already written no need to return it.
-		return errors.New("I wasn't able to install git. Please install it manually and run the agent again.")
+// GuessPackageManager returns the first package manager we know found in
+// PATH. Even if wrong about the distribution, it will work in most cases.
+// E.g. `apt-get install -y git` will work both on Ubuntu and Debian.
+func GuessPackageManager(logger Logger) string {
+	for _, packageManager := range []string{"apt-get", "apk", "dnf", "yum", "zypper", "pacman"} {
+		if _, err := lookPath(packageManager); err == nil {
+			logger.Log("Found " + packageManager + ". I will use it and see how it goes.")
+			return packageManager
+		}
 	}
 
-	return err
+	logger.Log("Didn't find a package manager I can use either.")
+	return ""
+}
+
+// InstallCommand returns the command installing git with packageManager.
+// When we are not root (uid != 0), the command is run through sudo. sudo is
+// run non interactively (-n) so it fails instead of waiting for a password.
+func InstallCommand(packageManager string, uid int) (string, error) {
+	command := GIT_INSTALL_COMMANDS[packageManager]
+	if uid == 0 {
+		return command, nil
+	}
+
+	if _, err := lookPath("sudo"); err != nil {
+		return "", errors.New("I need root privileges to install git but I am not root and sudo is not available. " +
+			"Please install git manually and run the agent again.")
+	}
+
+	return "sudo -n sh -c '" + command + "'", nil
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+// fakeLookPath makes lookPath find only the given commands.
+func fakeLookPath(commands ...string) func() {
+	lookPath = func(file string) (string, error) {
+		for _, command := range commands {
+			if command == file {
+				return "/usr/bin/" + file, nil
+			}
+		}
+		return "", errors.New(file + " not found")
+	}
+
+	return func() { lookPath = exec.LookPath }
+}
+
+func TestParseOsRelease(t *testing.T) {
+	contents := `NAME="Amazon Linux"
+VERSION="2023"
+# comment
+ID="amzn"
+ID_LIKE="fedora"
+PRETTY_NAME='Amazon Linux 2023'
+VERSION_ID=2023
+`
+	osRelease := ParseOsRelease(contents)
+	expected := map[string]string{
+		"NAME":        "Amazon Linux",
+		"VERSION":     "2023",
+		"ID":          "amzn",
+		"ID_LIKE":     "fedora",
+		"PRETTY_NAME": "Amazon Linux 2023",
+		"VERSION_ID":  "2023",
+	}
+	if !reflect.DeepEqual(osRelease, expected) {
+		t.Error("Expected ", expected, " but got ", osRelease)
+	}
+}
+
+func TestPackageManagerFor(t *testing.T) {
+	restore := fakeLookPath("yum", "apk", "zypper")
+	defer restore()
+
+	cases := []struct {
+		ids      []string
+		expected string
+	}{
+		{[]string{"alpine"}, "apk"},
+		// dnf is not available so yum is used
+		{[]string{"centos", "rhel", "fedora"}, "yum"},
+		{[]string{"opensuse-leap", "suse", "opensuse"}, "zypper"},
+		// ID is unknown but ID_LIKE is
+		{[]string{"someos", "rhel"}, "yum"},
+		// apt-get is not available
+		{[]string{"ubuntu", "debian"}, ""},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		if result := PackageManagerFor(c.ids); result != c.expected {
+			t.Error("Expected ", c.expected, " for ", c.ids, " but got ", result)
+		}
+	}
+}
+
+func TestInstallCommand(t *testing.T) {
+	restore := fakeLookPath("sudo")
+	defer restore()
+
+	if command, err := InstallCommand("apk", 0); err != nil || command != "apk add --no-cache git" {
+		t.Error("It shouldn't use sudo as root but got: ", command, err)
+	}
+	if command, err := InstallCommand("apt-get", 1000); err != nil ||
+		command != "sudo -n sh -c 'apt-get update && apt-get install -y git'" {
+		t.Error("It should use sudo when not root but got: ", command, err)
+	}
+
+	fakeLookPath()
+	if _, err := InstallCommand("dnf", 1000); err == nil {
+		t.Error("It should return an error when not root and sudo is not available")
+	}
+}
+
+func TestParseGitVersion(t *testing.T) {
+	cases := map[string]string{
+		"git version 2.39.2\n":                 "2.39.2",
+		"git version 2.37.1 (Apple Git-137.1)": "2.37.1",
+		"git version 2.45.1.windows.1":         "2.45.1",
+	}
+	for output, expected := range cases {
+		if version, err := ParseGitVersion(output); err != nil || version != expected {
+			t.Error("Expected ", expected, " but got ", version, err)
+		}
+	}
+
+	if _, err := ParseGitVersion("command not found"); err == nil {
+		t.Error("It should return an error when there is no version")
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	cases := []struct {
+		version  string
+		minimum  string
+		expected bool
+	}{
+		{"2.3", "2.3", true},
+		{"2.3.0", "2.3", true},
+		{"2.39.2", "2.3", true},
+		{"2.2.9", "2.3", false},
+		{"1.9", "2.3", false},
+		{"3.0", "2.31", true},
+		{"2.30.9", "2.31", false},
+		{"2", "2.3", false},
+	}
+	for _, c := range cases {
+		if result := VersionAtLeast(c.version, c.minimum); result != c.expected {
+			t.Error("Expected VersionAtLeast(", c.version, ", ", c.minimum, ") to be ", c.expected)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/testributor/agent/system_command"
+	"io"
+	"sync"
+)
+
+const (
+	// Build commands and test jobs run on the agent's machine
+	EXECUTOR_LOCAL = "local"
+	// Build commands and test jobs run in a container of the project's docker image
+	EXECUTOR_DOCKER = "docker"
+	// Build commands and test jobs run on another machine over SSH
+	EXECUTOR_SSH = "ssh"
+)
+
+// Executor runs the build commands and the test jobs. The code is always
+// fetched on the agent's machine. Executors make it available where the
+// commands run.
+type Executor interface {
+	// Prepare is called before the build commands of every test run, after
+	// the project's code and files are in place.
+	Prepare(logger Logger) error
+	// Run runs a command in the project's directory like
+	// system_command.RunWithEnv does.
+	Run(command string, env []string, logger io.Writer) (system_command.CommandResult, error)
+	// Cancel kills the running command (if any).
+	Cancel() error
+	// Cleanup removes anything Prepare created. Prepare can be called again
+	// after Cleanup.
+	Cleanup(logger Logger)
+}
+
+// ExecutorType returns the executor selected with the executor setting.
+func ExecutorType(config *Config) (string, error) {
+	switch executor := config.Executor; executor {
+	case "", EXECUTOR_LOCAL:
+		return EXECUTOR_LOCAL, nil
+	case EXECUTOR_DOCKER, EXECUTOR_SSH:
+		return executor, nil
+	default:
+		return "", errors.New("Invalid executor: " + executor +
+			". Use \"" + EXECUTOR_LOCAL + "\", \"" + EXECUTOR_DOCKER + "\" or \"" + EXECUTOR_SSH + "\".")
+	}
+}
+
+// CommandRunner runs a command like system_command.RunWithEnv does.
+type CommandRunner func(command string, env []string, logger io.Writer) (system_command.CommandResult, error)
+
+// Executor returns the project's executor (see ExecutorType).
+func (project *Project) Executor() Executor {
+	if project.executor == nil {
+		switch executorType, _ := ExecutorType(project.Config()); executorType {
+		case EXECUTOR_DOCKER:
+			project.executor = &ContainerExecutor{project: project}
+		case EXECUTOR_SSH:
+			project.executor = &SshExecutor{project: project}
+		default:
+			project.executor = &LocalExecutor{}
+		}
+	}
+
+	return project.executor
+}
+
+// RunCommand runs build commands and test jobs with the project's executor.
+func (project *Project) RunCommand(command string, env []string, logger io.Writer) (system_command.CommandResult, error) {
+	return project.Executor().Run(command, env, logger)
+}
+
+// LocalExecutor runs the commands on the agent's machine.
+type LocalExecutor struct {
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+}
+
+func (e *LocalExecutor) Prepare(logger Logger) error {
+	return nil
+}
+
+func (e *LocalExecutor) Run(command string, env []string, logger io.Writer) (system_command.CommandResult, error) {
+	return e.RunWithInput(command, env, nil, logger)
+}
+
+// RunWithInput is like Run but the command reads input from its standard
+// input.
+func (e *LocalExecutor) RunWithInput(command string, env []string, input io.Reader, logger io.Writer) (system_command.CommandResult, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e.mutex.Lock()
+	e.cancel = cancel
+	e.mutex.Unlock()
+
+	return system_command.RunWithInput(ctx, command, env, input, logger)
+}
+
+func (e *LocalExecutor) Cancel() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.cancel != nil {
+		e.cancel()
+	}
+
+	return nil
+}
+
+func (e *LocalExecutor) Cleanup(logger Logger) {
+}
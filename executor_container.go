@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"github.com/testributor/agent/system_command"
+	"io"
+	"sync"
+)
+
+// ContainerExecutor runs the commands in a container of the project's docker
+// image. The project's directory is mounted on the same path so paths in the
+// output are the same as on the host. The SSH directory is not mounted to keep
+// the private key away from the build commands and tests.
+// TESTRIBUTOR_DOCKER_USER and TESTRIBUTOR_DOCKER_NETWORK set the user and
+// network of the container.
+type ContainerExecutor struct {
+	project     *Project
+	mutex       sync.Mutex // Guards docker and containerId which Cancel changes while Run waits
+	docker      *DockerClient
+	containerId string
+	image       string // The image of the running container
+}
+
+// Prepare starts a container unless one of the project's image is running.
+func (e *ContainerExecutor) Prepare(logger Logger) error {
+	e.mutex.Lock()
+	running := e.containerId != "" && e.image == e.project.dockerImage
+	e.mutex.Unlock()
+	if running {
+		return nil
+	}
+	e.Cleanup(logger)
+
+	if e.project.dockerImage == "" {
+		return errors.New("The project doesn't have a docker image. Set one on Testributor or use the local executor.")
+	}
+
+	docker := NewDockerClient(DockerSocket(e.project.Config()))
+	if err := docker.PullImage(e.project.dockerImage, logger); err != nil {
+		return err
+	}
+
+	id, err := docker.CreateContainer(DockerContainerOptions{
+		Image:      e.project.dockerImage,
+		WorkingDir: e.project.directory,
+		Binds:      []string{e.project.directory + ":" + e.project.directory},
+		User:       e.project.Config().DockerUser,
+		Network:    e.project.Config().DockerNetwork,
+	})
+	if err != nil {
+		return err
+	}
+	logger.Log("Started container " + id[:12] + " of " + e.project.dockerImage)
+
+	e.mutex.Lock()
+	e.docker = docker
+	e.containerId = id
+	e.image = e.project.dockerImage
+	e.mutex.Unlock()
+
+	return nil
+}
+
+// Run runs the command in the container. Only the env variables given are set
+// (not the agent's environment).
+func (e *ContainerExecutor) Run(command string, env []string, logger io.Writer) (system_command.CommandResult, error) {
+	e.mutex.Lock()
+	docker, containerId := e.docker, e.containerId
+	e.mutex.Unlock()
+	if containerId == "" {
+		return system_command.CommandResult{}, errors.New("The container is not running.")
+	}
+
+	return docker.Exec(containerId, command, env, e.project.directory, logger)
+}
+
+// Cancel removes the container since the Docker API can't kill a single exec.
+// The next Prepare starts a new one.
+func (e *ContainerExecutor) Cancel() error {
+	e.mutex.Lock()
+	docker, containerId := e.docker, e.containerId
+	e.containerId = ""
+	e.mutex.Unlock()
+	if containerId == "" {
+		return nil
+	}
+
+	return docker.RemoveContainer(containerId)
+}
+
+// Cleanup removes the container (if there is one).
+func (e *ContainerExecutor) Cleanup(logger Logger) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.containerId == "" {
+		return
+	}
+
+	if err := e.docker.RemoveContainer(e.containerId); err != nil {
+		logger.Warn("Couldn't remove container " + e.containerId[:12] + ": " + err.Error())
+		return
+	}
+	logger.Log("Removed container " + e.containerId[:12])
+	e.containerId = ""
+}
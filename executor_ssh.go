@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"github.com/testributor/agent/system_command"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// The remote directory used when executor_ssh_url has no path
+	// (relative to the remote user's home directory).
+	DEFAULT_SSH_EXECUTOR_DIRECTORY = "testributor_project"
+
+	// Written in the remote directory: the files of the last copy and the
+	// process group of the running command.
+	SSH_EXECUTOR_FILES_NAME = ".testributor_files"
+	SSH_EXECUTOR_PID_NAME   = ".testributor_pid"
+)
+
+// SshExecutor runs the commands on another machine over SSH. The machine is
+// set with executor_ssh_url (e.g. ssh://ci@10.0.0.5:2222/srv/katana or
+// ci@10.0.0.5:katana) and needs a POSIX shell and tar. The key in
+// executor_ssh_key is used (if set) along with the user's ssh configuration
+// and known hosts.
+//
+// Before every test run, the project's directory (without .git) is copied to
+// the remote directory. Files of the previous copy which are gone from the
+// project are removed. Files created by the commands (e.g. installed
+// dependencies) are left in place.
+type SshExecutor struct {
+	project *Project
+	local   LocalExecutor // Runs ssh. Cancelling it closes the connection.
+}
+
+// Destination returns the remote machine and directory.
+func (e *SshExecutor) Destination() (RepositoryUrl, error) {
+	rawUrl := e.project.Config().ExecutorSshUrl
+	if rawUrl == "" {
+		return RepositoryUrl{}, errors.New("executor_ssh_url (TESTRIBUTOR_EXECUTOR_SSH_URL) is needed for the ssh executor.")
+	}
+
+	destination, err := ParseRepositoryUrl(rawUrl)
+	if err != nil {
+		return RepositoryUrl{}, err
+	}
+	if destination.Scheme != "ssh" {
+		return RepositoryUrl{}, errors.New("executor_ssh_url is not an ssh url: " + rawUrl)
+	}
+	if destination.Path == "" || destination.Path == "/" {
+		destination.Path = DEFAULT_SSH_EXECUTOR_DIRECTORY
+	}
+
+	return destination, nil
+}
+
+// SshCommand returns the ssh command running remoteCommand on the remote
+// machine.
+func (e *SshExecutor) SshCommand(remoteCommand string) (string, error) {
+	destination, err := e.Destination()
+	if err != nil {
+		return "", err
+	}
+
+	command := e.project.SshPath() + " -o BatchMode=yes"
+	if destination.Port != "" {
+		command += " -p " + destination.Port
+	}
+	if key := e.project.Config().ExecutorSshKey; key != "" {
+		command += " -i " + ShellQuote(key)
+	}
+	host := destination.Host
+	if destination.User != "" {
+		host = destination.User + "@" + host
+	}
+
+	return command + " " + ShellQuote(host) + " " + ShellQuote(remoteCommand), nil
+}
+
+// Prepare copies the project's directory to the remote machine.
+func (e *SshExecutor) Prepare(logger Logger) error {
+	destination, err := e.Destination()
+	if err != nil {
+		return err
+	}
+	directory := ShellQuote(destination.Path)
+
+	// Remove the files of the last copy which are not in this one
+	remoteCommand := "mkdir -p " + directory + " && cd " + directory + " && " +
+		"touch " + SSH_EXECUTOR_FILES_NAME + " && mv " + SSH_EXECUTOR_FILES_NAME + " " + SSH_EXECUTOR_FILES_NAME + ".old && " +
+		"tar -xf - && " +
+		"{ grep -vxF -f " + SSH_EXECUTOR_FILES_NAME + " " + SSH_EXECUTOR_FILES_NAME + ".old | " +
+		"while IFS= read -r file; do rm -f \"./$file\"; done; } && rm -f " + SSH_EXECUTOR_FILES_NAME + ".old"
+	sshCommand, err := e.SshCommand(remoteCommand)
+	if err != nil {
+		return err
+	}
+
+	logger.Log("Copying the project to " + destination.HostWithPort() + ":" + destination.Path)
+	reader, writer := io.Pipe()
+	archiveErr := make(chan error, 1)
+	go func() {
+		err := e.writeArchive(writer)
+		writer.CloseWithError(err)
+		archiveErr <- err
+	}()
+	res, err := e.local.RunWithInput(sshCommand, nil, reader, ioutil.Discard)
+	// Stops writing the archive if ssh exited before reading all of it
+	reader.Close()
+	if err != nil {
+		return err
+	}
+	if err = <-archiveErr; err != nil && err != io.ErrClosedPipe {
+		return errors.New("Couldn't archive the project: " + err.Error())
+	}
+	if !res.Success {
+		return errors.New("Couldn't copy the project to " + destination.HostWithPort() + ": " + strings.TrimSpace(res.Errors))
+	}
+
+	return nil
+}
+
+// writeArchive writes the project's directory, without .git and the job logs,
+// to w as a tar archive. The archive ends with the list of the files in it
+// (see Prepare).
+func (e *SshExecutor) writeArchive(w io.Writer) error {
+	archive := tar.NewWriter(w)
+	files := ""
+
+	err := filepath.Walk(e.project.directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(e.project.directory, path)
+		if err != nil || name == "." {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if name == ".git" || name == JOB_LOGS_DIRECTORY {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			files += name + "\n"
+		}
+		if err = archive.WriteHeader(header); err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(archive, file)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = archive.WriteHeader(&tar.Header{Name: SSH_EXECUTOR_FILES_NAME, Typeflag: tar.TypeReg,
+		Mode: 0644, Size: int64(len(files)), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(archive, files); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// Run runs the command in the remote directory. Only the env variables given
+// are set on top of the remote user's environment. The variables and the
+// command are sent to the remote shell over the standard input so they don't
+// show up in the arguments of ssh (and of the remote shell) on either machine.
+func (e *SshExecutor) Run(command string, env []string, logger io.Writer) (system_command.CommandResult, error) {
+	destination, err := e.Destination()
+	if err != nil {
+		return system_command.CommandResult{}, err
+	}
+
+	script := "cd " + ShellQuote(destination.Path) + " || exit 1\n"
+	for _, variable := range env {
+		script += "export " + ShellQuote(variable) + "\n"
+	}
+	// The command runs in its own process group (when setsid is available) so
+	// Cancel can kill all of its processes. It doesn't get the rest of the
+	// script as its input.
+	quoted := ShellQuote(command)
+	script += "if command -v setsid >/dev/null; then setsid sh -c " + quoted + " </dev/null &\n" +
+		"else sh -c " + quoted + " </dev/null &\nfi\n" +
+		"echo $! > " + SSH_EXECUTOR_PID_NAME + "\n" +
+		"wait $!\nstatus=$?\n" +
+		"rm -f " + SSH_EXECUTOR_PID_NAME + "\n" +
+		"exit $status\n"
+
+	sshCommand, err := e.SshCommand("sh -s")
+	if err != nil {
+		return system_command.CommandResult{}, err
+	}
+
+	return e.local.RunWithInput(sshCommand, nil, strings.NewReader(script), logger)
+}
+
+// Cancel kills the remote command's process group (or just the command when
+// the remote machine has no setsid) and closes the connection it runs on.
+func (e *SshExecutor) Cancel() error {
+	err := e.killRemoteCommand()
+	if cancelErr := e.local.Cancel(); err == nil {
+		err = cancelErr
+	}
+
+	return err
+}
+
+// killRemoteCommand kills the command Run started over a new connection.
+func (e *SshExecutor) killRemoteCommand() error {
+	destination, err := e.Destination()
+	if err != nil {
+		return err
+	}
+	pidFile := ShellQuote(destination.Path + "/" + SSH_EXECUTOR_PID_NAME)
+	sshCommand, err := e.SshCommand("[ ! -f " + pidFile + " ] || { pid=$(cat " + pidFile + ") && " +
+		"{ kill -TERM -$pid 2>/dev/null || kill -TERM $pid; }; }")
+	if err != nil {
+		return err
+	}
+
+	var kill LocalExecutor
+	res, err := kill.Run(sshCommand, nil, ioutil.Discard)
+	if err != nil {
+		return err
+	}
+	if !res.Success {
+		return errors.New("Couldn't kill the command on " + destination.HostWithPort() + ": " + strings.TrimSpace(res.Errors))
+	}
+
+	return nil
+}
+
+// Cleanup leaves the remote directory in place so the next run (e.g. after a
+// restart) keeps the files created by the build commands.
+func (e *SshExecutor) Cleanup(logger Logger) {
+}
+
+// ShellQuote quotes s for POSIX shells.
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecutorType(t *testing.T) {
+	config := DefaultConfig()
+
+	for value, expected := range map[string]string{"": EXECUTOR_LOCAL, "docker": EXECUTOR_DOCKER, "ssh": EXECUTOR_SSH} {
+		config.Executor = value
+		if executor, err := ExecutorType(config); err != nil || executor != expected {
+			t.Error("Expected ", expected, " for ", value, " but got ", executor, err)
+		}
+	}
+
+	config.Executor = "kubernetes"
+	if _, err := ExecutorType(config); err == nil {
+		t.Error("It should return an error for unknown executors")
+	}
+
+	config.Executor = "ssh"
+	if _, ok := (&Project{config: config}).Executor().(*SshExecutor); !ok {
+		t.Error("It should create the selected executor")
+	}
+}
+
+func TestLocalExecutor(t *testing.T) {
+	executor := &LocalExecutor{}
+
+	res, err := executor.Run("echo $TESTRIBUTOR_EXECUTOR_TEST", []string{"TESTRIBUTOR_EXECUTOR_TEST=hello"}, ioutil.Discard)
+	if err != nil || !res.Success || res.Output != "hello\n" {
+		t.Error("It should run the command with the env variables but got: ", res, err)
+	}
+
+	// Cancel should kill the command along with the processes it started
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		executor.Cancel()
+	}()
+	start := time.Now()
+	res, _ = executor.Run("sleep 10 | cat", nil, ioutil.Discard)
+	if res.Success || time.Since(start) > 5*time.Second {
+		t.Error("It should kill the command when cancelled")
+	}
+}
+
+func TestContainerExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_docker")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "docker.sock")
+	api, stop := startFakeDockerApi(t, socket)
+	defer stop()
+	config := DefaultConfig()
+	config.DockerSocket = socket
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+
+	if check := CheckDocker(socket); check.Problem != "" {
+		t.Error("It should reach the API but got: ", check.Problem)
+	}
+
+	project := &Project{directory: filepath.Join(dir, "project"), sshDirectory: filepath.Join(dir, "ssh"),
+		dockerImage: "missing", config: config}
+	executor := &ContainerExecutor{project: project}
+	if err = executor.Prepare(logger); err == nil || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Error("It should return the pull error but got: ", err)
+	}
+
+	project.dockerImage = "ruby:2.4.0"
+	if err = executor.Prepare(logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !api.images["ruby:2.4.0"] {
+		t.Error("It should pull the image")
+	}
+	container := api.containers[executor.containerId]
+	binds := container["HostConfig"].(map[string]interface{})["Binds"].([]interface{})
+	if container["Image"] != "ruby:2.4.0" || container["WorkingDir"] != project.directory ||
+		!reflect.DeepEqual(binds, []interface{}{project.directory + ":" + project.directory}) {
+		t.Error("Unexpected container config: ", container)
+	}
+
+	res, err := executor.Run("bin/rake test", []string{"A=1"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Success || res.ExitCode != 3 || res.Output != "first line\nsecond line\n" || res.Errors != "an error\n" {
+		t.Error("Unexpected result: ", res)
+	}
+	exec := api.execs[strings.Repeat("e", 64)]
+	if !reflect.DeepEqual(exec["Cmd"], []interface{}{"sh", "-c", "bin/rake test"}) ||
+		!reflect.DeepEqual(exec["Env"], []interface{}{"A=1"}) {
+		t.Error("Unexpected exec config: ", exec)
+	}
+
+	executor.Cleanup(logger)
+	if len(api.containers) != 0 || executor.containerId != "" {
+		t.Error("Cleanup should remove the container")
+	}
+}
+
+func TestSshExecutor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_ssh_executor")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// A fake ssh which runs the remote command (the last argument) locally
+	// and records its arguments.
+	fakeSsh := filepath.Join(dir, "ssh")
+	ioutil.WriteFile(fakeSsh, []byte("#!/bin/sh\n"+
+		"echo \"$@\" > "+filepath.Join(dir, "ssh_args")+"\n"+
+		"for last; do :; done\n"+
+		"cd "+dir+" && exec sh -c \"$last\"\n"), 0755)
+
+	config := DefaultConfig()
+	project := &Project{directory: filepath.Join(dir, "project"), sshPath: fakeSsh, config: config}
+	os.Mkdir(project.directory, 0755)
+	ioutil.WriteFile(filepath.Join(project.directory, "test.rb"), []byte("test"), 0644)
+	os.Mkdir(filepath.Join(project.directory, ".git"), 0755)
+	executor := &SshExecutor{project: project}
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+
+	if err = executor.Prepare(logger); err == nil {
+		t.Error("It should return an error without executor_ssh_url")
+	}
+
+	config.ExecutorSshUrl = "ssh://ci@10.0.0.5:2222/remote dir"
+	if destination, err := executor.Destination(); err != nil || destination.Path != "/remote dir" {
+		t.Error("Unexpected destination: ", destination, err)
+	}
+
+	config.ExecutorSshUrl = "ci@10.0.0.5:remote"
+	if err = executor.Prepare(logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "remote", "test.rb")); string(contents) != "test" {
+		t.Error("Prepare should copy the project to the remote directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "remote", ".git")); !os.IsNotExist(err) {
+		t.Error("Prepare should not copy .git")
+	}
+
+	// Files deleted from the project are removed, files created remotely are kept
+	os.Remove(filepath.Join(project.directory, "test.rb"))
+	ioutil.WriteFile(filepath.Join(project.directory, "other_test.rb"), []byte("test"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "remote", "installed.rb"), []byte("installed"), 0644)
+	if err = executor.Prepare(logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	for file, exists := range map[string]bool{"test.rb": false, "other_test.rb": true, "installed.rb": true} {
+		if _, err := os.Stat(filepath.Join(dir, "remote", file)); os.IsNotExist(err) == exists {
+			t.Error("Unexpected existence of "+file+" after the second copy: ", !exists)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(project.directory, "test.rb"), []byte("test"), 0644)
+	if err = executor.Prepare(logger); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res, err := executor.Run("echo \"$A\" && cat test.rb", []string{"A=it's secret"}, ioutil.Discard)
+	if err != nil || res.Output != "it's secret\ntest\n" {
+		t.Error("Run should run the command in the remote directory but got: ", res.Output, err)
+	}
+	args, _ := ioutil.ReadFile(filepath.Join(dir, "ssh_args"))
+	if string(args) != "-o BatchMode=yes ci@10.0.0.5 sh -s\n" {
+		t.Error("The variables and the command should not be in the ssh arguments but got: ", string(args))
+	}
+
+	done := make(chan bool)
+	go func() {
+		executor.Run("sh -c 'sleep 1; touch late' & wait", nil, ioutil.Discard)
+		done <- true
+	}()
+	pidFile := filepath.Join(dir, "remote", SSH_EXECUTOR_PID_NAME)
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(pidFile); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err = executor.Cancel(); err != nil {
+		t.Error("Cancel should kill the remote command but got: ", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return after Cancel")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, "remote", "late")); !os.IsNotExist(err) {
+		t.Error("Cancel should kill the processes started by the remote command")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+)
+
+const (
+	// Values accepted by TESTRIBUTOR_GIT_BACKEND. The shell backend runs the
+	// git command (the default). The builtin one is implemented in Go and
+	// doesn't need git to be installed.
+	GIT_BACKEND_SHELL   = "shell"
+	GIT_BACKEND_BUILTIN = "builtin"
+)
+
+// Git is what the Project needs from git to fetch the repository and
+// checkout commits. All methods work on the project's directory.
+type Git interface {
+	// Init creates the repository (if needed) and sets remoteUrl as "origin".
+	Init(remoteUrl string) error
+	// LsRemote returns the branches (ref name -> commit sha) of the remote
+	// repository at remoteUrl. It is also used to check we have access.
+	LsRemote(remoteUrl string) (map[string]string, error)
+	// Fetch fetches "origin".
+	Fetch() error
+	// Checkout hard resets the working tree to commitSha (or HEAD when empty).
+	Checkout(commitSha string) error
+	// Clean removes untracked files and directories (ignored ones are kept).
+	Clean() error
+	// RevParse returns the commit sha rev points to.
+	RevParse(rev string) (string, error)
+	// CatFile returns the type of the object (e.g. "commit") or an empty
+	// string when the object doesn't exist.
+	CatFile(object string) (string, error)
+	// Diff returns the paths of the files changed between two commits.
+	Diff(from string, to string) ([]string, error)
+}
+
+// GitBackend returns the git backend selected with the git_backend setting.
+func GitBackend(config *Config) (string, error) {
+	switch value := config.GitBackend; value {
+	case "", GIT_BACKEND_SHELL:
+		return GIT_BACKEND_SHELL, nil
+	case GIT_BACKEND_BUILTIN:
+		return GIT_BACKEND_BUILTIN, nil
+	default:
+		return "", errors.New("Invalid git_backend: " + value +
+			". Use \"" + GIT_BACKEND_SHELL + "\" or \"" + GIT_BACKEND_BUILTIN + "\".")
+	}
+}
+
+// Git returns the project's Git implementation, creating it on first use.
+func (project *Project) Git() Git {
+	if project.git == nil {
+		if backend, _ := GitBackend(project.Config()); backend == GIT_BACKEND_BUILTIN {
+			project.git = &BuiltinGit{project: project}
+		} else {
+			project.git = &ShellGit{project: project}
+		}
+	}
+
+	return project.git
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"path/filepath"
+)
+
+// BuiltinGit implements Git in Go (using go-git) so the agent can run on
+// systems without git. It uses the same credentials as the shell backend:
+// the project's SSH key (or ssh-agent) and known_hosts file, or the HTTPS token.
+type BuiltinGit struct {
+	project *Project
+	auth    transport.AuthMethod
+}
+
+func (g *BuiltinGit) repository() (*git.Repository, error) {
+	return git.PlainOpen(g.project.directory)
+}
+
+// authMethod returns the credentials for the project's repository and a
+// function to call when the operation is done. They are created on first use
+// since the SSH files are written after the Project is created. Credentials
+// using the ssh-agent hold a connection to it so they are created for every
+// operation and the connection is closed by the returned function.
+func (g *BuiltinGit) authMethod() (transport.AuthMethod, func(), error) {
+	done := func() {}
+	if g.auth != nil {
+		return g.auth, done, nil
+	}
+
+	switch g.project.RepositoryTransport() {
+	case REPOSITORY_TRANSPORT_LOCAL:
+		return nil, done, nil
+	case REPOSITORY_TRANSPORT_HTTPS:
+		username, token, err := g.project.HttpsCredentials()
+		if err != nil {
+			return nil, done, err
+		}
+		g.auth = &githttp.BasicAuth{Username: username, Password: token}
+	default:
+		repositoryUrl, err := ParseRepositoryUrl(g.project.repositoryUrl)
+		if err != nil {
+			return nil, done, err
+		}
+		user := repositoryUrl.User
+		if user == "" {
+			user = "git"
+		}
+
+		hostKeyChecking, err := HostKeyChecking(g.project.Config())
+		if err != nil {
+			return nil, done, err
+		}
+		hostKeyCallback := HostKeyCallback(hostKeyChecking,
+			filepath.Join(g.project.sshDirectory, KNOWN_HOSTS_NAME))
+
+		if g.project.sshAgent != nil {
+			conn, err := net.Dial("unix", g.project.sshAgent.socket)
+			if err != nil {
+				return nil, done, err
+			}
+			auth := &gitssh.PublicKeysCallback{User: user, Callback: agent.NewClient(conn).Signers}
+			auth.HostKeyCallback = hostKeyCallback
+
+			return auth, func() { conn.Close() }, nil
+		}
+
+		auth, err := gitssh.NewPublicKeys(user, []byte(g.project.currentWorkerGroup["ssh_key_private"]), "")
+		if err != nil {
+			return nil, done, err
+		}
+		auth.HostKeyCallback = hostKeyCallback
+		g.auth = auth
+	}
+
+	return g.auth, done, nil
+}
+
+func (g *BuiltinGit) Init(remoteUrl string) error {
+	repository, err := git.PlainOpen(g.project.directory)
+	if err == git.ErrRepositoryNotExists {
+		repository, err = git.PlainInit(g.project.directory, false)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Replace origin in case the url changed in testributor project/settings page
+	err = repository.DeleteRemote("origin")
+	if err != nil && err != git.ErrRemoteNotFound {
+		return err
+	}
+	_, err = repository.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remoteUrl}})
+
+	return err
+}
+
+func (g *BuiltinGit) LsRemote(remoteUrl string) (map[string]string, error) {
+	auth, done, err := g.authMethod()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{remoteUrl}})
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	heads := make(map[string]string)
+	if err == transport.ErrEmptyRemoteRepository {
+		return heads, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			heads[ref.Name().String()] = ref.Hash().String()
+		}
+	}
+
+	return heads, nil
+}
+
+func (g *BuiltinGit) Fetch() error {
+	repository, err := g.repository()
+	if err != nil {
+		return err
+	}
+	auth, done, err := g.authMethod()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	err = repository.Fetch(&git.FetchOptions{RemoteName: "origin", Auth: auth})
+	if err == git.NoErrAlreadyUpToDate || err == transport.ErrEmptyRemoteRepository {
+		return nil
+	}
+
+	return err
+}
+
+func (g *BuiltinGit) Checkout(commitSha string) error {
+	repository, err := g.repository()
+	if err != nil {
+		return err
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+
+	if commitSha == "" {
+		commitSha = "HEAD"
+	}
+	hash, err := repository.ResolveRevision(plumbing.Revision(commitSha))
+	if err != nil {
+		return err
+	}
+
+	// go-git can't reset an unborn branch (a freshly initialized repository)
+	// so we create the branch HEAD points to first.
+	if _, err = repository.Head(); err == plumbing.ErrReferenceNotFound {
+		head, err := repository.Storer.Reference(plumbing.HEAD)
+		if err != nil {
+			return err
+		}
+		err = repository.Storer.SetReference(plumbing.NewHashReference(head.Target(), *hash))
+		if err != nil {
+			return err
+		}
+	}
+
+	return worktree.Reset(&git.ResetOptions{Commit: *hash, Mode: git.HardReset})
+}
+
+func (g *BuiltinGit) Clean() error {
+	repository, err := g.repository()
+	if err != nil {
+		return err
+	}
+	worktree, err := repository.Worktree()
+	if err != nil {
+		return err
+	}
+
+	// Like the -e option of git clean
+	worktree.Excludes = append(worktree.Excludes, gitignore.ParsePattern("/"+JOB_LOGS_DIRECTORY+"/", nil))
+
+	return worktree.Clean(&git.CleanOptions{Dir: true})
+}
+
+func (g *BuiltinGit) RevParse(rev string) (string, error) {
+	repository, err := g.repository()
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := repository.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return "", err
+	}
+
+	return hash.String(), nil
+}
+
+func (g *BuiltinGit) CatFile(name string) (string, error) {
+	repository, err := g.repository()
+	if err != nil {
+		return "", err
+	}
+
+	// Like git, we accept short hashes and other revisions (which go-git
+	// resolves to commits) and don't know about names we can't resolve
+	hash := plumbing.NewHash(name)
+	if !plumbing.IsHash(name) {
+		resolved, err := repository.ResolveRevision(plumbing.Revision(name))
+		if err != nil {
+			return "", nil
+		}
+		hash = *resolved
+	}
+	encodedObject, err := repository.Storer.EncodedObject(plumbing.AnyObject, hash)
+	if err == plumbing.ErrObjectNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return encodedObject.Type().String(), nil
+}
+
+func (g *BuiltinGit) Diff(from string, to string) ([]string, error) {
+	repository, err := g.repository()
+	if err != nil {
+		return nil, err
+	}
+
+	var trees [2]*object.Tree
+	for i, rev := range []string{from, to} {
+		hash, err := repository.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return nil, err
+		}
+		commit, err := repository.CommitObject(*hash)
+		if err != nil {
+			return nil, err
+		}
+		if trees[i], err = commit.Tree(); err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := trees[0].Diff(trees[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, change := range changes {
+		// Deleted files only have a "From" side
+		path := change.To.Name
+		if path == "" {
+			path = change.From.Name
+		}
+		paths = append(paths, path)
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"github.com/testributor/agent/system_command"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ShellGit implements Git by running the git command in the project's
+// directory with the project's git environment (see Project.RunGit).
+type ShellGit struct {
+	project *Project
+}
+
+// run changes to the project's directory and runs the git command. Failed
+// commands return an error with git's error output.
+func (g *ShellGit) run(command string) (system_command.CommandResult, error) {
+	err := os.Chdir(g.project.directory)
+	if err != nil {
+		return system_command.CommandResult{}, err
+	}
+
+	res, err := g.project.RunGit(command, ioutil.Discard)
+	if err != nil {
+		return res, err
+	}
+	if !res.Success {
+		return res, errors.New(command + " failed: " + strings.TrimSpace(res.Errors))
+	}
+
+	return res, nil
+}
+
+func (g *ShellGit) Init(remoteUrl string) error {
+	_, err := g.run("git init")
+	if err != nil {
+		return err
+	}
+
+	// Check if origin exists and remove in order to change it if
+	// url changed in testributor project/settings page
+	res, err := g.run("git remote show")
+	if err != nil {
+		return err
+	}
+	for _, remote := range strings.Split(res.Output, "\n") {
+		if strings.TrimSpace(remote) == "origin" {
+			if _, err = g.run("git remote rm origin"); err != nil {
+				return err
+			}
+
+			break
+		}
+	}
+
+	_, err = g.run("git remote add origin " + remoteUrl)
+
+	return err
+}
+
+func (g *ShellGit) LsRemote(remoteUrl string) (map[string]string, error) {
+	// ls-remote doesn't need a repository so we don't chdir (the project's
+	// directory might not exist yet).
+	res, err := g.project.RunGit("git ls-remote -q --heads "+remoteUrl, ioutil.Discard)
+	if err != nil {
+		return nil, err
+	}
+	if !res.Success {
+		return nil, errors.New(strings.TrimSpace(res.Errors))
+	}
+
+	heads := make(map[string]string)
+	for _, head := range strings.Split(res.Output, "\n") {
+		if fields := strings.Fields(head); len(fields) > 1 {
+			heads[fields[1]] = fields[0]
+		}
+	}
+
+	return heads, nil
+}
+
+func (g *ShellGit) Fetch() error {
+	_, err := g.run("git fetch origin")
+
+	return err
+}
+
+func (g *ShellGit) Checkout(commitSha string) error {
+	var err error
+	if commitSha == "" {
+		_, err = g.run("git reset --hard")
+	} else {
+		_, err = g.run("git reset --hard " + commitSha + " --")
+	}
+
+	return err
+}
+
+func (g *ShellGit) Clean() error {
+	_, err := g.run("git clean -df -e /" + JOB_LOGS_DIRECTORY + "/")
+
+	return err
+}
+
+func (g *ShellGit) RevParse(rev string) (string, error) {
+	res, err := g.run("git rev-parse " + rev)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(res.Output), nil
+}
+
+func (g *ShellGit) CatFile(object string) (string, error) {
+	err := os.Chdir(g.project.directory)
+	if err != nil {
+		return "", err
+	}
+
+	// A missing object is not an error, git just doesn't print anything.
+	res, err := g.project.RunGit("git cat-file -t "+object, ioutil.Discard)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(res.Output), nil
+}
+
+func (g *ShellGit) Diff(from string, to string) ([]string, error) {
+	res, err := g.run("git diff --name-only " + from + " " + to)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, path := range strings.Split(res.Output, "\n") {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// prepareGitRemote creates a repository with two commits on master and
+// returns its path and the commits' SHAs.
+func prepareGitRemote(t *testing.T, dir string) (string, []string) {
+	remote := filepath.Join(dir, "remote")
+	commands := [][]string{
+		{"init", "-q", remote},
+		{"-C", remote, "config", "user.email", "agent@testributor.com"},
+		{"-C", remote, "config", "user.name", "Testributor"},
+		{"-C", remote, "checkout", "-q", "-b", "master"},
+	}
+	for _, args := range commands {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatal(string(output))
+		}
+	}
+
+	var commits []string
+	for _, file := range []string{"first.rb", "second.rb"} {
+		ioutil.WriteFile(filepath.Join(remote, file), []byte(file), 0644)
+		for _, args := range [][]string{
+			{"-C", remote, "add", file},
+			{"-C", remote, "commit", "-q", "-m", file},
+		} {
+			if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+				t.Fatal(string(output))
+			}
+		}
+		sha, err := exec.Command("git", "-C", remote, "rev-parse", "HEAD").Output()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		commits = append(commits, strings.TrimSpace(string(sha)))
+	}
+
+	return remote, commits
+}
+
+func testGitBackend(t *testing.T, backend string) {
+	// The shell backend changes to the project's directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Chdir(cwd)
+
+	dir, err := ioutil.TempDir("", "testributor_git")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	remote, commits := prepareGitRemote(t, dir)
+
+	config := DefaultConfig()
+	config.GitBackend = backend
+	project := Project{repositoryUrl: remote, directory: filepath.Join(dir, "project"), config: config}
+	os.Mkdir(project.directory, 0755)
+	git := project.Git()
+
+	heads, err := git.LsRemote(remote)
+	if err != nil || !reflect.DeepEqual(heads, map[string]string{"refs/heads/master": commits[1]}) {
+		t.Error("LsRemote should return the remote branches but got: ", heads, err)
+	}
+
+	if err = git.Init(remote); err != nil {
+		t.Fatal(err.Error())
+	}
+	// Initializing again should replace origin
+	if err = git.Init(remote); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = git.Fetch(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if objectType, err := git.CatFile(commits[0]); err != nil || objectType != "commit" {
+		t.Error("CatFile should return commit but got: ", objectType, err)
+	}
+	if objectType, err := git.CatFile(commits[0][:10]); err != nil || objectType != "commit" {
+		t.Error("CatFile should accept short hashes but got: ", objectType, err)
+	}
+	if objectType, err := git.CatFile(strings.Repeat("0", 40)); err != nil || objectType != "" {
+		t.Error("CatFile should return nothing for missing objects but got: ", objectType, err)
+	}
+
+	if err = git.Checkout(commits[0]); err != nil {
+		t.Fatal(err.Error())
+	}
+	if sha, err := git.RevParse("HEAD"); err != nil || sha != commits[0] {
+		t.Error("RevParse should return the checked out commit but got: ", sha, err)
+	}
+	if _, err := os.Stat(filepath.Join(project.directory, "second.rb")); !os.IsNotExist(err) {
+		t.Error("Checkout should reset the working tree")
+	}
+
+	if paths, err := git.Diff(commits[0], commits[1]); err != nil || !reflect.DeepEqual(paths, []string{"second.rb"}) {
+		t.Error("Diff should return the changed files but got: ", paths, err)
+	}
+
+	untracked := filepath.Join(project.directory, "tmp", "artifact.log")
+	os.MkdirAll(filepath.Dir(untracked), 0755)
+	ioutil.WriteFile(untracked, []byte("artifact"), 0644)
+	jobLog := filepath.Join(project.directory, JOB_LOGS_DIRECTORY, "12", "23.log")
+	os.MkdirAll(filepath.Dir(jobLog), 0755)
+	ioutil.WriteFile(jobLog, []byte("output"), 0644)
+	if err = git.Clean(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(untracked); !os.IsNotExist(err) {
+		t.Error("Clean should remove untracked files")
+	}
+	if _, err := os.Stat(jobLog); err != nil {
+		t.Error("Clean should keep the job logs but got: ", err)
+	}
+}
+
+func TestShellGit(t *testing.T) {
+	testGitBackend(t, GIT_BACKEND_SHELL)
+}
+
+func TestBuiltinGit(t *testing.T) {
+	testGitBackend(t, GIT_BACKEND_BUILTIN)
+}
+
+func TestGitBackend(t *testing.T) {
+	config := DefaultConfig()
+	if backend, err := GitBackend(config); err != nil || backend != GIT_BACKEND_SHELL {
+		t.Error("It should use the shell backend by default but got: ", backend, err)
+	}
+
+	config.GitBackend = "libgit2"
+	if _, err := GitBackend(config); err == nil {
+		t.Error("It should return an error for unknown backends")
+	}
+}
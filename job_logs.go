@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// The directory (in the project's directory) the output of every job is
+	// written to: <test_run_id>/<job_id>.log. git clean leaves it alone.
+	JOB_LOGS_DIRECTORY = ".testributor_logs"
+	// How many test runs we keep the logs of
+	DEFAULT_JOB_LOGS_KEEP_TEST_RUNS = 20
+	// The size of all the logs we keep (the oldest test runs are removed first)
+	DEFAULT_JOB_LOGS_MAX_MEGABYTES = 500
+)
+
+// JobLogs writes the output of each job to its own file and removes the logs
+// of old test runs. All the methods work on nil JobLogs (nothing is written).
+type JobLogs struct {
+	directory    string
+	keepTestRuns int
+	maxBytes     int64
+}
+
+// NewJobLogs returns the JobLogs of the project's directory with the limits
+// set in job_logs_keep_test_runs (0 disables the job logs) and
+// job_logs_max_megabytes.
+func NewJobLogs(projectDirectory string, config *Config) (*JobLogs, error) {
+	if config.JobLogsKeepTestRuns < 0 {
+		return nil, errors.New("Invalid job_logs_keep_test_runs: " + strconv.Itoa(config.JobLogsKeepTestRuns) +
+			". Use a number (0 or more).")
+	}
+	if config.JobLogsMaxMegabytes < 0 {
+		return nil, errors.New("Invalid job_logs_max_megabytes: " + strconv.Itoa(config.JobLogsMaxMegabytes) +
+			". Use a number (0 or more).")
+	}
+	if config.JobLogsKeepTestRuns == 0 {
+		return nil, nil
+	}
+
+	return &JobLogs{
+		directory:    filepath.Join(projectDirectory, JOB_LOGS_DIRECTORY),
+		keepTestRuns: config.JobLogsKeepTestRuns,
+		maxBytes:     int64(config.JobLogsMaxMegabytes) * 1024 * 1024,
+	}, nil
+}
+
+// Path returns the file the output of the job is written to. It returns an
+// empty string when the job logs are disabled.
+func (l *JobLogs) Path(testRunId int, jobId int) string {
+	if l == nil {
+		return ""
+	}
+
+	return filepath.Join(l.directory, strconv.Itoa(testRunId), strconv.Itoa(jobId)+".log")
+}
+
+// Create creates the job's log file. The caller closes it.
+func (l *JobLogs) Create(testRunId int, jobId int) (*os.File, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	path := l.Path(testRunId, jobId)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	return os.Create(path)
+}
+
+// Prune removes the logs of the oldest test runs so we keep at most
+// keepTestRuns test runs and maxBytes of logs. The logs of the latest test run
+// are never removed.
+func (l *JobLogs) Prune() error {
+	if l == nil {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(l.directory)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var testRuns []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			testRuns = append(testRuns, entry)
+		}
+	}
+	// Newest first
+	sort.Slice(testRuns, func(i, j int) bool {
+		return testRuns[i].ModTime().After(testRuns[j].ModTime())
+	})
+
+	totalBytes := int64(0)
+	for i, testRun := range testRuns {
+		path := filepath.Join(l.directory, testRun.Name())
+		totalBytes += directorySize(path)
+		if i > 0 && (i >= l.keepTestRuns || totalBytes > l.maxBytes) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func directorySize(dir string) int64 {
+	size := int64(0)
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
+
+// jobLogWriter writes the output of a command to the job's log file as well
+// as the logger. Like the logger, it gets one line (without the newline) per
+// Write. stdout and stderr are read concurrently so the lines are written
+// under a mutex.
+type jobLogWriter struct {
+	mutex  sync.Mutex
+	logger io.Writer
+	file   io.Writer
+}
+
+func (w *jobLogWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, err := w.file.Write(append(append([]byte{}, p...), '\n')); err != nil {
+		return 0, err
+	}
+
+	return w.logger.Write(p)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"github.com/testributor/agent/system_command"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNewJobLogs(t *testing.T) {
+	config := DefaultConfig()
+	jobLogs, err := NewJobLogs("project", config)
+	if err != nil || jobLogs.keepTestRuns != DEFAULT_JOB_LOGS_KEEP_TEST_RUNS ||
+		jobLogs.maxBytes != DEFAULT_JOB_LOGS_MAX_MEGABYTES*1024*1024 {
+		t.Error("Expected the default limits but got:", jobLogs, err)
+	}
+	if path := jobLogs.Path(12, 23); path != filepath.Join("project", JOB_LOGS_DIRECTORY, "12", "23.log") {
+		t.Error("Expected the log of job 23 in the directory of test run 12 but got:", path)
+	}
+
+	config.JobLogsMaxMegabytes = -1
+	if _, err = NewJobLogs("project", config); err == nil {
+		t.Error("Expected an error for a negative size")
+	}
+
+	config.JobLogsMaxMegabytes = DEFAULT_JOB_LOGS_MAX_MEGABYTES
+	config.JobLogsKeepTestRuns = 0
+	jobLogs, err = NewJobLogs("project", config)
+	if err != nil || jobLogs != nil {
+		t.Error("Expected the job logs to be disabled but got:", jobLogs, err)
+	}
+	if file, err := jobLogs.Create(12, 23); file != nil || err != nil || jobLogs.Path(12, 23) != "" ||
+		jobLogs.Prune() != nil {
+		t.Error("Disabled job logs should write nothing")
+	}
+}
+
+func writeTestRunLogs(t *testing.T, jobLogs *JobLogs, testRunId int, size int, modTime time.Time) {
+	file, err := jobLogs.Create(testRunId, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file.Write(bytes.Repeat([]byte("a"), size))
+	file.Close()
+
+	os.Chtimes(filepath.Dir(file.Name()), modTime, modTime)
+}
+
+func testRunLogsExist(jobLogs *JobLogs, testRunId int) bool {
+	_, err := os.Stat(filepath.Join(jobLogs.directory, strconv.Itoa(testRunId)))
+	return err == nil
+}
+
+func TestJobLogsPrune(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testributor_job_logs")
+	defer os.RemoveAll(dir)
+
+	jobLogs := &JobLogs{directory: filepath.Join(dir, JOB_LOGS_DIRECTORY), keepTestRuns: 3, maxBytes: 1000}
+	if err := jobLogs.Prune(); err != nil {
+		t.Error("Expected nothing to prune before any job ran but got:", err)
+	}
+
+	now := time.Now()
+	for testRunId := 1; testRunId <= 5; testRunId++ {
+		writeTestRunLogs(t, jobLogs, testRunId, 100, now.Add(time.Duration(testRunId)*time.Minute))
+	}
+	if err := jobLogs.Prune(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for testRunId, kept := range map[int]bool{1: false, 2: false, 3: true, 4: true, 5: true} {
+		if testRunLogsExist(jobLogs, testRunId) != kept {
+			t.Error("Expected only the latest 3 test runs to be kept but test run", testRunId, "wasn't")
+		}
+	}
+
+	// Test run 6 fills the limit on its own and 5 doesn't fit anymore
+	writeTestRunLogs(t, jobLogs, 6, 950, now.Add(6*time.Minute))
+	jobLogs.Prune()
+	for testRunId, kept := range map[int]bool{3: false, 4: false, 5: false, 6: true} {
+		if testRunLogsExist(jobLogs, testRunId) != kept {
+			t.Error("Expected only test run 6 to be kept but test run", testRunId, "wasn't")
+		}
+	}
+
+	// The latest test run is kept even when it is too big
+	writeTestRunLogs(t, jobLogs, 7, 2000, now.Add(7*time.Minute))
+	jobLogs.Prune()
+	if testRunLogsExist(jobLogs, 6) || !testRunLogsExist(jobLogs, 7) {
+		t.Error("Expected test run 7 to be kept")
+	}
+}
+
+func TestRunWritingTheLogFile(t *testing.T) {
+	var logged, logFile bytes.Buffer
+	testJob := TestJob{Id: 23, TestRunId: 12, Command: "echo first && echo second"}
+	testJob.Run(system_command.RunWithEnv, Logger{prefix: "test", writer: &logged}, &logFile)
+
+	if logFile.String() != "first\nsecond\n" {
+		t.Error("Expected the command's output in the log file but got:", logFile.String())
+	}
+	if !bytes.Contains(logged.Bytes(), []byte("second")) {
+		t.Error("Expected the command's output to be logged too but got:", logged.String())
+	}
+}
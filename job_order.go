@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+const (
+	// Jobs run in the order Testributor sent them
+	JOB_ORDER_FIFO = "fifo"
+	// The jobs predicted to take longer run first. When the jobs of a test run
+	// are shared by many workers, this avoids a long job starting last and
+	// keeping the test run going while the other workers idle.
+	JOB_ORDER_LONGEST_FIRST = "longest_first"
+	// The jobs predicted to take less run first to report failures sooner.
+	JOB_ORDER_SHORTEST_FIRST = "shortest_first"
+	// The jobs of the test run we got jobs for first run first so a new
+	// test run doesn't delay the ones already running.
+	JOB_ORDER_OLDEST_TEST_RUN_FIRST = "oldest_test_run_first"
+)
+
+// JobOrder returns the order of the jobs in the Manager's queue selected with
+// the job_order setting.
+func JobOrder(config *Config) (string, error) {
+	switch order := config.JobOrder; order {
+	case "", JOB_ORDER_FIFO:
+		return JOB_ORDER_FIFO, nil
+	case JOB_ORDER_LONGEST_FIRST, JOB_ORDER_SHORTEST_FIRST, JOB_ORDER_OLDEST_TEST_RUN_FIRST:
+		return order, nil
+	default:
+		return "", errors.New("Invalid job_order: " + order +
+			". Use \"" + JOB_ORDER_FIFO + "\", \"" + JOB_ORDER_LONGEST_FIRST + "\", \"" +
+			JOB_ORDER_SHORTEST_FIRST + "\" or \"" + JOB_ORDER_OLDEST_TEST_RUN_FIRST + "\".")
+	}
+}
+
+// SortJobs sorts the jobs in the given order. The sort is stable so jobs
+// which are equal in that order keep the order Testributor sent them in.
+// The longest and shortest first orders use the workload's estimate of each
+// job (see WorkloadModel.JobSeconds).
+func SortJobs(jobs []TestJob, order string, workload *WorkloadModel) {
+	switch order {
+	case JOB_ORDER_LONGEST_FIRST:
+		sort.SliceStable(jobs, func(i, j int) bool {
+			return workload.JobSeconds(jobs[i]) > workload.JobSeconds(jobs[j])
+		})
+	case JOB_ORDER_SHORTEST_FIRST:
+		sort.SliceStable(jobs, func(i, j int) bool {
+			return workload.JobSeconds(jobs[i]) < workload.JobSeconds(jobs[j])
+		})
+	case JOB_ORDER_OLDEST_TEST_RUN_FIRST:
+		// A test run is as old as its first queued job
+		testRunQueuedAt := make(map[int]int64)
+		for _, job := range jobs {
+			if queuedAt, ok := testRunQueuedAt[job.TestRunId]; !ok || job.QueuedAtSecondsSinceEpoch < queuedAt {
+				testRunQueuedAt[job.TestRunId] = job.QueuedAtSecondsSinceEpoch
+			}
+		}
+		sort.SliceStable(jobs, func(i, j int) bool {
+			queuedAtI, queuedAtJ := testRunQueuedAt[jobs[i].TestRunId], testRunQueuedAt[jobs[j].TestRunId]
+			if queuedAtI != queuedAtJ {
+				return queuedAtI < queuedAtJ
+			}
+			return jobs[i].TestRunId < jobs[j].TestRunId
+		})
+	}
+}
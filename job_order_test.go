@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// simulateQueue runs the jobs (sorted in the given order) on a number of
+// workers taking the next job in the queue whenever they are idle. It returns
+// the time each test run finished and the mean time a job finished.
+func simulateQueue(jobs []TestJob, order string, workers int) (map[int]float64, float64) {
+	queue := make([]TestJob, len(jobs))
+	copy(queue, jobs)
+	SortJobs(queue, order, &WorkloadModel{})
+
+	workerFreeAt := make([]float64, workers)
+	testRunFinishedAt := make(map[int]float64)
+	totalFinishedAt := float64(0)
+	for _, job := range queue {
+		next := 0
+		for i := range workerFreeAt {
+			if workerFreeAt[i] < workerFreeAt[next] {
+				next = i
+			}
+		}
+		workerFreeAt[next] += job.CostPredictionSeconds
+		totalFinishedAt += workerFreeAt[next]
+		if workerFreeAt[next] > testRunFinishedAt[job.TestRunId] {
+			testRunFinishedAt[job.TestRunId] = workerFreeAt[next]
+		}
+	}
+
+	return testRunFinishedAt, totalFinishedAt / float64(len(queue))
+}
+
+func jobIds(jobs []TestJob) []int {
+	ids := []int{}
+	for _, job := range jobs {
+		ids = append(ids, job.Id)
+	}
+	return ids
+}
+
+func TestJobOrder(t *testing.T) {
+	config := DefaultConfig()
+
+	for value, expected := range map[string]string{
+		"":                      JOB_ORDER_FIFO,
+		"fifo":                  JOB_ORDER_FIFO,
+		"longest_first":         JOB_ORDER_LONGEST_FIRST,
+		"shortest_first":        JOB_ORDER_SHORTEST_FIRST,
+		"oldest_test_run_first": JOB_ORDER_OLDEST_TEST_RUN_FIRST,
+	} {
+		config.JobOrder = value
+		if order, err := JobOrder(config); err != nil || order != expected {
+			t.Error("Expected", expected, "for", value, "but got:", order, err)
+		}
+	}
+
+	config.JobOrder = "random"
+	if _, err := JobOrder(config); err == nil {
+		t.Error("Expected an error for an invalid order")
+	}
+}
+
+func TestSortJobs(t *testing.T) {
+	jobs := []TestJob{
+		TestJob{Id: 1, CostPredictionSeconds: 3, TestRunId: 2, QueuedAtSecondsSinceEpoch: 100},
+		TestJob{Id: 2, CostPredictionSeconds: 1, TestRunId: 2, QueuedAtSecondsSinceEpoch: 100},
+		TestJob{Id: 3, CostPredictionSeconds: NO_PREDICTION_WORKLOAD_SECONDS, TestRunId: 1, QueuedAtSecondsSinceEpoch: 200},
+		TestJob{Id: 4, CostPredictionSeconds: 1, TestRunId: 3, QueuedAtSecondsSinceEpoch: 200},
+		TestJob{Id: 5, CostPredictionSeconds: 3, TestRunId: 2, QueuedAtSecondsSinceEpoch: 200},
+	}
+
+	for order, expected := range map[string][]int{
+		JOB_ORDER_FIFO:                  []int{1, 2, 3, 4, 5},
+		"":                              []int{1, 2, 3, 4, 5},
+		JOB_ORDER_LONGEST_FIRST:         []int{3, 1, 5, 2, 4},
+		JOB_ORDER_SHORTEST_FIRST:        []int{2, 4, 1, 5, 3},
+		JOB_ORDER_OLDEST_TEST_RUN_FIRST: []int{1, 2, 5, 3, 4},
+	} {
+		sorted := make([]TestJob, len(jobs))
+		copy(sorted, jobs)
+		SortJobs(sorted, order, &WorkloadModel{})
+		if ids := jobIds(sorted); !reflect.DeepEqual(ids, expected) {
+			t.Error("Expected", expected, "for", order, "but got:", ids)
+		}
+	}
+}
+
+func TestSortJobsWithLearnedDurations(t *testing.T) {
+	workload := &WorkloadModel{}
+	workload.LearnDuration(&TestJob{Command: "bin/rspec spec/a_spec.rb", RunSeconds: 10})
+	jobs := []TestJob{
+		TestJob{Id: 1, Command: "bin/rspec spec/a_spec.rb", CostPredictionSeconds: 1},
+		TestJob{Id: 2, Command: "bin/rspec spec/b_spec.rb", CostPredictionSeconds: 3},
+		TestJob{Id: 3, Command: "bin/rspec spec/c_spec.rb", CostPredictionSeconds: 2, DurationP50Seconds: 5},
+	}
+
+	// 10 (learned), 3 (predicted) and 5 (from the history)
+	SortJobs(jobs, JOB_ORDER_LONGEST_FIRST, workload)
+	if ids := jobIds(jobs); !reflect.DeepEqual(ids, []int{1, 3, 2}) {
+		t.Error("Expected the measured durations to count before the predictions but got:", ids)
+	}
+}
+
+func TestLongestFirstReducesMakespan(t *testing.T) {
+	// Many short jobs and a long one sent last
+	jobs := []TestJob{}
+	for i := 1; i <= 8; i++ {
+		jobs = append(jobs, TestJob{Id: i, CostPredictionSeconds: 1, TestRunId: 1})
+	}
+	jobs = append(jobs, TestJob{Id: 9, CostPredictionSeconds: 8, TestRunId: 1})
+
+	fifo, _ := simulateQueue(jobs, JOB_ORDER_FIFO, 3)
+	longestFirst, _ := simulateQueue(jobs, JOB_ORDER_LONGEST_FIRST, 3)
+	if fifo[1] != 10 || longestFirst[1] != 8 {
+		t.Error("Expected the test run to finish at 10 (fifo) and 8 (longest first) but got:",
+			fifo[1], longestFirst[1])
+	}
+}
+
+func TestShortestFirstReducesMeanFinishTime(t *testing.T) {
+	jobs := []TestJob{
+		TestJob{Id: 1, CostPredictionSeconds: 20, TestRunId: 1},
+		TestJob{Id: 2, CostPredictionSeconds: 10, TestRunId: 1},
+		TestJob{Id: 3, CostPredictionSeconds: 2, TestRunId: 1},
+		TestJob{Id: 4, CostPredictionSeconds: 1, TestRunId: 1},
+	}
+
+	// One worker: 20, 30, 32, 33 vs 1, 3, 13, 33
+	_, fifo := simulateQueue(jobs, JOB_ORDER_FIFO, 1)
+	_, shortestFirst := simulateQueue(jobs, JOB_ORDER_SHORTEST_FIRST, 1)
+	if fifo != 28.75 || shortestFirst != 12.5 {
+		t.Error("Expected a mean finish time of 28.75 (fifo) and 12.5 (shortest first) but got:",
+			fifo, shortestFirst)
+	}
+}
+
+func TestOldestTestRunFirstFinishesOlderTestRunsFirst(t *testing.T) {
+	// The second batch has jobs of a new test run before the remaining jobs
+	// of the older one
+	jobs := []TestJob{
+		TestJob{Id: 1, CostPredictionSeconds: 5, TestRunId: 1, QueuedAtSecondsSinceEpoch: 100},
+		TestJob{Id: 2, CostPredictionSeconds: 5, TestRunId: 1, QueuedAtSecondsSinceEpoch: 100},
+		TestJob{Id: 3, CostPredictionSeconds: 5, TestRunId: 2, QueuedAtSecondsSinceEpoch: 105},
+		TestJob{Id: 4, CostPredictionSeconds: 5, TestRunId: 2, QueuedAtSecondsSinceEpoch: 105},
+		TestJob{Id: 5, CostPredictionSeconds: 5, TestRunId: 1, QueuedAtSecondsSinceEpoch: 105},
+	}
+
+	fifo, _ := simulateQueue(jobs, JOB_ORDER_FIFO, 2)
+	oldestFirst, _ := simulateQueue(jobs, JOB_ORDER_OLDEST_TEST_RUN_FIRST, 2)
+	if fifo[1] != 15 || oldestFirst[1] != 10 {
+		t.Error("Expected the older test run to finish at 15 (fifo) and 10 (oldest first) but got:",
+			fifo[1], oldestFirst[1])
+	}
+	if fifo[2] != 10 || oldestFirst[2] != 15 {
+		t.Error("Expected the newer test run to finish at 10 (fifo) and 15 (oldest first) but got:",
+			fifo[2], oldestFirst[2])
+	}
+}
+
+func TestAddJobsSortsTheQueue(t *testing.T) {
+	manager := Manager{jobOrder: JOB_ORDER_LONGEST_FIRST,
+		jobs: []TestJob{TestJob{Id: 1, CostPredictionSeconds: 2}}}
+
+	manager.AddJobs([]TestJob{
+		TestJob{Id: 2, CostPredictionSeconds: 1},
+		TestJob{Id: 3, CostPredictionSeconds: 5},
+	})
+	if ids := jobIds(manager.jobs); !reflect.DeepEqual(ids, []int{3, 1, 2}) {
+		t.Error("Expected the jobs to be sorted longest first but got:", ids)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	KNOWN_HOSTS_NAME = "testributor_known_hosts"
+
+	// Values accepted by ssh_host_key_checking. "accept-new" trusts
+	// (and remembers) hosts we have never seen but still refuses changed keys.
+	// With the shell git backend it requires OpenSSH 7.6 or newer.
+	HOST_KEY_CHECKING_STRICT     = "yes"
+	HOST_KEY_CHECKING_ACCEPT_NEW = "accept-new"
+)
+
+// The host keys of the hosting services most projects live on. They are
+// published here:
+// https://docs.github.com/en/authentication/keeping-your-account-and-data-secure/githubs-ssh-key-fingerprints
+// https://support.atlassian.com/bitbucket-cloud/docs/configure-ssh-and-two-step-verification/
+// https://docs.gitlab.com/ee/user/gitlab_com/#ssh-known_hosts-entries
+const BUNDLED_KNOWN_HOSTS = `github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+github.com ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg=
+github.com ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCj7ndNxQowgcQnjshcLrqPEiiphnt+VTTvDP6mHBL9j1aNUkY4Ue1gvwnGLVlOhGeYrnZaMgRK6+PKCUXaDbC7qtbW8gIkhL7aGCsOr/C56SJMy/BCZfxd1nWzAOxSDPgVsmerOBYfNqltV9/hWCqBywINIR+5dIg6JTJ72pcEpEjcYgXkE2YEFXV1JHnsKgbLWNlhScqb2UmyRkQyytRLtL+38TGxkxCflmO+5Z8CSSNY7GidjMIZ7Q4zMjA2n1nGrlTDkzwDCsw+wqFPGQA179cnfGWOWRVruj16z6XyvxvjJwbz0wQZ75XK5tKSb7FNyeIEs4TT4jk+S4dhPeAUC5y+bDYirYgM4GC7uEnztnZyaVWQ7B381AK4Qdrwt51ZqExKbQpTUNn+EjqoTwvqNj4kqx5QUCI0ThS/YkOxJCXmPUWZbhjpCg56i+2aB6CmK2JGhn57K5mj0MNdBXA4/WnwH6XoPWJzK5Nyu2zB3nAZp+S5hpQs+p1vN1/wsjk=
+bitbucket.org ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIazEu89wgQZ4bqs3d63QSMzYVa0MuJ2e2gKTKqu+UUO
+bitbucket.org ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBPIQmuzMBuKdWeF4+a2sjSSpBK0iqitSQ+5BM9KhpexuGt20JpTVM7u5BDZngncgrqDMbWdxMWWOGtZ9UgbqgZE=
+gitlab.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAfuCHKVTjquxvt6CM6tdG4SLp1Btn/nOeHHE5UOzRdf
+gitlab.com ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBFSMqzJeV9rUzU4kWitGjeR4PWSa29SPqJ1fVkhtj3Hw9xjLVXVYrU9QlYWrOLXBpQ6KWjbjTDTdDkoohFzgbEY=
+`
+
+// KnownHosts returns the contents of our known_hosts file. These are the
+// bundled host keys followed by any keys sent by Testributor (for self hosted
+// repositories) and any keys in the ssh_known_hosts setting.
+func (project *Project) KnownHosts() string {
+	knownHosts := BUNDLED_KNOWN_HOSTS
+
+	for _, extra := range []string{project.sshKnownHosts, project.Config().SshKnownHosts} {
+		if extra = strings.TrimSpace(extra); extra != "" {
+			knownHosts += extra + "\n"
+		}
+	}
+
+	return knownHosts
+}
+
+// HostKeyChecking returns the value to use for ssh's StrictHostKeyChecking
+// option. Unknown hosts are rejected unless the user explicitly asks otherwise.
+func HostKeyChecking(config *Config) (string, error) {
+	switch value := config.SshHostKeyChecking; value {
+	case "", HOST_KEY_CHECKING_STRICT:
+		return HOST_KEY_CHECKING_STRICT, nil
+	case HOST_KEY_CHECKING_ACCEPT_NEW:
+		return HOST_KEY_CHECKING_ACCEPT_NEW, nil
+	default:
+		return "", errors.New("Invalid ssh_host_key_checking: " + value +
+			". Use \"" + HOST_KEY_CHECKING_STRICT + "\" or \"" + HOST_KEY_CHECKING_ACCEPT_NEW + "\".")
+	}
+}
+
+// SshConfig returns the contents of our ssh config file which makes ssh
+// verify hosts against our own known_hosts file only.
+func SshConfig(hostKeyChecking string, knownHostsFile string) string {
+	return "Host *\n" +
+		"    StrictHostKeyChecking " + hostKeyChecking + "\n" +
+		"    UserKnownHostsFile \"" + knownHostsFile + "\"\n"
+}
+
+// HostKeyCallback verifies hosts against the known_hosts file the way ssh does
+// with the given StrictHostKeyChecking value. It is used by the builtin git
+// backend. With accept-new, unknown hosts are appended to the file.
+func HostKeyCallback(hostKeyChecking string, knownHostsFile string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		// Read the file every time so we see the hosts accepted in the meantime
+		callback, err := knownhosts.New(knownHostsFile)
+		if err != nil {
+			return err
+		}
+
+		err = callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		// A changed key has the known keys in Want and is always refused
+		if hostKeyChecking != HOST_KEY_CHECKING_ACCEPT_NEW || !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+			return err
+		}
+
+		file, err := os.OpenFile(knownHostsFile, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = file.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+
+		return err
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKnownHosts(t *testing.T) {
+	config := DefaultConfig()
+	config.SshKnownHosts = "config.example.com ssh-ed25519 AAAA_CONFIG"
+	project := Project{sshKnownHosts: "git.example.com ssh-ed25519 AAAA_SETUP_DATA\n", config: config}
+
+	knownHosts := project.KnownHosts()
+
+	if !strings.HasPrefix(knownHosts, BUNDLED_KNOWN_HOSTS) {
+		t.Error("It should include the bundled host keys")
+	}
+	if !strings.Contains(knownHosts, "\ngit.example.com ssh-ed25519 AAAA_SETUP_DATA\n") {
+		t.Error("It should include the host keys from setup data but got: ", knownHosts)
+	}
+	if !strings.HasSuffix(knownHosts, "\nconfig.example.com ssh-ed25519 AAAA_CONFIG\n") {
+		t.Error("It should include the host keys from the config but got: ", knownHosts)
+	}
+}
+
+func TestHostKeyChecking(t *testing.T) {
+	config := DefaultConfig()
+	if value, err := HostKeyChecking(config); err != nil || value != HOST_KEY_CHECKING_STRICT {
+		t.Error("It should be strict by default but got: ", value, err)
+	}
+
+	config.SshHostKeyChecking = "accept-new"
+	if value, err := HostKeyChecking(config); err != nil || value != HOST_KEY_CHECKING_ACCEPT_NEW {
+		t.Error("It should allow accept-new but got: ", value, err)
+	}
+
+	config.SshHostKeyChecking = "no"
+	if _, err := HostKeyChecking(config); err == nil {
+		t.Error("It should not allow disabling host key checking")
+	}
+}
+
+func TestSshConfig(t *testing.T) {
+	expected := "Host *\n" +
+		"    StrictHostKeyChecking yes\n" +
+		"    UserKnownHostsFile \"/home/testributor/.ssh/testributor_known_hosts\"\n"
+
+	if config := SshConfig("yes", "/home/testributor/.ssh/testributor_known_hosts"); config != expected {
+		t.Error("Expected: \n" + expected + "\nGot: \n" + config)
+	}
+}
+
+func generateHostKey(t *testing.T) ssh.PublicKey {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	key, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_known_hosts")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	knownHostsFile := filepath.Join(dir, KNOWN_HOSTS_NAME)
+	ioutil.WriteFile(knownHostsFile, []byte(BUNDLED_KNOWN_HOSTS), 0600)
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	key := generateHostKey(t)
+
+	strict := HostKeyCallback(HOST_KEY_CHECKING_STRICT, knownHostsFile)
+	if err := strict("git.example.com:22", remote, key); err == nil {
+		t.Error("It should reject unknown hosts when strict")
+	}
+
+	acceptNew := HostKeyCallback(HOST_KEY_CHECKING_ACCEPT_NEW, knownHostsFile)
+	if err := acceptNew("git.example.com:22", remote, key); err != nil {
+		t.Error("It should accept unknown hosts with accept-new but got: ", err)
+	}
+	if err := strict("git.example.com:22", remote, key); err != nil {
+		t.Error("It should remember the accepted hosts but got: ", err)
+	}
+	if err := acceptNew("git.example.com:22", remote, generateHostKey(t)); err == nil {
+		t.Error("It should reject changed keys with accept-new")
+	}
+}
@@ -1,35 +1,166 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 )
 
+const (
+	LOG_LEVEL_DEBUG = "debug"
+	LOG_LEVEL_INFO  = "info"
+	LOG_LEVEL_WARN  = "warn"
+	LOG_LEVEL_ERROR = "error"
+
+	// The "[time][uuid][prefix] message" lines (the default)
+	LOG_FORMAT_TEXT = "text"
+	// One JSON object per line with the level and the fields
+	LOG_FORMAT_JSON = "json"
+)
+
+var LOG_LEVELS = map[string]int{
+	LOG_LEVEL_DEBUG: 0,
+	LOG_LEVEL_INFO:  1,
+	LOG_LEVEL_WARN:  2,
+	LOG_LEVEL_ERROR: 3,
+}
+
+// Set by ConfigureLogging
+var logLevel = LOG_LEVEL_INFO
+var logFormat = LOG_FORMAT_TEXT
+
+// LogSettings returns the format and the minimum level of the logs set with
+// the log_format and log_level settings.
+func LogSettings(config *Config) (string, string, error) {
+	format := config.LogFormat
+	switch format {
+	case "":
+		format = LOG_FORMAT_TEXT
+	case LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+	default:
+		return "", "", errors.New("Invalid log_format: " + format +
+			". Use \"" + LOG_FORMAT_TEXT + "\" or \"" + LOG_FORMAT_JSON + "\".")
+	}
+
+	level := strings.ToLower(config.LogLevel)
+	if level == "" {
+		level = LOG_LEVEL_INFO
+	}
+	if _, ok := LOG_LEVELS[level]; !ok {
+		return "", "", errors.New("Invalid log_level: " + level + ". Use \"" + LOG_LEVEL_DEBUG +
+			"\", \"" + LOG_LEVEL_INFO + "\", \"" + LOG_LEVEL_WARN + "\" or \"" + LOG_LEVEL_ERROR + "\".")
+	}
+
+	return format, level, nil
+}
+
+// ConfigureLogging sets the format and the minimum level of the logs (see
+// LogSettings).
+func ConfigureLogging(config *Config) error {
+	format, level, err := LogSettings(config)
+	if err != nil {
+		return err
+	}
+
+	logFormat = format
+	logLevel = level
+
+	return nil
+}
+
 type Logger struct {
 	prefix string // The name of the "thread"
 	writer io.Writer
+	// Added to every JSON line (e.g. test_run_id, job_id, commit_sha)
+	fields map[string]interface{}
 }
 
-// Write is implemented as part of the io.Writer interface
+// With returns a copy of the logger which adds the field to its messages.
+func (l Logger) With(key string, value interface{}) Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	l.fields = fields
+
+	return l
+}
+
+// Write is implemented as part of the io.Writer interface. It is used for the
+// output of the commands we run, which is logged at the info level (and
+// marked as command output in the JSON format).
 func (l Logger) Write(p []byte) (n int, err error) {
+	if err = l.write(LOG_LEVEL_INFO, string(p), true); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// write writes one line (the writer is os.Stdout which isn't buffered so there
+// is nothing to flush).
+func (l Logger) write(level string, message string, commandOutput bool) error {
+	if LOG_LEVELS[level] < LOG_LEVELS[logLevel] {
+		return nil
+	}
 	now := time.Now().UTC()
-	short_uuid := WorkerUUIDShort
 
-	// TODO: ljust
-	prefix := now.Format(
-		"[15:04:05 Mon 02 Jan UTC]") +
-		"[" + short_uuid + "]" +
-		"[" + l.prefix + "]"
+	var line []byte
+	if logFormat == LOG_FORMAT_JSON {
+		entry := map[string]interface{}{
+			"time":        now.Format(time.RFC3339Nano),
+			"level":       level,
+			"component":   l.prefix,
+			"worker_uuid": WorkerUUID,
+			"message":     message,
+		}
+		for key, value := range l.fields {
+			entry[key] = value
+		}
+		if commandOutput {
+			entry["source"] = "command"
+		}
+
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			return err
+		}
+	} else {
+		// TODO: ljust
+		prefix := now.Format(
+			"[15:04:05 Mon 02 Jan UTC]") +
+			"[" + WorkerUUIDShort + "]" +
+			"[" + l.prefix + "]"
 
-	prefix = fmt.Sprintf("%-40s ", prefix)
+		prefix = fmt.Sprintf("%-40s ", prefix)
+		if level != LOG_LEVEL_INFO {
+			prefix += strings.ToUpper(level) + ": "
+		}
+		line = []byte(prefix + message)
+	}
 
-	//TODO We used STDOUT.flush in ruby, is it needed here too?
-	return l.writer.Write([]byte(prefix + string(p) + "\n"))
+	_, err := l.writer.Write(append(line, '\n'))
+	return err
 }
 
 // This should be used to write strings instead for byte arrays (which is what
-// Write methods expects)
+// Write methods expects). Messages are logged at the info level.
 func (l Logger) Log(message string) {
-	l.Write([]byte(message))
+	l.write(LOG_LEVEL_INFO, message, false)
+}
+
+func (l Logger) Debug(message string) {
+	l.write(LOG_LEVEL_DEBUG, message, false)
+}
+
+func (l Logger) Warn(message string) {
+	l.write(LOG_LEVEL_WARN, message, false)
+}
+
+func (l Logger) Error(message string) {
+	l.write(LOG_LEVEL_ERROR, message, false)
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -17,7 +21,7 @@ func (w *myWriter) Write(p []byte) (n int, err error) {
 
 func TestLogPrefix(t *testing.T) {
 	writer := myWriter{}
-	logger := Logger{"Some prefix", &writer}
+	logger := Logger{prefix: "Some prefix", writer: &writer}
 
 	logger.Log("This is my message")
 
@@ -30,3 +34,95 @@ func TestLogPrefix(t *testing.T) {
 			"Expected format: " + expectedFormat)
 	}
 }
+
+func withLogging(format string, level string, test func()) {
+	defer func(format string, level string) { logFormat, logLevel = format, level }(logFormat, logLevel)
+	logFormat, logLevel = format, level
+	test()
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer func(format string, level string) { logFormat, logLevel = format, level }(logFormat, logLevel)
+	config := DefaultConfig()
+
+	config.LogFormat = "json"
+	config.LogLevel = "WARN"
+	if err := ConfigureLogging(config); err != nil || logFormat != LOG_FORMAT_JSON || logLevel != LOG_LEVEL_WARN {
+		t.Error("Expected the json format and the warn level but got:", logFormat, logLevel, err)
+	}
+
+	config.LogFormat = ""
+	config.LogLevel = ""
+	if err := ConfigureLogging(config); err != nil || logFormat != LOG_FORMAT_TEXT || logLevel != LOG_LEVEL_INFO {
+		t.Error("Expected the text format and the info level but got:", logFormat, logLevel, err)
+	}
+
+	config.LogFormat = "xml"
+	if err := ConfigureLogging(config); err == nil {
+		t.Error("Expected an error for an invalid format")
+	}
+	config.LogFormat = ""
+	config.LogLevel = "verbose"
+	if err := ConfigureLogging(config); err == nil {
+		t.Error("Expected an error for an invalid level")
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	withLogging(LOG_FORMAT_TEXT, LOG_LEVEL_WARN, func() {
+		var out bytes.Buffer
+		logger := Logger{prefix: "Worker", writer: &out}
+
+		logger.Debug("debugging")
+		logger.Log("information")
+		logger.Write([]byte("command output"))
+		logger.Warn("careful")
+		logger.Error("broken")
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 2 || !strings.HasSuffix(lines[0], "] WARN: careful") ||
+			!strings.HasSuffix(lines[1], "] ERROR: broken") {
+			t.Error("Expected only the warning and the error but got:", out.String())
+		}
+	})
+}
+
+func TestJsonLogs(t *testing.T) {
+	defer func(uuid string) { WorkerUUID = uuid }(WorkerUUID)
+	WorkerUUID = "3fd7c48e-1b8a-4f37-9d0c-2a5f4c1e8b6d"
+
+	withLogging(LOG_FORMAT_JSON, LOG_LEVEL_DEBUG, func() {
+		var out bytes.Buffer
+		logger := Logger{prefix: "Worker", writer: &out}
+		jobLogger := logger.With("test_run_id", 5).With("job_id", 12)
+
+		jobLogger.Log("Running bin/rspec")
+		jobLogger.Write([]byte("1 example, 0 failures"))
+		logger.Error("broken")
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if len(lines) != 3 {
+			t.Fatal("Expected 3 lines but got:", out.String())
+		}
+		var entries []map[string]interface{}
+		for _, line := range lines {
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatal("Expected JSON but got:", line)
+			}
+			delete(entry, "time")
+			entries = append(entries, entry)
+		}
+
+		expected := []map[string]interface{}{
+			{"level": "info", "component": "Worker", "worker_uuid": WorkerUUID, "message": "Running bin/rspec",
+				"test_run_id": float64(5), "job_id": float64(12)},
+			{"level": "info", "component": "Worker", "worker_uuid": WorkerUUID, "message": "1 example, 0 failures",
+				"test_run_id": float64(5), "job_id": float64(12), "source": "command"},
+			{"level": "error", "component": "Worker", "worker_uuid": WorkerUUID, "message": "broken"},
+		}
+		if !reflect.DeepEqual(entries, expected) {
+			t.Error("Expected", expected, "but got:", entries)
+		}
+	})
+}
@@ -8,7 +8,6 @@ import (
 )
 
 const (
-	MIN_WORKLOAD_SECONDS                    = 10
 	NO_JOBS_ON_TESTRIBUTOR_TIMEOUT_SECONDS  = 5
 	REMAINING_WORKLOAD_CHECK_TIMOUT_SECONDS = 5
 )
@@ -17,25 +16,47 @@ type Manager struct {
 	jobsChannel                           chan *TestJob
 	newJobsChannel                        chan []TestJob // TODO: Make this a pointer to slice?
 	cancelledTestRunIdsChan               chan []int
-	workerIdlingChannel                   chan bool
+	workerIdlingChannel                   chan *TestJob // The jobs the worker finished
 	jobs                                  []TestJob
+	jobOrder                              string // See SortJobs
 	workerCurrentJobCostPredictionSeconds float64
 	workerCurrentJobStartedAt             time.Time
+	workerCurrentJob                      *TestJob // nil when the worker is idle
+	cancelledTestRunIds                   []int    // The latest ones (see MAX_CANCELLED_TEST_RUNS_IN_STATUS)
+	statusRequestsChan                    chan chan ManagerStatus
+	workload                              WorkloadModel
+	history                               *DurationHistory
+	stealer                               *WorkStealer
+	stealRequestsChan                     chan chan []TestJob // Other agents asking for jobs
+	jobLogs                               *JobLogs
 	logger                                Logger
 	client                                *APIClient
 }
 
 // NewManager should be used to create a Manager instances. It ensures the correct
 // initialization of all fields.
-func NewManager(jobsChannel chan *TestJob, cancelledTestRunIdsChan chan []int) *Manager {
-	logger := Logger{"Manager", os.Stdout}
+func NewManager(config *Config, jobsChannel chan *TestJob, cancelledTestRunIdsChan chan []int,
+	history *DurationHistory) *Manager {
+	logger := Logger{prefix: "Manager", writer: os.Stdout}
+
+	jobOrder, err := JobOrder(config)
+	if err != nil {
+		logger.Warn(err.Error())
+		jobOrder = JOB_ORDER_FIFO
+	}
+
 	return &Manager{
 		jobsChannel:             jobsChannel,
 		cancelledTestRunIdsChan: cancelledTestRunIdsChan,
 		newJobsChannel:          make(chan []TestJob),
-		workerIdlingChannel:     make(chan bool),
+		stealRequestsChan:       make(chan chan []TestJob),
+		statusRequestsChan:      make(chan chan ManagerStatus),
+		workerIdlingChannel:     make(chan *TestJob),
+		jobOrder:                jobOrder,
+		workload:                WorkloadModel{minWorkloadSeconds: config.MinWorkloadSeconds},
+		history:                 history,
 		logger:                  logger,
-		client:                  NewClient(logger),
+		client:                  NewClient(config, logger),
 	}
 }
 
@@ -45,19 +66,38 @@ func NewManager(jobsChannel chan *TestJob, cancelledTestRunIdsChan chan []int) *
 // If there are jobs, it schedules a call to checkWorkload and exits.
 // checkWorkload will call FetchJobs again when needed.
 func (m *Manager) FetchJobs() {
-	result, err := m.client.FetchJobs()
+	span := StartSpan("Manager.FetchJobs", nil)
+	fetchStartedAt := time.Now()
+	result, err := m.client.FetchJobs(span)
 	if err != nil {
 		panic("Tried to fetch some jobs but there was an error: " + err.Error())
 	}
+	fetchSeconds := time.Since(fetchStartedAt).Seconds()
+	m.workload.LearnFetchLatency(fetchSeconds)
+	metricFetchDuration.Observe(fetchSeconds)
 	var jobs = make([]TestJob, 0, 10)
 	for _, job := range result.([]interface{}) {
 		testJob := NewTestJob(job.(map[string]interface{}))
 		testJob.QueuedAtSecondsSinceEpoch = time.Now().Unix()
 		jobs = append(jobs, testJob)
 	}
-
 	if len(jobs) > 0 {
 		m.logger.Log("Fetched " + strconv.Itoa(len(jobs)) + " jobs")
+	} else {
+		metricEmptyFetchesTotal.Inc()
+		if len(m.jobs) == 0 {
+			// Nothing left on Testributor. Help the other agents on this machine.
+			jobs = m.stealer.StealJobs()
+			span.SetAttribute("testributor.jobs.stolen", len(jobs))
+		}
+	}
+	span.SetAttribute("testributor.jobs.fetched", len(jobs))
+	span.End()
+	for i := range jobs {
+		jobs[i].startSpan(span)
+	}
+
+	if len(jobs) > 0 {
 		m.newJobsChannel <- jobs
 		// Schedule next check of remaining workload
 		go func() {
@@ -92,7 +132,7 @@ func (m *Manager) checkWorkload() {
 // worker (minimum 0)
 func (m *Manager) workloadOnWorkerSeconds() float64 {
 	secondsLeft :=
-		m.workerCurrentJobCostPredictionSeconds - float64(time.Since(m.workerCurrentJobStartedAt))
+		m.workerCurrentJobCostPredictionSeconds - time.Since(m.workerCurrentJobStartedAt).Seconds()
 
 	if secondsLeft < 0 {
 		return 0
@@ -101,13 +141,14 @@ func (m *Manager) workloadOnWorkerSeconds() float64 {
 	}
 }
 
-// TotalWorkloadInQueueSeconds return the sum of CostPredictionSeconds of
-// all jobs in queue plus the workloadOnWorkerSeconds.
+// TotalWorkloadInQueueSeconds return the sum of the expected durations (see
+// WorkloadModel.JobSeconds) of all jobs in queue plus the
+// workloadOnWorkerSeconds.
 func (m *Manager) TotalWorkloadInQueueSeconds() float64 {
 	totalWorkload := float64(0)
 
 	for _, job := range m.jobs {
-		totalWorkload += job.CostPredictionSeconds
+		totalWorkload += m.workload.JobSeconds(job)
 	}
 
 	totalWorkload += m.workloadOnWorkerSeconds()
@@ -116,9 +157,9 @@ func (m *Manager) TotalWorkloadInQueueSeconds() float64 {
 }
 
 // LowWorkload returns true when the total workload (the one the list + the one
-// already on the worker) is lower than MIN_WORKLOAD_SECONDS.
+// already on the worker) is lower than WorkloadModel.MinWorkloadSeconds.
 func (m *Manager) LowWorkload() bool {
-	return m.TotalWorkloadInQueueSeconds() <= MIN_WORKLOAD_SECONDS
+	return m.TotalWorkloadInQueueSeconds() <= m.workload.MinWorkloadSeconds()
 }
 
 // AssignJobToWorker removes the first job from the queue and writes the
@@ -127,8 +168,9 @@ func (m *Manager) LowWorkload() bool {
 func (m *Manager) AssignJobToWorker() bool {
 	if length := len(m.jobs); length > 0 {
 		jobToBeAssigned := m.jobs[0]
-		m.workerCurrentJobCostPredictionSeconds = jobToBeAssigned.CostPredictionSeconds
+		m.workerCurrentJobCostPredictionSeconds = m.workload.JobSeconds(jobToBeAssigned)
 		m.workerCurrentJobStartedAt = time.Now()
+		m.workerCurrentJob = &jobToBeAssigned
 
 		newJobsList := make([]TestJob, len(m.jobs)-1)
 		copy(newJobsList, m.jobs[1:])
@@ -140,6 +182,44 @@ func (m *Manager) AssignJobToWorker() bool {
 	}
 }
 
+// AddJobs adds the new jobs to the queue and sorts it in the Manager's
+// jobOrder. The jobs get the durations of their commands from the history.
+func (m *Manager) AddJobs(newJobs []TestJob) {
+	for i := range newJobs {
+		if p50, p95, ok := m.history.Percentiles(newJobs[i].Command); ok {
+			newJobs[i].DurationP50Seconds = p50
+			newJobs[i].DurationP95Seconds = p95
+		}
+	}
+	m.jobs = append(m.jobs, newJobs...)
+	SortJobs(m.jobs, m.jobOrder, &m.workload)
+}
+
+// GiveAwayJobs removes up to half of the queued jobs (the ones which would
+// run last) from the queue and returns them. They are given to another agent
+// (see WorkStealer).
+func (m *Manager) GiveAwayJobs() []TestJob {
+	count := len(m.jobs) / 2
+	if count == 0 {
+		return nil
+	}
+
+	given := make([]TestJob, count)
+	copy(given, m.jobs[len(m.jobs)-count:])
+	m.jobs = m.jobs[:len(m.jobs)-count]
+
+	return given
+}
+
+// LearnDuration records the duration of a job the worker finished.
+func (m *Manager) LearnDuration(job *TestJob) {
+	m.workload.LearnDuration(job)
+	if job == nil {
+		return
+	}
+	m.history.Record(job.Command, job.RunSeconds)
+}
+
 func (m *Manager) CancelTestRuns(ids []int) {
 	if len(ids) == 0 {
 		return
@@ -152,6 +232,8 @@ func (m *Manager) CancelTestRuns(ids []int) {
 		for _, id := range ids {
 			if job.TestRunId == id {
 				cancelledIdsSet[strconv.Itoa(id)] = struct{}{}
+				job.span.SetAttribute("testributor.job.cancelled", true)
+				job.span.End()
 			} else {
 				newJobsList = append(newJobsList, job)
 			}
@@ -166,36 +248,56 @@ func (m *Manager) CancelTestRuns(ids []int) {
 		}
 		m.logger.Log("Cancelling builds: " + strings.Join(cancelledIds, ", "))
 		m.jobs = newJobsList
+		for id := range cancelledIdsSet {
+			intId, _ := strconv.Atoi(id)
+			m.cancelledTestRunIds = append(m.cancelledTestRunIds, intId)
+		}
+		if extra := len(m.cancelledTestRunIds) - MAX_CANCELLED_TEST_RUNS_IN_STATUS; extra > 0 {
+			m.cancelledTestRunIds = m.cancelledTestRunIds[extra:]
+		}
 	}
 }
 
 func (m *Manager) ParseChannels() {
 	var newJobs []TestJob
+	defer func() { metricQueuedJobs.Set(float64(len(m.jobs))) }()
 
 	// TODO: These two selects need DRYing
 	if len(m.jobs) > 0 {
 		// TODO: we also need to monitor for cancelled jobs
 		select {
 		case newJobs = <-m.newJobsChannel:
-			m.jobs = append(m.jobs, newJobs...)
-		case <-m.workerIdlingChannel:
+			m.AddJobs(newJobs)
+		case finishedJob := <-m.workerIdlingChannel:
 			m.workerCurrentJobCostPredictionSeconds = 0
+			m.workerCurrentJob = nil
+			m.LearnDuration(finishedJob)
 		case cancelledIds := <-m.cancelledTestRunIdsChan:
 			m.CancelTestRuns(cancelledIds)
 		case m.jobsChannel <- &m.jobs[0]:
 			m.AssignJobToWorker()
+		case reply := <-m.stealRequestsChan:
+			reply <- m.GiveAwayJobs()
+		case reply := <-m.statusRequestsChan:
+			reply <- m.Status()
 		}
 	} else {
 		// If there are no jobs left in the list, we don't want to try to push
 		// a job to the worker
 		select {
 		case newJobs = <-m.newJobsChannel:
-			m.jobs = append(m.jobs, newJobs...)
-		case <-m.workerIdlingChannel:
+			m.AddJobs(newJobs)
+		case finishedJob := <-m.workerIdlingChannel:
 			m.workerCurrentJobCostPredictionSeconds = 0
+			m.workerCurrentJob = nil
+			m.LearnDuration(finishedJob)
 		case <-m.cancelledTestRunIdsChan:
 			// Do nothing, we just read this to let the Reporter continue.
 			// The reporter doesn't know if Manager has jobs in queue or not.
+		case reply := <-m.stealRequestsChan:
+			reply <- nil
+		case reply := <-m.statusRequestsChan:
+			reply <- m.Status()
 		}
 	}
 }
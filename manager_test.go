@@ -2,6 +2,8 @@ package main
 
 import (
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -154,7 +156,7 @@ func TestParseChannelsWhenJobsExists(t *testing.T) {
 }
 
 func TestParseChannelsWhenWorkerIsIdlingAndThereAreNoJobs(t *testing.T) {
-	workerIdlingChannel := make(chan bool)
+	workerIdlingChannel := make(chan *TestJob)
 
 	manager := Manager{
 		jobs:                                  []TestJob{},
@@ -163,7 +165,7 @@ func TestParseChannelsWhenWorkerIsIdlingAndThereAreNoJobs(t *testing.T) {
 	}
 
 	go func() {
-		manager.workerIdlingChannel <- true
+		manager.workerIdlingChannel <- &TestJob{}
 	}()
 
 	manager.ParseChannels()
@@ -175,7 +177,7 @@ func TestParseChannelsWhenWorkerIsIdlingAndThereAreNoJobs(t *testing.T) {
 }
 
 func TestParseChannelsWhenWorkerIsIdlingAndThereAreJobs(t *testing.T) {
-	workerIdlingChannel := make(chan bool)
+	workerIdlingChannel := make(chan *TestJob)
 
 	manager := Manager{
 		jobs: []TestJob{
@@ -186,7 +188,7 @@ func TestParseChannelsWhenWorkerIsIdlingAndThereAreJobs(t *testing.T) {
 	}
 
 	go func() {
-		manager.workerIdlingChannel <- true
+		manager.workerIdlingChannel <- &TestJob{}
 	}()
 
 	manager.ParseChannels()
@@ -208,7 +210,7 @@ func TestCancelTestRuns(t *testing.T) {
 	manager := Manager{
 		jobs: []TestJob{job1, job2, job3, job4},
 		cancelledTestRunIdsChan: cancelledTestRunIdsChan,
-		logger:                  Logger{"Manager", ioutil.Discard},
+		logger:                  Logger{prefix: "Manager", writer: ioutil.Discard},
 	}
 
 	manager.CancelTestRuns([]int{1234})
@@ -229,7 +231,7 @@ func TestCancelTestRunsThroughParseChannels(t *testing.T) {
 	manager := Manager{
 		jobs: []TestJob{job1, job2, job3, job4},
 		cancelledTestRunIdsChan: cancelledTestRunIdsChan,
-		logger:                  Logger{"Manager", ioutil.Discard},
+		logger:                  Logger{prefix: "Manager", writer: ioutil.Discard},
 	}
 
 	go func() {
@@ -242,3 +244,64 @@ func TestCancelTestRunsThroughParseChannels(t *testing.T) {
 		t.Error("It should remove cancelled builds from the jobs slice")
 	}
 }
+
+func TestWorkloadOnWorkerSeconds(t *testing.T) {
+	manager := Manager{
+		workerCurrentJobCostPredictionSeconds: 10,
+		workerCurrentJobStartedAt:             time.Now().Add(-4 * time.Second),
+	}
+
+	if seconds := manager.workloadOnWorkerSeconds(); seconds < 5.5 || seconds > 6 {
+		t.Error("Expected about 6 seconds left on the worker but got:", seconds)
+	}
+}
+
+func TestLowWorkloadWithUnpredictedJobs(t *testing.T) {
+	manager := Manager{jobs: []TestJob{
+		TestJob{Command: "bin/rspec spec/a_spec.rb", CostPredictionSeconds: NO_PREDICTION_WORKLOAD_SECONDS},
+	}}
+	manager.workload.LearnDuration(&TestJob{Command: "bin/rspec spec/a_spec.rb", RunSeconds: 3})
+
+	if !manager.LowWorkload() {
+		t.Error("LowWorkload should use the learned duration of unpredicted jobs")
+	}
+}
+
+func TestParseChannelsLearnsTheDurationOfFinishedJobs(t *testing.T) {
+	manager := Manager{jobs: []TestJob{}, workerIdlingChannel: make(chan *TestJob)}
+
+	go func() {
+		manager.workerIdlingChannel <- &TestJob{Command: "bin/rspec", RunSeconds: 7}
+	}()
+	manager.ParseChannels()
+
+	if seconds := manager.workload.JobSeconds(TestJob{Command: "bin/rspec",
+		CostPredictionSeconds: NO_PREDICTION_WORKLOAD_SECONDS}); seconds != 7 {
+		t.Error("Expected the learned duration to be 7 but got:", seconds)
+	}
+}
+
+func TestAddJobsWithDurationHistory(t *testing.T) {
+	history := LoadDurationHistory(filepath.Join(os.TempDir(), "missing", "durations.json"),
+		"katana", Logger{prefix: "", writer: ioutil.Discard})
+	manager := Manager{jobs: []TestJob{}, history: history, workerIdlingChannel: make(chan *TestJob)}
+
+	go func() {
+		manager.workerIdlingChannel <- &TestJob{Command: "bin/rspec", RunSeconds: 7}
+	}()
+	manager.ParseChannels()
+
+	unpredicted := TestJob{Command: "bin/rspec", CostPredictionSeconds: NO_PREDICTION_WORKLOAD_SECONDS}
+	manager.AddJobs([]TestJob{unpredicted})
+	if job := manager.jobs[0]; job.DurationP50Seconds != 7 || job.DurationP95Seconds != 7 {
+		t.Error("Expected the job to get the durations from the history but got:",
+			job.DurationP50Seconds, job.DurationP95Seconds)
+	}
+
+	// A new agent only has the history
+	manager = Manager{history: history}
+	manager.AddJobs([]TestJob{unpredicted})
+	if seconds := manager.workload.JobSeconds(manager.jobs[0]); seconds != 7 {
+		t.Error("Expected the median duration (7) but got:", seconds)
+	}
+}
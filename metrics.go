@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const METRICS_PATH = "/metrics"
+
+// The buckets (in seconds) of the duration histograms
+var DURATION_BUCKETS = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// The agent's metrics. They are always collected and served (in the
+// Prometheus text format) by the status server when TESTRIBUTOR_METRICS is
+// true.
+var (
+	metrics = &MetricsRegistry{}
+
+	metricJobsTotal = metrics.NewCounter("testributor_jobs_total",
+		"Jobs run by the worker by result type.", "result")
+	metricJobDuration = metrics.NewHistogram("testributor_job_duration_seconds",
+		"How long the jobs' commands ran.", DURATION_BUCKETS)
+	metricJobPredictionRatio = metrics.NewHistogram("testributor_job_duration_prediction_ratio",
+		"The duration of the jobs divided by Testributor's prediction (jobs with a prediction only).",
+		[]float64{0.25, 0.5, 0.8, 1, 1.25, 2, 4})
+	metricQueuedJobs = metrics.NewGauge("testributor_queued_jobs",
+		"Jobs in the Manager's queue.")
+	metricFetchDuration = metrics.NewHistogram("testributor_fetch_duration_seconds",
+		"How long fetching a batch of jobs from Testributor took.", DURATION_BUCKETS)
+	metricEmptyFetchesTotal = metrics.NewCounter("testributor_empty_fetches_total",
+		"Fetches which found no jobs on Testributor.")
+	metricReportBatchSize = metrics.NewHistogram("testributor_report_batch_size",
+		"Jobs sent in each report to Testributor.", []float64{1, 2, 5, 10, 20, 50, 100})
+	metricReportFailuresTotal = metrics.NewCounter("testributor_report_failures_total",
+		"Reports which couldn't be sent to Testributor.")
+	metricLastServerCommunication = metrics.NewGauge("testributor_last_server_communication_timestamp_seconds",
+		"When the agent last reported or beaconed to Testributor (seconds since the epoch).")
+	metricServerCommunicationAge = metrics.NewGaugeFunc("testributor_server_communication_age_seconds",
+		"Seconds since the agent last reported or beaconed to Testributor.", func() float64 {
+			if lastServerCommunication := metricLastServerCommunication.Value(); lastServerCommunication > 0 {
+				return float64(time.Now().UnixNano())/1e9 - lastServerCommunication
+			}
+			return math.NaN()
+		})
+	metricGitDuration = metrics.NewHistogram("testributor_git_duration_seconds",
+		"How long git operations on the project's repository took.", DURATION_BUCKETS, "operation")
+	metricApiRequestsTotal = metrics.NewCounter("testributor_api_requests_total",
+		"Requests to the Testributor API by path and status code (\"error\" when the request failed).",
+		"path", "status")
+	metricApiRequestDuration = metrics.NewHistogram("testributor_api_request_duration_seconds",
+		"How long requests to the Testributor API took.", DURATION_BUCKETS, "path")
+)
+
+// metric is implemented by every metric type.
+type metric interface {
+	write(w io.Writer)
+}
+
+// MetricsRegistry keeps the metrics served by ServeHTTP.
+type MetricsRegistry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+func (r *MetricsRegistry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func (r *MetricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteMetrics(w)
+}
+
+func (r *MetricsRegistry) WriteMetrics(w io.Writer) {
+	r.mutex.Lock()
+	registered := append([]metric{}, r.metrics...)
+	r.mutex.Unlock()
+
+	for _, m := range registered {
+		m.write(w)
+	}
+}
+
+// metricVec holds the values of a counter or a gauge per label values.
+type metricVec struct {
+	name       string
+	help       string
+	metricType string
+	labelNames []string
+	mutex      sync.Mutex
+	values     map[string]float64 // Joined label values -> value
+	labels     map[string][]string
+}
+
+func newMetricVec(name string, help string, metricType string, labelNames []string) *metricVec {
+	return &metricVec{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		labelNames: labelNames,
+		values:     make(map[string]float64),
+		labels:     make(map[string][]string),
+	}
+}
+
+func (v *metricVec) update(labelValues []string, update func(float64) float64) {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("%s needs the labels %v", v.name, v.labelNames))
+	}
+	key := strings.Join(labelValues, "\x00")
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.values[key] = update(v.values[key])
+	v.labels[key] = labelValues
+}
+
+func (v *metricVec) value(labelValues []string) float64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.values[strings.Join(labelValues, "\x00")]
+}
+
+func (v *metricVec) write(w io.Writer) {
+	writeHeader(w, v.name, v.help, v.metricType)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if len(v.labelNames) == 0 && len(v.values) == 0 {
+		// Metrics without labels always have a value
+		fmt.Fprintf(w, "%s 0\n", v.name)
+	}
+	for _, key := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labelNames, v.labels[key], "", ""),
+			formatMetricValue(v.values[key]))
+	}
+}
+
+// Counter is a value which only goes up.
+type Counter struct{ *metricVec }
+
+func (r *MetricsRegistry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	counter := &Counter{newMetricVec(name, help, "counter", labelNames)}
+	r.register(counter)
+	return counter
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.update(labelValues, func(current float64) float64 { return current + value })
+}
+
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.value(labelValues)
+}
+
+// Gauge is a value which goes up and down.
+type Gauge struct{ *metricVec }
+
+func (r *MetricsRegistry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	gauge := &Gauge{newMetricVec(name, help, "gauge", labelNames)}
+	r.register(gauge)
+	return gauge
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 { return value })
+}
+
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.value(labelValues)
+}
+
+// GaugeFunc is a gauge whose value is computed when the metrics are written.
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (r *MetricsRegistry) NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	gauge := &GaugeFunc{name: name, help: help, value: value}
+	r.register(gauge)
+	return gauge
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatMetricValue(g.value()))
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	name       string
+	help       string
+	buckets    []float64 // Upper bounds, sorted
+	labelNames []string
+	mutex      sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // Per bucket (not cumulative)
+	count       uint64
+	sum         float64
+}
+
+func (r *MetricsRegistry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	histogram := &Histogram{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     make(map[string]*histogramSeries),
+	}
+	r.register(histogram)
+	return histogram
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labelNames) {
+		panic(fmt.Sprintf("%s needs the labels %v", h.name, h.labelNames))
+	}
+	key := strings.Join(labelValues, "\x00")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// Count returns the number of observations.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if series, ok := h.series[strings.Join(labelValues, "\x00")]; ok {
+		return series.count
+	}
+	return 0
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		series := h.series[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(h.labelNames, series.labelValues, "le", formatMetricValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(h.labelNames, series.labelValues, "le", "+Inf"), series.count)
+		labels := formatLabels(h.labelNames, series.labelValues, "", "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatMetricValue(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, series.count)
+	}
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// formatLabels returns {name="value",...}. The extra label (e.g. the "le" of
+// histogram buckets) is added when extraName is not empty.
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+"=\""+escapeLabelValue(values[i])+"\"")
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+extraValue+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
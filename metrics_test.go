@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsRegistryWriteMetrics(t *testing.T) {
+	registry := &MetricsRegistry{}
+	counter := registry.NewCounter("jobs_total", "Jobs.", "result")
+	gauge := registry.NewGauge("queued_jobs", "Queued jobs.")
+	histogram := registry.NewHistogram("duration_seconds", "Durations.", []float64{1, 5}, "operation")
+	registry.NewGaugeFunc("answer", "The answer.", func() float64 { return 42 })
+
+	counter.Inc("passed")
+	counter.Inc("passed")
+	counter.Inc(`we"ird`)
+	histogram.Observe(0.5, "fetch")
+	histogram.Observe(3, "fetch")
+	histogram.Observe(10, "fetch")
+
+	var out bytes.Buffer
+	registry.WriteMetrics(&out)
+	expected := `# HELP jobs_total Jobs.
+# TYPE jobs_total counter
+jobs_total{result="passed"} 2
+jobs_total{result="we\"ird"} 1
+# HELP queued_jobs Queued jobs.
+# TYPE queued_jobs gauge
+queued_jobs 0
+# HELP duration_seconds Durations.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{operation="fetch",le="1"} 1
+duration_seconds_bucket{operation="fetch",le="5"} 2
+duration_seconds_bucket{operation="fetch",le="+Inf"} 3
+duration_seconds_sum{operation="fetch"} 13.5
+duration_seconds_count{operation="fetch"} 3
+# HELP answer The answer.
+# TYPE answer gauge
+answer 42
+`
+	if out.String() != expected {
+		t.Error("Expected:\n" + expected + "but got:\n" + out.String())
+	}
+
+	gauge.Set(3)
+	if value := gauge.Value(); value != 3 {
+		t.Error("Expected the gauge to be 3 but got:", value)
+	}
+}
+
+func TestObserveJob(t *testing.T) {
+	passed := metricJobsTotal.Value("passed")
+	ratios := metricJobPredictionRatio.Count()
+
+	observeJob(&TestJob{ResultType: 3, RunSeconds: 2, CostPredictionSeconds: 4})
+	observeJob(&TestJob{ResultType: 3, RunSeconds: 2, CostPredictionSeconds: NO_PREDICTION_WORKLOAD_SECONDS})
+
+	if value := metricJobsTotal.Value("passed"); value != passed+2 {
+		t.Error("Expected 2 more passed jobs but got:", value-passed)
+	}
+	if count := metricJobPredictionRatio.Count(); count != ratios+1 {
+		t.Error("Expected only the predicted job to be compared with its prediction but got:", count-ratios)
+	}
+}
+
+func TestStatusServerMetrics(t *testing.T) {
+	for _, serveMetrics := range []bool{false, true} {
+		server, err := StartStatusServer("127.0.0.1:0", &Manager{}, &Reporter{}, serveMetrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := http.Get("http://" + server.Address() + METRICS_PATH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		server.Close()
+
+		served := resp.StatusCode == http.StatusOK && strings.Contains(string(body), "testributor_jobs_total")
+		if served != serveMetrics {
+			t.Error("Expected the metrics to be served:", serveMetrics, "but got:", resp.StatusCode, string(body))
+		}
+	}
+}
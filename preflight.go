@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"github.com/testributor/agent/system_command"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// StrictHostKeyChecking=accept-new was added in OpenSSH 7.6
+	MIN_OPENSSH_VERSION_FOR_ACCEPT_NEW = "7.6"
+
+	BASH_INSTALL_HINT = "Install bash (e.g. apk add bash)."
+	SSH_INSTALL_HINT  = "Install the OpenSSH client (e.g. apk add openssh-client, apt-get install openssh-client, " +
+		"dnf install openssh-clients) or set TESTRIBUTOR_GIT_BACKEND=builtin."
+	GIT_INSTALL_HINT = "Install git or set TESTRIBUTOR_GIT_BACKEND=builtin."
+	TAR_INSTALL_HINT = "Install tar (needed to copy the project to the ssh executor's machine)."
+	DOCKER_HINT      = "Start Docker (or Podman) and make sure the agent's user can access its socket " +
+		"or set TESTRIBUTOR_DOCKER_SOCKET to its path."
+)
+
+// PreflightCheck is the result of checking one of the tools (or directories)
+// the agent needs. Problem is empty when the check passed.
+type PreflightCheck struct {
+	Name    string
+	Path    string
+	Version string
+	Problem string
+	Hint    string
+}
+
+// Preflight checks every external command the agent will run (and the
+// directories it will write to) before we start working on builds, so we
+// fail early with a helpful message instead of in the middle of a build.
+// It prints a report of all the checks and returns an error if any failed.
+// The paths of bash and ssh found are stored on the project.
+func (project *Project) Preflight(gitBackend string, logger Logger) error {
+	var checks []PreflightCheck
+
+	checks = append(checks, CheckShell())
+
+	// Build commands run where the executor runs them
+	switch executor, _ := ExecutorType(project.Config()); executor {
+	case EXECUTOR_DOCKER:
+		checks = append(checks, CheckDocker(DockerSocket(project.Config())))
+	case EXECUTOR_SSH:
+		destination := PreflightCheck{Name: "ssh executor", Hint: "Set executor_ssh_url (TESTRIBUTOR_EXECUTOR_SSH_URL) to the machine " +
+			"(and directory) the commands should run on (e.g. ssh://ci@10.0.0.5/srv/katana)."}
+		if url, err := (&SshExecutor{project: project}).Destination(); err != nil {
+			destination.Problem = err.Error()
+		} else {
+			destination.Path = url.HostWithPort() + ":" + url.Path
+		}
+		checks = append(checks, destination,
+			CheckCommand("tar", "tar --version", `(\d+(\.\d+)+)`, "", TAR_INSTALL_HINT))
+	default:
+		bash := CheckCommand("bash", "bash --version", `version (\d+(\.\d+)*)`, "", BASH_INSTALL_HINT)
+		project.bashPath = bash.Path
+		checks = append(checks, bash)
+	}
+
+	// The builtin backend uses neither git nor ssh
+	executor, _ := ExecutorType(project.Config())
+	if gitBackend == GIT_BACKEND_SHELL {
+		minimum := MIN_GIT_VERSION
+		if project.RepositoryTransport() == REPOSITORY_TRANSPORT_HTTPS {
+			minimum = MIN_GIT_VERSION_FOR_HTTPS
+		}
+		checks = append(checks,
+			CheckCommand("git", "git --version", `git version (\d+(\.\d+)*)`, minimum, GIT_INSTALL_HINT))
+	}
+	if (gitBackend == GIT_BACKEND_SHELL && project.RepositoryTransport() == REPOSITORY_TRANSPORT_SSH) ||
+		executor == EXECUTOR_SSH {
+		minimum := ""
+		if hostKeyChecking, _ := HostKeyChecking(project.Config()); hostKeyChecking == HOST_KEY_CHECKING_ACCEPT_NEW {
+			minimum = MIN_OPENSSH_VERSION_FOR_ACCEPT_NEW
+		}
+		// ssh -V prints something like "OpenSSH_9.2p1, OpenSSL 3.0.11 19 Sep 2023"
+		ssh := CheckCommand("ssh", "ssh -V", `OpenSSH_(\d+(\.\d+)*)`, minimum, SSH_INSTALL_HINT)
+		project.sshPath = ssh.Path
+		checks = append(checks, ssh)
+	}
+
+	checks = append(checks,
+		CheckWriteableDirectory("project directory", project.directory),
+		CheckWriteableDirectory("temporary directory", os.TempDir()))
+
+	PrintPreflightReport(checks, logger)
+
+	for _, check := range checks {
+		if check.Problem != "" {
+			return errors.New("Some of the preflight checks failed. See the report above.")
+		}
+	}
+
+	return nil
+}
+
+// CheckCommand looks for the command name in PATH and finds its version by
+// running versionCommand and matching its output with versionPattern (the
+// first group is the version). When minimum is not empty, older versions
+// fail the check.
+func CheckCommand(name string, versionCommand string, versionPattern string, minimum string, hint string) PreflightCheck {
+	check := PreflightCheck{Name: name, Hint: hint}
+
+	path, err := lookPath(name)
+	if err != nil {
+		check.Problem = "not found in PATH"
+		return check
+	}
+	check.Path = path
+
+	res, err := system_command.Run(versionCommand, ioutil.Discard)
+	if err != nil {
+		check.Problem = "couldn't run \"" + versionCommand + "\": " + err.Error()
+		return check
+	}
+	if match := regexp.MustCompile(versionPattern).FindStringSubmatch(res.CombinedOutput); match != nil {
+		check.Version = match[1]
+	}
+
+	if minimum != "" {
+		if check.Version == "" {
+			check.Problem = "couldn't find the version (" + minimum + " or newer is needed)"
+		} else if !VersionAtLeast(check.Version, minimum) {
+			check.Problem = "version " + minimum + " or newer is needed"
+		}
+	}
+
+	return check
+}
+
+// CheckDocker makes sure the Docker (or Podman) API is reachable.
+func CheckDocker(socket string) PreflightCheck {
+	check := PreflightCheck{Name: "docker", Path: socket, Hint: DOCKER_HINT}
+
+	if err := NewDockerClient(socket).Ping(); err != nil {
+		check.Problem = err.Error()
+	}
+
+	return check
+}
+
+// CheckShell makes sure the shell we run commands with (see
+// system_command.PosixShellCommand) exists and can run commands.
+func CheckShell() PreflightCheck {
+	check := PreflightCheck{Name: "shell", Path: os.Getenv("SHELL"),
+		Hint: "Point SHELL to a POSIX shell (e.g. /bin/sh) or unset it."}
+	if check.Path == "" {
+		check.Path = "/bin/sh"
+		check.Hint = "Install a POSIX shell at /bin/sh or point SHELL to one."
+	}
+
+	if fileInfo, err := os.Stat(check.Path); err != nil || fileInfo.IsDir() || fileInfo.Mode()&0111 == 0 {
+		check.Problem = "not an executable file"
+		return check
+	}
+
+	res, err := system_command.Run("exit 0", ioutil.Discard)
+	if err != nil || !res.Success {
+		check.Problem = "couldn't run commands"
+	}
+
+	return check
+}
+
+// CheckWriteableDirectory checks that we can create files in dir. When dir
+// doesn't exist yet, we check the closest parent directory that exists since
+// that's where dir will be created.
+func CheckWriteableDirectory(name string, dir string) PreflightCheck {
+	check := PreflightCheck{Name: name, Path: dir,
+		Hint: "Make sure the agent's user can write to " + dir + "."}
+
+	existing := dir
+	for {
+		if fileInfo, err := os.Stat(existing); err == nil {
+			if !fileInfo.IsDir() {
+				check.Problem = existing + " is not a directory"
+				return check
+			}
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+
+	file, err := ioutil.TempFile(existing, ".testributor_preflight_")
+	if err != nil {
+		check.Problem = "not writeable"
+		return check
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	return check
+}
+
+// PrintPreflightReport logs one line per check followed by the hints of the
+// failed ones.
+func PrintPreflightReport(checks []PreflightCheck, logger Logger) {
+	report := "Preflight checks:\n"
+	for _, check := range checks {
+		status := "ok"
+		if check.Problem != "" {
+			status = "FAILED"
+		}
+
+		details := []string{}
+		if check.Version != "" {
+			details = append(details, check.Version)
+		}
+		if check.Path != "" {
+			details = append(details, check.Path)
+		}
+		if check.Problem != "" {
+			details = append(details, check.Problem)
+		}
+		report += "  [" + status + "] " + check.Name + ": " + strings.Join(details, ", ") + "\n"
+	}
+
+	for _, check := range checks {
+		if check.Problem != "" {
+			report += "  " + check.Name + ": " + check.Hint + "\n"
+		}
+	}
+
+	logger.Log(report)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckCommand(t *testing.T) {
+	check := CheckCommand("git", "git --version", `git version (\d+(\.\d+)*)`, MIN_GIT_VERSION, GIT_INSTALL_HINT)
+	if check.Problem != "" || check.Path == "" || check.Version == "" {
+		t.Error("It should find git and its version but got: ", check)
+	}
+
+	check = CheckCommand("git", "git --version", `git version (\d+(\.\d+)*)`, "999.0", GIT_INSTALL_HINT)
+	if !strings.Contains(check.Problem, "999.0 or newer is needed") {
+		t.Error("It should fail for old versions but got: ", check.Problem)
+	}
+
+	restore := fakeLookPath()
+	defer restore()
+	check = CheckCommand("ssh", "ssh -V", `OpenSSH_(\d+(\.\d+)*)`, "", SSH_INSTALL_HINT)
+	if check.Problem != "not found in PATH" || check.Hint != SSH_INSTALL_HINT {
+		t.Error("It should fail for missing commands but got: ", check)
+	}
+}
+
+func TestCheckShell(t *testing.T) {
+	shell := os.Getenv("SHELL")
+	defer os.Setenv("SHELL", shell)
+
+	os.Setenv("SHELL", "/bin/sh")
+	if check := CheckShell(); check.Problem != "" {
+		t.Error("It should accept /bin/sh but got: ", check.Problem)
+	}
+
+	os.Setenv("SHELL", "/nonexistent/shell")
+	if check := CheckShell(); check.Problem == "" {
+		t.Error("It should fail when SHELL doesn't exist")
+	}
+}
+
+func TestCheckWriteableDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_preflight")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// Missing directories are checked through their parent
+	if check := CheckWriteableDirectory("project directory", filepath.Join(dir, "a", "b")); check.Problem != "" {
+		t.Error("It should accept directories that can be created but got: ", check.Problem)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Error("It should remove the file it created")
+	}
+
+	file := filepath.Join(dir, "file")
+	ioutil.WriteFile(file, []byte("file"), 0644)
+	if check := CheckWriteableDirectory("project directory", filepath.Join(file, "project")); check.Problem == "" {
+		t.Error("It should fail when a file is in the way")
+	}
+
+	// Permissions don't apply to root
+	if os.Geteuid() != 0 {
+		readOnly := filepath.Join(dir, "read_only")
+		os.Mkdir(readOnly, 0555)
+		if check := CheckWriteableDirectory("project directory", readOnly); check.Problem != "not writeable" {
+			t.Error("It should fail for read only directories but got: ", check.Problem)
+		}
+	}
+}
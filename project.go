@@ -4,27 +4,41 @@ import (
 	"errors"
 	"github.com/mitchellh/go-homedir"
 	"github.com/testributor/agent/system_command"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strings"
+	"time"
 )
 
 const (
 	PRIVATE_KEY_NAME                                   = "testributor_id_rsa"
 	PUBLIC_KEY_NAME                                    = "testributor_id_rsa.pub"
 	SSH_CONFIG_NAME                                    = "testributor_ssh_config"
-	GIT_SSH_FILE                                       = "testributor_git_ssh.sh"
+	SSH_DIRECTORY_PREFIX                               = "testributor_ssh_"
 	TESTRIBUTOR_FUNCTIONS_COMBINED_BUILD_COMMANDS_PATH = "testributor_functions.sh"
 	BUILD_COMMANDS_PATH                                = "testributor_build_commands.sh"
+	DEFAULT_PROJECT_DIRECTORY                          = "~/.testributor"
 )
 
 type Project struct {
-	repositorySshUrl   string
+	repositoryUrl      string
 	files              []map[string]interface{}
 	currentWorkerGroup map[string]string
+	sshKnownHosts      string
 	directory          string
+	sshDirectory       string
+	sshAgent           *SshAgent
+	git                Git
+	gitEnvironment     []string          // Extra environment variables for git commands
+	bashPath           string            // Set by Preflight
+	sshPath            string            // Set by Preflight
+	writtenFiles       map[string]string // The contents of the files we last wrote
+	setupRepositoryUrl string            // The url as sent by Testributor (repositoryUrl might be made absolute)
+	setupDataVersion   string
+	dockerImage        string
+	executor           Executor
+	config             *Config
 }
 
 // This is a custom type based on the type return my APIClient's FetchJobs
@@ -32,12 +46,99 @@ type Project struct {
 // them in a format suitable for TestJob fields.
 type ProjectBuilder map[string]interface{}
 
+// NewProjectBuilder returns a ProjectBuilder for the setup data returned by
+// APIClient.ProjectSetupData.
+func NewProjectBuilder(setupData interface{}) (ProjectBuilder, error) {
+	builder, ok := setupData.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("The setup data is not an object")
+	}
+
+	return ProjectBuilder(builder), nil
+}
+
+// check returns an error when the fields the other methods read are missing
+// or have the wrong type, so a malformed response doesn't make them panic.
+func (builder *ProjectBuilder) check() error {
+	currentProject, ok := (*builder)["current_project"].(map[string]interface{})
+	if !ok {
+		return errors.New("The setup data has no current_project")
+	}
+	if _, ok = currentProject["repository_ssh_url"].(string); !ok {
+		if url, _ := currentProject["repository_url"].(string); url == "" {
+			return errors.New("The setup data has no repository url")
+		}
+	}
+	files, ok := currentProject["files"].([]interface{})
+	if !ok {
+		return errors.New("The setup data has no files")
+	}
+	for _, file := range files {
+		if _, ok = file.(map[string]interface{}); !ok {
+			return errors.New("The setup data has an invalid file")
+		}
+	}
+
+	currentWorkerGroup, ok := (*builder)["current_worker_group"].(map[string]interface{})
+	if !ok {
+		return errors.New("The setup data has no current_worker_group")
+	}
+	for key, value := range currentWorkerGroup {
+		if _, ok = value.(string); !ok {
+			return errors.New("The setup data has an invalid current_worker_group " + key)
+		}
+	}
+
+	return nil
+}
+
 func (builder *ProjectBuilder) repositorySshUrl() string {
 	currentProject := (*builder)["current_project"].(map[string]interface{})
 
 	return currentProject["repository_ssh_url"].(string)
 }
 
+// repositoryUrl returns the url to fetch the project's code from. Projects
+// accessed over HTTPS send it as "repository_url". Older setup data only
+// have "repository_ssh_url" so we fall back to that one.
+func (builder *ProjectBuilder) repositoryUrl() string {
+	currentProject := (*builder)["current_project"].(map[string]interface{})
+
+	if url, ok := currentProject["repository_url"].(string); ok && url != "" {
+		return url
+	}
+
+	return builder.repositorySshUrl()
+}
+
+// sshKnownHosts returns the host keys of self hosted repositories in
+// known_hosts format (if any).
+func (builder *ProjectBuilder) sshKnownHosts() string {
+	currentProject := (*builder)["current_project"].(map[string]interface{})
+
+	knownHosts, _ := currentProject["ssh_known_hosts"].(string)
+
+	return knownHosts
+}
+
+// dockerImage returns the project's docker image as "name:version" (or just
+// "name" when there is no version). It is empty when the project doesn't
+// have an image.
+func (builder *ProjectBuilder) dockerImage() string {
+	currentProject := (*builder)["current_project"].(map[string]interface{})
+
+	dockerImage, ok := currentProject["docker_image"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	name, _ := dockerImage["name"].(string)
+	if version, _ := dockerImage["version"].(string); name != "" && version != "" {
+		return name + ":" + version
+	}
+
+	return name
+}
+
 func (builder *ProjectBuilder) files() []map[string]interface{} {
 	currentProject := (*builder)["current_project"].(map[string]interface{})
 
@@ -62,11 +163,20 @@ func (builder *ProjectBuilder) currentWorkerGroup() map[string]string {
 	return result
 }
 
-func (builder *ProjectBuilder) NewProject() (*Project, error) {
+func (builder *ProjectBuilder) NewProject(config *Config) (*Project, error) {
+	if err := builder.check(); err != nil {
+		return &Project{}, err
+	}
+
 	project := Project{
-		repositorySshUrl:   builder.repositorySshUrl(),
+		config:             config,
+		repositoryUrl:      builder.repositoryUrl(),
 		files:              builder.files(),
 		currentWorkerGroup: builder.currentWorkerGroup(),
+		sshKnownHosts:      builder.sshKnownHosts(),
+		setupRepositoryUrl: builder.repositoryUrl(),
+		setupDataVersion:   SetupDataVersion(map[string]interface{}(*builder)),
+		dockerImage:        builder.dockerImage(),
 	}
 
 	dir, err := project.ProjectDir()
@@ -80,25 +190,33 @@ func (builder *ProjectBuilder) NewProject() (*Project, error) {
 
 // NewProject makes a request to Testributor and fetches the Project's data.
 // It return an initialized Project struct.
-func NewProject(logger Logger) (*Project, error) {
-	client := NewClient(logger)
+func NewProject(config *Config, logger Logger) (*Project, error) {
+	client := NewClient(config, logger)
 	setupData, err := client.ProjectSetupData()
 	if err != nil {
 		return &Project{}, err
 	}
 
-	builder := ProjectBuilder(setupData.(map[string]interface{}))
+	builder, err := NewProjectBuilder(setupData)
+	if err != nil {
+		return &Project{}, err
+	}
 
-	return builder.NewProject()
+	return builder.NewProject(config)
 }
 
-func (project *Project) Init(logger Logger) error {
-	err := project.CreateSshKeys(logger)
-	if err != nil {
-		return err
+// Config returns the config the project was created with (the defaults when
+// there is none).
+func (project *Project) Config() *Config {
+	if project.config == nil {
+		project.config = DefaultConfig()
 	}
 
-	err = project.CheckSshKeyValidity(logger)
+	return project.config
+}
+
+func (project *Project) Init(logger Logger) error {
+	err := project.SetupRepositoryAccess(logger)
 	if err != nil {
 		return err
 	}
@@ -113,7 +231,7 @@ func (project *Project) Init(logger Logger) error {
 		return err
 	}
 
-	err = project.SetupTestEnvironment("", logger)
+	err = project.SetupTestEnvironment("", 0, logger, nil)
 	if err != nil {
 		return err
 	}
@@ -122,7 +240,7 @@ func (project *Project) Init(logger Logger) error {
 }
 
 func (project *Project) CreateSshKeys(logger Logger) error {
-	err := project.EnsureSshDir(logger)
+	err := project.CreateSshDir(logger)
 	if err != nil {
 		return err
 	}
@@ -134,126 +252,178 @@ func (project *Project) CreateSshKeys(logger Logger) error {
 	return nil
 }
 
-func (project *Project) EnsureSshDir(logger Logger) error {
-	sshDir, err := homedir.Expand("~/.ssh")
+// CreateSshDir creates a private (0700) directory for the project's SSH files.
+// Every agent gets its own directory so agents running on the same host for
+// different projects don't overwrite each other's keys. It is removed on exit
+// (see Project.Cleanup).
+func (project *Project) CreateSshDir(logger Logger) error {
+	sshDir, err := ioutil.TempDir("", SSH_DIRECTORY_PREFIX)
 	if err != nil {
 		return err
 	}
-
-	// If not exists or is not directory, create the .ssh directory
-	if fileInfo, err := os.Stat(sshDir); os.IsNotExist(err) || (err == nil && !fileInfo.IsDir()) {
-		logger.Log("Couldn't find " + sshDir + " directory. I will try to create it.")
-		mkDirErr := os.Mkdir(sshDir, os.FileMode(0700))
-		if mkDirErr != nil {
-			return mkDirErr
-		}
-	} else if err == nil {
-		logger.Log(sshDir + " directory already exists.")
-	} else {
+	// TempDir already creates the directory with 0700 but we don't want to
+	// depend on that.
+	if err = os.Chmod(sshDir, os.FileMode(0700)); err != nil {
 		return err
 	}
+	project.sshDirectory = sshDir
+	logger.Log("Created " + sshDir + " directory")
 
 	return nil
 }
 
 func (project *Project) WriteSshFiles(logger Logger) error {
-	KeyFile, err := homedir.Expand("~/.ssh/" + PRIVATE_KEY_NAME)
+	agentMode, err := SshAgentMode(project.Config())
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(KeyFile, []byte(project.currentWorkerGroup["ssh_key_private"]), os.FileMode(0600))
-	if err != nil {
-		return err
-	}
-	logger.Log("Wrote " + KeyFile)
 
-	KeyFile, err = homedir.Expand("~/.ssh/" + PUBLIC_KEY_NAME)
-	if err != nil {
-		return err
+	publicKey := []byte(project.currentWorkerGroup["ssh_key_public"])
+	if agentMode == SSH_AGENT_MODE_NONE {
+		KeyFile := filepath.Join(project.sshDirectory, PRIVATE_KEY_NAME)
+		err = ioutil.WriteFile(KeyFile, []byte(project.currentWorkerGroup["ssh_key_private"]), os.FileMode(0600))
+		if err != nil {
+			return err
+		}
+		logger.Log("Wrote " + KeyFile)
+	} else {
+		err = project.LoadSshAgent(agentMode, logger)
+		if err != nil {
+			return err
+		}
+		// This must match the key in the agent since we use it to select it.
+		publicKey = project.sshAgent.AuthorizedKey()
 	}
-	err = ioutil.WriteFile(KeyFile, []byte(project.currentWorkerGroup["ssh_key_public"]), os.FileMode(0644))
+
+	KeyFile := filepath.Join(project.sshDirectory, PUBLIC_KEY_NAME)
+	err = ioutil.WriteFile(KeyFile, publicKey, os.FileMode(0644))
 	if err != nil {
 		return err
 	}
 	logger.Log("Wrote " + KeyFile)
 
-	KeyFile, err = homedir.Expand("~/.ssh/" + SSH_CONFIG_NAME)
-	if err != nil {
-		return err
-	}
-	err = ioutil.WriteFile(KeyFile, []byte("Host *\n    StrictHostKeyChecking no\n"), os.FileMode(0644))
+	knownHostsFile := filepath.Join(project.sshDirectory, KNOWN_HOSTS_NAME)
+	err = ioutil.WriteFile(knownHostsFile, []byte(project.KnownHosts()), os.FileMode(0644))
 	if err != nil {
 		return err
 	}
-	logger.Log("Wrote " + KeyFile)
+	logger.Log("Wrote " + knownHostsFile)
 
-	KeyFile, err = homedir.Expand("~/.ssh/" + GIT_SSH_FILE)
+	hostKeyChecking, err := HostKeyChecking(project.Config())
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(KeyFile, []byte(project.SshCommand()+" \"$@\""), os.FileMode(0744))
+	if hostKeyChecking != HOST_KEY_CHECKING_STRICT {
+		logger.Warn("Unknown hosts will be trusted (StrictHostKeyChecking " + hostKeyChecking + ")")
+	}
+
+	KeyFile = filepath.Join(project.sshDirectory, SSH_CONFIG_NAME)
+	err = ioutil.WriteFile(KeyFile, []byte(SshConfig(hostKeyChecking, knownHostsFile)), os.FileMode(0644))
 	if err != nil {
 		return err
 	}
 	logger.Log("Wrote " + KeyFile)
 
-	// https://git-scm.com/book/tr/v2/Git-Internals-Environment-Variables#Miscellaneous
-	err = os.Setenv("GIT_SSH", KeyFile)
-	if err != nil {
-		return err
+	// Only the git commands we run get this, not the whole process (and the
+	// test jobs which inherit its environment).
+	// https://git-scm.com/docs/git#Documentation/git.txt-codeGITSSHCOMMANDcode
+	project.gitEnvironment = []string{"GIT_SSH_COMMAND=" + project.SshCommand()}
+	if project.sshAgent != nil {
+		project.gitEnvironment = append(project.gitEnvironment, "SSH_AUTH_SOCK="+project.sshAgent.socket)
 	}
 
 	return nil
 }
 
-// http://linuxcommando.blogspot.gr/2008/10/how-to-disable-ssh-host-key-checking.html
+// LoadSshAgent makes the private key available through an ssh-agent (see
+// ssh_agent.go) instead of writing it to disk.
+func (project *Project) LoadSshAgent(agentMode string, logger Logger) error {
+	privateKey := []byte(project.currentWorkerGroup["ssh_key_private"])
+
+	var err error
+	if agentMode == SSH_AGENT_MODE_EXTERNAL {
+		project.sshAgent, err = ConnectSshAgent(os.Getenv("SSH_AUTH_SOCK"), privateKey, logger)
+	} else {
+		socket := filepath.Join(project.sshDirectory, SSH_AGENT_SOCKET_NAME)
+		project.sshAgent, err = StartSshAgent(socket, privateKey, logger)
+	}
+
+	return err
+}
+
 // Something like the following should work on Linux but NUL does not behave
 // the same on Windows:
 //   ssh -i /home/dimitris/.ssh/testributor_id_rsa -F /dev/null -o UserKnownHostsFile=/dev/null  -o StrictHostKeyChecking=no -T git@github.com
-// For this reason we create our own config file and skip the UserKnownHostsFile
-// option.
+// For this reason we create our own config file which points ssh to our own
+// known_hosts file (see known_hosts.go) instead of the user's one.
+//
+// When the key is served by an ssh-agent we pass the public key instead which
+// makes ssh use the matching key from the agent and ignore any other keys.
 func (project *Project) SshCommand() string {
-	// Ignore the error, if it was to fail, it would have already done so on a
-	// previous use.
 	// TODO: This does not work on Windows.
-	privateKey, _ := homedir.Expand("~/.ssh/" + PRIVATE_KEY_NAME)
-	configFile, _ := homedir.Expand("~/.ssh/" + SSH_CONFIG_NAME)
+	configFile := filepath.Join(project.sshDirectory, SSH_CONFIG_NAME)
+	if project.sshAgent != nil {
+		publicKey := filepath.Join(project.sshDirectory, PUBLIC_KEY_NAME)
+		return project.SshPath() + " -i " + publicKey + " -o IdentitiesOnly=yes -F " + configFile
+	}
+	privateKey := filepath.Join(project.sshDirectory, PRIVATE_KEY_NAME)
 
-	// TODO: Are we sure these is an "ssh" command available?
-	// We are sure there is a "git" command but does this mean we have ssh?
 	// On windows we might need to "construct" the ssh command using an absolute
 	// path (it should live somewhere inside Portable git directory).
-	return "ssh -i " + privateKey + " -F " + configFile
+	return project.SshPath() + " -i " + privateKey + " -F " + configFile
 }
 
-func (project *Project) CheckSshKeyValidity(logger Logger) error {
-	logger.Log("Checking the validity of the SSH keys")
-	remoteHost := strings.Split(project.repositorySshUrl, ":")[0]
+// SshPath returns the ssh command found by Preflight.
+func (project *Project) SshPath() string {
+	if project.sshPath == "" {
+		return "ssh"
+	}
+
+	return project.sshPath
+}
 
-	result, err := system_command.Run(project.SshCommand()+" -T "+remoteHost, logger)
+// BashPath returns the bash command found by Preflight.
+func (project *Project) BashPath() string {
+	if project.bashPath == "" {
+		return "bash"
+	}
+
+	return project.bashPath
+}
+
+// CheckRepositoryAccess lists the refs of the project's repository to make
+// sure we can fetch it with our keys (or token). It returns a
+// *RepositoryAccessError telling whether the host was unreachable, access
+// was denied or the repository was not found.
+func (project *Project) CheckRepositoryAccess(logger Logger) error {
+	repositoryUrl, err := ParseRepositoryUrl(project.repositoryUrl)
 	if err != nil {
 		return err
 	}
+	logger.Log("Checking access to the repository on " + repositoryUrl.HostWithPort())
 
-	if result.ExitCode == 255 {
-		return errors.New("The SSH keys don't seem to be valid.")
+	_, err = project.Git().LsRemote(project.repositoryUrl)
+	if err != nil {
+		return &RepositoryAccessError{
+			Kind:   ClassifyRepositoryAccessError(err.Error()),
+			Url:    repositoryUrl,
+			Output: err.Error(),
+		}
 	}
 
-	logger.Log("The SSH keys seem to be valid.")
+	logger.Log("The repository is accessible.")
 	return nil
 }
 
+// ProjectDir returns the directory set with the project_directory setting
+// (a leading ~ is the user's home directory).
 func (project *Project) ProjectDir() (string, error) {
-	var directory string
-	if directory = os.Getenv("TESTRIBUTOR_PROJECT_DIRECTORY"); directory == "" {
-		dir, err := homedir.Expand("~/.testributor")
-		directory = dir
-		if err != nil {
-			return "", err
-		}
+	directory := project.Config().ProjectDirectory
+	if directory == "" {
+		directory = DEFAULT_PROJECT_DIRECTORY
 	}
 
-	return directory, nil
+	return homedir.Expand(directory)
 }
 
 func (project *Project) CreateProjectDir(logger Logger) error {
@@ -275,100 +445,96 @@ func (project *Project) CreateProjectDir(logger Logger) error {
 	return nil
 }
 
-// CommitExists returns true when the commit SHA is known to git, false otherwise.
-func (project *Project) CommitExists(commitSha string) (bool, error) {
-	err := os.Chdir(project.directory)
-	if err != nil {
-		return false, err
-	}
+// RunGit runs a git command with the environment needed to access the
+// project's repository (see Project.gitEnvironment).
+func (project *Project) RunGit(command string, logger io.Writer) (system_command.CommandResult, error) {
+	return system_command.RunWithEnv(command, project.gitEnvironment, logger)
+}
 
-	res, err := system_command.Run("git cat-file -t "+commitSha, ioutil.Discard)
-	if err != nil {
-		return false, err
+// Cleanup stops the ssh-agent (if any) and removes the project's SSH files.
+// It should be called before the agent exits.
+func (project *Project) Cleanup(logger Logger) {
+	if project.executor != nil {
+		project.executor.Cleanup(logger)
 	}
 
-	return strings.TrimSpace(res.Output) == "commit", nil
-}
-
-func (project *Project) FetchProjectRepo(logger Logger) error {
-	logger.Log("Fetching repo")
+	if project.sshAgent != nil {
+		project.sshAgent.Stop(logger)
+		project.sshAgent = nil
+	}
 
-	err := os.Chdir(project.directory)
-	if err != nil {
-		return err
+	if project.sshDirectory == "" {
+		return
 	}
 
-	_, err = system_command.Run("git init", logger)
-	if err != nil {
-		return err
+	if err := os.RemoveAll(project.sshDirectory); err != nil {
+		logger.Warn("Couldn't remove " + project.sshDirectory + ": " + err.Error())
+		return
 	}
+	logger.Log("Removed " + project.sshDirectory)
+	project.sshDirectory = ""
+}
 
-	// Check if origin exists and remove in order to change it if
-	// url changed in testributor project/settings page
-	res, err := system_command.Run("git remote show", ioutil.Discard)
+// CommitExists returns true when the commit SHA is known to git, false otherwise.
+func (project *Project) CommitExists(commitSha string) (bool, error) {
+	objectType, err := project.Git().CatFile(commitSha)
 	if err != nil {
-		return err
+		return false, err
 	}
-	for _, remote := range strings.Split(res.Output, "\n") {
-		matched, err := regexp.MatchString("origin", remote)
-		if err != nil {
-			return err
-		}
 
-		if matched {
-			_, err = system_command.Run("git remote rm origin", ioutil.Discard)
-			if err != nil {
-				return err
-			}
+	return objectType == "commit", nil
+}
 
-			break
-		}
-	}
+func (project *Project) FetchProjectRepo(logger Logger) error {
+	logger.Log("Fetching repo")
 
-	logger.Log("Adding " + project.repositorySshUrl + " as origin")
-	res, err = system_command.Run("git remote add origin "+project.repositorySshUrl, logger)
+	logger.Log("Adding " + project.repositoryUrl + " as origin")
+	err := project.Git().Init(project.repositoryUrl)
 	if err != nil {
 		return err
 	}
 
 	logger.Log("Fetching origin")
-	res, err = system_command.Run("git fetch origin", logger)
+	fetchStartedAt := time.Now()
+	err = project.Git().Fetch()
+	metricGitDuration.Observe(time.Since(fetchStartedAt).Seconds(), "fetch")
 	if err != nil {
 		return err
 	}
 
 	// An "initial" commit to checkout. This creates the local HEAD so we can
 	// hard reset to something in SetupTestEnvironment.
-	res, err = system_command.Run("git ls-remote --heads -q", ioutil.Discard)
+	remoteHeads, err := project.Git().LsRemote(project.repositoryUrl)
 	if err != nil {
 		return err
 	}
-	remoteHeads := strings.Split(res.Output, "\n")
-	commitToCheckout := ""
-	for _, head := range remoteHeads {
-		if fields := strings.Fields(head); len(fields) > 1 && fields[1] == "refs/heads/master" {
-			commitToCheckout = fields[0]
-			logger.Log("Found a master branch.")
-		}
+
+	// A bare repository might not have any branches yet (nothing pushed).
+	// There is nothing to checkout in this case. We will fetch again when
+	// we get a job for a commit we don't know about.
+	if len(remoteHeads) == 0 {
+		logger.Log("The repository doesn't have any branches yet.")
+		return nil
 	}
 
-	// No master found. Use a random commit.
-	if commitToCheckout == "" {
-		commitToCheckout = strings.Fields(remoteHeads[0])[0]
+	commitToCheckout, found := remoteHeads["refs/heads/master"]
+	if found {
+		logger.Log("Found a master branch.")
+	} else {
+		// No master found. Use a random commit.
+		for _, commitToCheckout = range remoteHeads {
+			break
+		}
 		logger.Log("Didn't find a master branch.")
 	}
 
 	logger.Log("Checking out " + commitToCheckout + " commit.")
-	_, err = system_command.Run("git reset --hard "+commitToCheckout, logger)
-	if err != nil {
-		return err
-	}
 
-	return nil
+	return project.checkout(commitToCheckout)
 }
 
 // TestributorYml returns a TestributorYml value created by the testributor.yml
-// in the project's repo. This file is the only file that does not get overwritten
+// in the project's repo. This file does not get overwritten by default
 // when we write the files specified on Testributor and there is a good reason
 // for that. A user might want to use a different testributor.yml on some branches.
 // For example to skip some test jobs or to use different versions (e.g. Ruby
@@ -389,14 +555,35 @@ func (project *Project) TestributorYml() (TestributorYml, error) {
 
 // WriteProjectFiles creates the files created on Testributor. If they already
 // exist, they are overwritten except for testributor.yml. Read the comments
-// on Project.TestributorYml() method to see why.
+// on Project.TestributorYml() method to see why. Other files can be kept,
+// merged or appended too (see FileOverride).
 //
 // This means that in order to be able to update this file after we have already
 // written it, we need to start from a clean repo state before this method
 // is called (running `git clean -df` would do the trick: https://git-scm.com/docs/git-clean/2.2.0)
-func (project *Project) WriteProjectFiles(logger Logger) error {
+//
+// Files are only written inside the project's directory (see ProjectFilePath).
+// Files marked as templates are expanded with variables (see ExpandTemplate).
+func (project *Project) WriteProjectFiles(variables map[string]string, logger Logger) error {
+	overrides, err := ReadFileOverrides(project.directory)
+	if err != nil {
+		return err
+	}
+	writtenFiles := make(map[string]string)
+
 	for _, file := range project.files {
-		path := file["path"].(string)
+		path, err := project.ProjectFilePath(file["path"].(string))
+		if err != nil {
+			return err
+		}
+		mode, err := ProjectFileMode(file)
+		if err != nil {
+			return err
+		}
+		contents, err := ProjectFileContents(file, variables)
+		if err != nil {
+			return err
+		}
 
 		dir := filepath.Dir(path)
 		// Is directory does not exist or is a file (not a directory), create the directory
@@ -407,55 +594,72 @@ func (project *Project) WriteProjectFiles(logger Logger) error {
 			}
 		}
 
-		if path == "testributor.yml" {
-			// Don't overwrite testributor.yml file
-			if _, err := os.Stat(path); os.IsNotExist(err) {
-				err := ioutil.WriteFile(path, []byte(file["contents"].(string)), os.FileMode(0644))
-				if err != nil {
-					return err
-				}
-			}
-		} else {
-			err := ioutil.WriteFile(path, []byte(file["contents"].(string)), os.FileMode(0644))
-			if err != nil {
-				return err
-			}
+		policy, err := FileOverride(file, overrides)
+		if err != nil {
+			return err
+		}
+		// nil when the repository doesn't have the file
+		repositoryContents, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			repositoryContents = nil
+		} else if err != nil {
+			return err
+		}
+		// Ignored files survive `git clean -df`. If this is still the file we
+		// wrote last time, the repository doesn't have its own version.
+		if previous, ok := project.writtenFiles[path]; ok && previous == string(repositoryContents) {
+			repositoryContents = nil
+		}
+		contents, write, err := ApplyFileOverride(policy, repositoryContents, contents)
+		if err != nil {
+			return errors.New(file["path"].(string) + ": " + err.Error())
+		}
+		if !write {
+			logger.Log("Keeping the repository's version of " + file["path"].(string))
+			continue
+		}
+
+		err = ioutil.WriteFile(path, []byte(contents), mode)
+		if err != nil {
+			return err
 		}
+		// WriteFile only sets the mode of new files
+		err = os.Chmod(path, mode)
+		if err != nil {
+			return err
+		}
+		writtenFiles[path] = contents
 	}
+	project.writtenFiles = writtenFiles
+
 	return nil
 }
 
 // CurrentCommitSha return the current checked out commit in the project's
 // directory.
 func (project *Project) CurrentCommitSha() (string, error) {
-	err := os.Chdir(project.directory)
-	if err != nil {
-		return "", err
-	}
-	res, err := system_command.Run("git rev-parse HEAD", ioutil.Discard)
-	if err != nil {
-		return "", err
-	}
-
-	return strings.TrimSpace(res.Output), nil
+	return project.Git().RevParse("HEAD")
 }
 
 func (project *Project) CheckoutCommit(commitSha string) error {
-	err := os.Chdir(project.directory)
-	if err != nil {
-		return err
-	}
-
+	// Nothing to reset to when nothing has been checked out yet (e.g. the
+	// repository didn't have any branches when we fetched it).
 	if commitSha == "" {
-		_, err = system_command.Run("git reset --hard", ioutil.Discard)
-	} else {
-		_, err = system_command.Run("git reset --hard "+commitSha+" --", ioutil.Discard)
-	}
-	if err != nil {
-		return err
+		if _, err := project.CurrentCommitSha(); err != nil {
+			return nil
+		}
 	}
 
-	return nil
+	return project.checkout(commitSha)
+}
+
+// checkout checks out the commit and records how long it took.
+func (project *Project) checkout(commitSha string) error {
+	checkoutStartedAt := time.Now()
+	err := project.Git().Checkout(commitSha)
+	metricGitDuration.Observe(time.Since(checkoutStartedAt).Seconds(), "checkout")
+
+	return err
 }
 
 // PrepareBashFunctionsAndVariables creates a bash script which is the user's
@@ -490,8 +694,14 @@ func (project *Project) PrepareBashFunctionsAndVariables(buildCommandVariables m
 }
 
 // SetupTestEnvironment checks out the specified commit, creates any overriden
-// files
-func (project *Project) SetupTestEnvironment(commitSha string, logger Logger) error {
+// files. It is traced as a child of parent (if any).
+func (project *Project) SetupTestEnvironment(commitSha string, testRunId int, logger Logger, parent *Span) error {
+	return trace("Project.SetupTestEnvironment", parent, func(span *Span) error {
+		return project.setupTestEnvironment(commitSha, testRunId, logger, span)
+	})
+}
+
+func (project *Project) setupTestEnvironment(commitSha string, testRunId int, logger Logger, span *Span) error {
 	err := os.Chdir(project.directory)
 	if err != nil {
 		return err
@@ -504,7 +714,10 @@ func (project *Project) SetupTestEnvironment(commitSha string, logger Logger) er
 		buildCommandVariables["WORKER_INITIALIZING"] = "true"
 	} else {
 		if exists, err := project.CommitExists(commitSha); err != nil || !exists {
-			if err = project.FetchProjectRepo(logger); err != nil {
+			err = trace("git.fetch", span, func(*Span) error {
+				return project.FetchProjectRepo(logger)
+			})
+			if err != nil {
 				return err
 			}
 		}
@@ -517,18 +730,32 @@ func (project *Project) SetupTestEnvironment(commitSha string, logger Logger) er
 		buildCommandVariables["PREVIOUS_COMMIT_HASH"] = currentCommitSha[:5]
 		buildCommandVariables["CURRENT_COMMIT_HASH"] = commitSha[:5]
 	}
-	err = project.CheckoutCommit(commitSha)
+	err = trace("git.checkout", span, func(*Span) error {
+		return project.CheckoutCommit(commitSha)
+	})
 	if err != nil {
 		return err
 	}
 
 	// Cleanup any artifacts
-	_, err = system_command.Run("git clean -df", ioutil.Discard)
+	err = trace("git.clean", span, func(*Span) error {
+		return project.Git().Clean()
+	})
+	if err != nil {
+		return err
+	}
+
+	// commitSha is empty when resetting to the default branch
+	currentCommitSha, err := project.CurrentCommitSha()
+	if err != nil {
+		currentCommitSha = ""
+	}
+	err = project.WriteProjectFiles(TemplateVariables(project.Config(), testRunId, currentCommitSha), logger)
 	if err != nil {
 		return err
 	}
 
-	err = project.WriteProjectFiles(logger)
+	err = project.Executor().Prepare(logger)
 	if err != nil {
 		return err
 	}
@@ -542,8 +769,20 @@ func (project *Project) SetupTestEnvironment(commitSha string, logger Logger) er
 	if err != nil {
 		return err
 	}
+	// The build commands don't get the git environment. It carries the
+	// repository's credentials (see Project.gitEnvironment).
 	// TODO: This is Linux specific. Fix it as soon as we implement pipelining.
-	_, err = system_command.Run("/bin/bash "+TESTRIBUTOR_FUNCTIONS_COMBINED_BUILD_COMMANDS_PATH, logger)
+	bash := project.BashPath()
+	if _, ok := project.Executor().(*LocalExecutor); !ok {
+		// The path found by Preflight is the path on this machine
+		bash = "bash"
+	}
+	err = trace("build_commands", span, func(buildSpan *Span) error {
+		res, err := project.RunCommand(bash+" "+TESTRIBUTOR_FUNCTIONS_COMBINED_BUILD_COMMANDS_PATH,
+			nil, logger)
+		buildSpan.SetAttribute("testributor.build_commands.success", res.Success)
+		return err
+	})
 
 	return nil
 }
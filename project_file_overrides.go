@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// The file (in the repository) where a branch can set the override policy
+	// of the files created on Testributor. It is a YAML hash of paths to
+	// policies, e.g. "config/database.yml: keep".
+	FILE_OVERRIDES_PATH = ".testributor/overrides"
+
+	// The file created on Testributor replaces the one in the repository
+	FILE_OVERRIDE_OVERWRITE = "overwrite"
+	// The file in the repository (if there is one) is used
+	FILE_OVERRIDE_KEEP = "keep"
+	// Both files are merged as YAML hashes. The values in the repository win.
+	FILE_OVERRIDE_MERGE_YAML = "merge_yaml"
+	// The file created on Testributor is appended to the one in the repository
+	FILE_OVERRIDE_APPEND = "append"
+)
+
+var FILE_OVERRIDE_POLICIES = []string{
+	FILE_OVERRIDE_OVERWRITE, FILE_OVERRIDE_KEEP, FILE_OVERRIDE_MERGE_YAML, FILE_OVERRIDE_APPEND,
+}
+
+func validFileOverride(policy string) bool {
+	for _, p := range FILE_OVERRIDE_POLICIES {
+		if p == policy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReadFileOverrides reads the FILE_OVERRIDES_PATH file of the checked out
+// commit. It returns an empty map when there is no such file.
+func ReadFileOverrides(directory string) (map[string]string, error) {
+	overrides := make(map[string]string)
+
+	contents, err := ioutil.ReadFile(filepath.Join(directory, FILE_OVERRIDES_PATH))
+	if os.IsNotExist(err) {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed map[string]string
+	if err = yaml.Unmarshal(contents, &parsed); err != nil {
+		return nil, errors.New("Invalid " + FILE_OVERRIDES_PATH + ": " + err.Error())
+	}
+	for path, policy := range parsed {
+		if !validFileOverride(policy) {
+			return nil, errors.New("Invalid policy " + policy + " for " + path + " in " + FILE_OVERRIDES_PATH +
+				". Use one of: " + strings.Join(FILE_OVERRIDE_POLICIES, ", ") + ".")
+		}
+		overrides[filepath.Clean(path)] = policy
+	}
+
+	return overrides, nil
+}
+
+// FileOverride returns the override policy of a file created on Testributor.
+// The repository's overrides file comes first so that a branch can carry its
+// own version of a file, then the file's "override" in the setup data.
+// testributor.yml is kept by default (see Project.TestributorYml()), all other
+// files are overwritten.
+func FileOverride(file map[string]interface{}, overrides map[string]string) (string, error) {
+	path := filepath.Clean(file["path"].(string))
+
+	if policy, ok := overrides[path]; ok {
+		return policy, nil
+	}
+
+	if policy, _ := file["override"].(string); policy != "" {
+		if !validFileOverride(policy) {
+			return "", errors.New("Invalid override policy " + policy + " for " + path +
+				". Use one of: " + strings.Join(FILE_OVERRIDE_POLICIES, ", ") + ".")
+		}
+		return policy, nil
+	}
+
+	if path == "testributor.yml" {
+		return FILE_OVERRIDE_KEEP, nil
+	}
+
+	return FILE_OVERRIDE_OVERWRITE, nil
+}
+
+// ApplyFileOverride returns the contents to write given the policy, the
+// contents of the file in the repository (nil when there isn't one) and the
+// contents created on Testributor. It returns false when the file in the
+// repository should be left alone.
+func ApplyFileOverride(policy string, repositoryContents []byte, contents string) (string, bool, error) {
+	if repositoryContents == nil {
+		return contents, true, nil
+	}
+
+	switch policy {
+	case FILE_OVERRIDE_KEEP:
+		return "", false, nil
+	case FILE_OVERRIDE_APPEND:
+		existing := string(repositoryContents)
+		if existing != "" && !strings.HasSuffix(existing, "\n") {
+			existing += "\n"
+		}
+		return existing + contents, true, nil
+	case FILE_OVERRIDE_MERGE_YAML:
+		merged, err := MergeYaml(contents, string(repositoryContents))
+		return merged, err == nil, err
+	default:
+		return contents, true, nil
+	}
+}
+
+// MergeYaml merges the YAML hash override into base (recursively) and
+// returns the result as YAML.
+func MergeYaml(base string, override string) (string, error) {
+	var baseValue, overrideValue map[interface{}]interface{}
+	if err := yaml.Unmarshal([]byte(base), &baseValue); err != nil {
+		return "", errors.New("Couldn't merge YAML: " + err.Error())
+	}
+	if err := yaml.Unmarshal([]byte(override), &overrideValue); err != nil {
+		return "", errors.New("Couldn't merge YAML: " + err.Error())
+	}
+
+	merged, err := yaml.Marshal(mergeYamlMaps(baseValue, overrideValue))
+	if err != nil {
+		return "", err
+	}
+
+	return string(merged), nil
+}
+
+func mergeYamlMaps(base map[interface{}]interface{}, override map[interface{}]interface{}) map[interface{}]interface{} {
+	result := make(map[interface{}]interface{})
+	for key, value := range base {
+		result[key] = value
+	}
+
+	for key, value := range override {
+		baseMap, baseIsMap := result[key].(map[interface{}]interface{})
+		overrideMap, overrideIsMap := value.(map[interface{}]interface{})
+		if baseIsMap && overrideIsMap {
+			result[key] = mergeYamlMaps(baseMap, overrideMap)
+		} else {
+			result[key] = value
+		}
+	}
+
+	return result
+}
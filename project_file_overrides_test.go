@@ -0,0 +1,137 @@
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileOverride(t *testing.T) {
+	overrides := map[string]string{"config/database.yml": FILE_OVERRIDE_KEEP}
+
+	cases := []struct {
+		file     map[string]interface{}
+		expected string
+	}{
+		{map[string]interface{}{"path": "config/redis.yml"}, FILE_OVERRIDE_OVERWRITE},
+		{map[string]interface{}{"path": "testributor.yml"}, FILE_OVERRIDE_KEEP},
+		{map[string]interface{}{"path": "testributor.yml", "override": "overwrite"}, FILE_OVERRIDE_OVERWRITE},
+		{map[string]interface{}{"path": "build.sh", "override": "append"}, FILE_OVERRIDE_APPEND},
+		// The repository's overrides file wins
+		{map[string]interface{}{"path": "./config/database.yml", "override": "overwrite"}, FILE_OVERRIDE_KEEP},
+	}
+	for _, c := range cases {
+		if policy, err := FileOverride(c.file, overrides); err != nil || policy != c.expected {
+			t.Error("Expected ", c.expected, " for ", c.file, " but got ", policy, err)
+		}
+	}
+
+	if _, err := FileOverride(map[string]interface{}{"path": "a", "override": "replace"}, overrides); err == nil {
+		t.Error("It should return an error for unknown policies")
+	}
+}
+
+func TestReadFileOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_overrides")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if overrides, err := ReadFileOverrides(dir); err != nil || len(overrides) != 0 {
+		t.Error("It should return no overrides without a file but got: ", overrides, err)
+	}
+
+	os.Mkdir(filepath.Join(dir, ".testributor"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, FILE_OVERRIDES_PATH),
+		[]byte("config/database.yml: keep\n./build.sh: append\n"), 0644)
+	expected := map[string]string{"config/database.yml": "keep", "build.sh": "append"}
+	if overrides, err := ReadFileOverrides(dir); err != nil || !reflect.DeepEqual(overrides, expected) {
+		t.Error("Expected ", expected, " but got ", overrides, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, FILE_OVERRIDES_PATH), []byte("config/database.yml: ignore\n"), 0644)
+	if _, err := ReadFileOverrides(dir); err == nil {
+		t.Error("It should return an error for unknown policies")
+	}
+}
+
+func TestApplyFileOverride(t *testing.T) {
+	for _, policy := range FILE_OVERRIDE_POLICIES {
+		if contents, write, err := ApplyFileOverride(policy, nil, "new"); err != nil || !write || contents != "new" {
+			t.Error(policy, " should write the file when the repository doesn't have it")
+		}
+	}
+
+	if contents, write, _ := ApplyFileOverride(FILE_OVERRIDE_OVERWRITE, []byte("old"), "new"); !write || contents != "new" {
+		t.Error("overwrite should replace the file but got: ", contents)
+	}
+	if _, write, _ := ApplyFileOverride(FILE_OVERRIDE_KEEP, []byte("old"), "new"); write {
+		t.Error("keep should not write the file")
+	}
+	if contents, _, _ := ApplyFileOverride(FILE_OVERRIDE_APPEND, []byte("old"), "new\n"); contents != "old\nnew\n" {
+		t.Error("append should append the contents but got: ", contents)
+	}
+
+	contents, write, err := ApplyFileOverride(FILE_OVERRIDE_MERGE_YAML,
+		[]byte("test:\n  database: branch_test\n"),
+		"test:\n  adapter: postgresql\n  database: katana_test\nredis: redis://redis\n")
+	var merged map[string]interface{}
+	yaml.Unmarshal([]byte(contents), &merged)
+	expected := map[string]interface{}{
+		"test":  map[interface{}]interface{}{"adapter": "postgresql", "database": "branch_test"},
+		"redis": "redis://redis",
+	}
+	if err != nil || !write || !reflect.DeepEqual(merged, expected) {
+		t.Error("merge_yaml should merge the files keeping the repository's values but got: ", contents, err)
+	}
+
+	if _, _, err = ApplyFileOverride(FILE_OVERRIDE_MERGE_YAML, []byte("- a list"), "a: b"); err == nil {
+		t.Error("merge_yaml should return an error when the files are not hashes")
+	}
+}
+
+func TestWriteProjectFilesOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_overrides")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+
+	project := Project{directory: dir, files: []map[string]interface{}{
+		{"path": "build.sh", "contents": "echo server\n", "override": "append"},
+		{"path": "config/database.yml", "contents": "server"},
+	}}
+	os.MkdirAll(filepath.Join(dir, ".testributor"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, FILE_OVERRIDES_PATH), []byte("config/database.yml: keep\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte("echo branch\n"), 0644)
+
+	if err = project.WriteProjectFiles(nil, logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "build.sh")); string(contents) != "echo branch\necho server\n" {
+		t.Error("It should append to the repository's file but got: ", string(contents))
+	}
+	// The repository doesn't have the file so it should be written
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "config", "database.yml")); string(contents) != "server" {
+		t.Error("It should write kept files missing from the repository but got: ", string(contents))
+	}
+
+	// Our files survive when they are ignored by git. They should not be
+	// treated as the repository's files.
+	project.files[1]["contents"] = "server v2"
+	ioutil.WriteFile(filepath.Join(dir, "build.sh"), []byte("echo branch\n"), 0644)
+	if err = project.WriteProjectFiles(nil, logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "config", "database.yml")); string(contents) != "server v2" {
+		t.Error("It should replace the files it wrote but got: ", string(contents))
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "build.sh")); string(contents) != "echo branch\necho server\n" {
+		t.Error("It should append once but got: ", string(contents))
+	}
+}
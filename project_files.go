@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_PROJECT_FILE_MODE = os.FileMode(0644)
+const EXECUTABLE_PROJECT_FILE_MODE = os.FileMode(0755)
+
+// ProjectFilePath returns the absolute path of a file sent with the project's
+// setup data. Paths are relative to the project's directory and they are not
+// allowed to point outside it, neither directly (absolute paths, "..") nor
+// through symlinks (e.g. a symlink committed in the repository).
+func (project *Project) ProjectFilePath(path string) (string, error) {
+	if path == "" {
+		return "", errors.New("A project file has an empty path.")
+	}
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") {
+		return "", errors.New("Refusing to write " + path + ": absolute paths are not allowed.")
+	}
+
+	cleanPath := filepath.Clean(path)
+	if cleanPath == "." || cleanPath == ".." || strings.HasPrefix(cleanPath, ".."+string(filepath.Separator)) {
+		return "", errors.New("Refusing to write " + path + ": it is outside the project directory.")
+	}
+
+	directory, err := filepath.Abs(project.directory)
+	if err != nil {
+		return "", err
+	}
+	directory, err = filepath.EvalSymlinks(directory)
+	if err != nil {
+		return "", err
+	}
+	fullPath := filepath.Join(directory, cleanPath)
+
+	// Resolve the symlinks of the part of the path that exists. The rest will
+	// be created by us so it can't contain symlinks.
+	existing, missing := fullPath, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+		existing = filepath.Dir(existing)
+	}
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		// e.g. a dangling symlink
+		return "", errors.New("Refusing to write " + path + ": " + err.Error())
+	}
+	resolved = filepath.Join(resolved, missing)
+
+	if resolved != directory && !strings.HasPrefix(resolved, directory+string(filepath.Separator)) {
+		return "", errors.New("Refusing to write " + path + ": it is outside the project directory.")
+	}
+
+	return resolved, nil
+}
+
+// ProjectFileMode returns the permissions of a file sent with the project's
+// setup data. Files can have a "mode" (an octal string like "0755") or be
+// marked as "executable". All other files get DEFAULT_PROJECT_FILE_MODE.
+func ProjectFileMode(file map[string]interface{}) (os.FileMode, error) {
+	if mode, ok := file["mode"].(string); ok && mode != "" {
+		value, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || value > 0777 {
+			return 0, errors.New("Invalid mode " + mode + " for " + file["path"].(string) +
+				". Use an octal number like \"0755\".")
+		}
+
+		return os.FileMode(value), nil
+	}
+
+	if executable, _ := file["executable"].(bool); executable {
+		return EXECUTABLE_PROJECT_FILE_MODE, nil
+	}
+
+	return DEFAULT_PROJECT_FILE_MODE, nil
+}
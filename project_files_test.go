@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProjectFilePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_project_files")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	project := Project{directory: filepath.Join(dir, "project")}
+	os.MkdirAll(filepath.Join(project.directory, "config"), 0755)
+	os.Mkdir(filepath.Join(dir, "outside"), 0755)
+	os.Symlink(filepath.Join(dir, "outside"), filepath.Join(project.directory, "escape"))
+	os.Symlink("config", filepath.Join(project.directory, "settings"))
+	os.Symlink("/etc/passwd", filepath.Join(project.directory, "config", "database.yml"))
+
+	allowed := map[string]string{
+		"config/database.local.yml": "config/database.local.yml",
+		"./testributor.yml":         "testributor.yml",
+		"new/dir/file.sh":           "new/dir/file.sh",
+		"config/../other.yml":       "other.yml",
+		// Symlinks inside the project directory are fine
+		"settings/app.yml": "config/app.yml",
+	}
+	for path, expected := range allowed {
+		result, err := project.ProjectFilePath(path)
+		if err != nil || result != filepath.Join(project.directory, expected) {
+			t.Error("Expected ", expected, " for ", path, " but got ", result, err)
+		}
+	}
+
+	rejected := []string{
+		"",
+		".",
+		"/etc/cron.d/x",
+		"../outside/file",
+		"config/../../outside/file",
+		"escape/file",
+		"config/database.yml",
+	}
+	for _, path := range rejected {
+		if result, err := project.ProjectFilePath(path); err == nil {
+			t.Error("It should reject ", path, " but got ", result)
+		}
+	}
+}
+
+func TestProjectFileMode(t *testing.T) {
+	cases := []struct {
+		file     map[string]interface{}
+		expected os.FileMode
+	}{
+		{map[string]interface{}{"path": "a"}, 0644},
+		{map[string]interface{}{"path": "a", "executable": true}, 0755},
+		{map[string]interface{}{"path": "a", "executable": false}, 0644},
+		{map[string]interface{}{"path": "a", "mode": "0600"}, 0600},
+		{map[string]interface{}{"path": "a", "mode": "750", "executable": true}, 0750},
+	}
+	for _, c := range cases {
+		if mode, err := ProjectFileMode(c.file); err != nil || mode != c.expected {
+			t.Error("Expected ", c.expected, " for ", c.file, " but got ", mode, err)
+		}
+	}
+
+	for _, mode := range []string{"rwx", "0999", "01777"} {
+		if _, err := ProjectFileMode(map[string]interface{}{"path": "a", "mode": mode}); err == nil {
+			t.Error("It should reject mode ", mode)
+		}
+	}
+}
+
+func TestWriteProjectFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_project_files")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	project := Project{directory: dir, files: []map[string]interface{}{
+		{"path": "bin/setup", "contents": "#!/bin/sh\n", "executable": true},
+		{"path": "config/secrets.yml", "contents": "secret", "mode": "0600"},
+		{"path": "testributor.yml", "contents": "new"},
+	}}
+	ioutil.WriteFile(filepath.Join(dir, "testributor.yml"), []byte("old"), 0644)
+	// An existing file gets the new mode too
+	os.Mkdir(filepath.Join(dir, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "bin", "setup"), []byte(""), 0644)
+
+	if err = project.WriteProjectFiles(nil, Logger{prefix: "test", writer: ioutil.Discard}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for path, expected := range map[string]os.FileMode{"bin/setup": 0755, "config/secrets.yml": 0600} {
+		if fileInfo, err := os.Stat(filepath.Join(dir, path)); err != nil || fileInfo.Mode().Perm() != expected {
+			t.Error("Expected ", path, " to have mode ", expected, " but got ", fileInfo, err)
+		}
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "testributor.yml")); string(contents) != "old" {
+		t.Error("It should not overwrite testributor.yml")
+	}
+
+	project.files = []map[string]interface{}{{"path": "../escaped", "contents": "x"}}
+	if err = project.WriteProjectFiles(nil, Logger{prefix: "test", writer: ioutil.Discard}); err == nil {
+		t.Error("It should refuse to write outside the project directory")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped")); !os.IsNotExist(err) {
+		t.Error("It should not create the file")
+	}
+}
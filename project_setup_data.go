@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+const (
+	// How often the setup data are fetched again (unless Testributor tells us
+	// they changed earlier). Set setup_data_refresh_seconds to 0 to only
+	// refresh them when Testributor tells us.
+	DEFAULT_SETUP_DATA_REFRESH_SECONDS = 600
+)
+
+// SetupDataRefreshInterval returns the interval set with
+// setup_data_refresh_seconds (0 means never).
+func SetupDataRefreshInterval(config *Config) (time.Duration, error) {
+	seconds := config.SetupDataRefreshSeconds
+	if seconds < 0 {
+		return 0, errors.New("Invalid setup_data_refresh_seconds: " + strconv.Itoa(seconds) +
+			". Use a number of seconds (0 to disable).")
+	}
+
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// SetupDataVersion returns the version of the setup data found in a response
+// from Testributor (setup_data, beacon or batch_update). It returns an empty
+// string when the response doesn't have one.
+func SetupDataVersion(response interface{}) string {
+	result, ok := response.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	switch version := result["setup_data_version"].(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(version, 'f', -1, 64)
+	default:
+		return fmt.Sprint(version)
+	}
+}
+
+// SetupDataChanges returns what changed in the updated project (as returned
+// by ProjectBuilder.NewProject) compared to this one.
+func (project *Project) SetupDataChanges(updated *Project) []string {
+	var changes []string
+
+	if project.setupRepositoryUrl != updated.setupRepositoryUrl {
+		changes = append(changes, "repository url")
+	}
+	if !reflect.DeepEqual(project.currentWorkerGroup, updated.currentWorkerGroup) {
+		changes = append(changes, "repository credentials")
+	}
+	if project.sshKnownHosts != updated.sshKnownHosts {
+		changes = append(changes, "known hosts")
+	}
+	if !reflect.DeepEqual(project.files, updated.files) {
+		changes = append(changes, "files")
+	}
+	if project.dockerImage != updated.dockerImage {
+		changes = append(changes, "docker image")
+	}
+
+	return changes
+}
+
+// ApplySetupData replaces the project's setup data with the ones of the
+// updated project. When the repository or its credentials changed, access to
+// the repository is set up again (new keys, credentials and origin). If that
+// fails, the project keeps using the old setup data and an error is returned.
+// The new files are written by the next SetupTestEnvironment call.
+func (project *Project) ApplySetupData(updated *Project, logger Logger) error {
+	changes := project.SetupDataChanges(updated)
+	project.setupDataVersion = updated.setupDataVersion
+	if len(changes) == 0 {
+		logger.Log("The setup data didn't change")
+		return nil
+	}
+	logger.Log(fmt.Sprintf("The setup data changed: %v", changes))
+
+	// The container executor starts a container of the new image when prepared
+	project.dockerImage = updated.dockerImage
+
+	repositoryChanged := false
+	for _, change := range changes {
+		if change != "files" && change != "docker image" {
+			repositoryChanged = true
+		}
+	}
+	if !repositoryChanged {
+		project.files = updated.files
+		return nil
+	}
+
+	// Set up the repository access on a copy so we can go back to the current
+	// setup if the new one doesn't work.
+	candidate := *project
+	candidate.repositoryUrl = updated.repositoryUrl
+	candidate.setupRepositoryUrl = updated.setupRepositoryUrl
+	candidate.currentWorkerGroup = updated.currentWorkerGroup
+	candidate.sshKnownHosts = updated.sshKnownHosts
+	candidate.files = updated.files
+	candidate.sshDirectory = ""
+	candidate.sshAgent = nil
+	candidate.git = nil
+	candidate.gitEnvironment = nil
+
+	if err := candidate.SetupRepositoryAccess(logger); err != nil {
+		// The executor is still the project's. Only clean up what the
+		// candidate created.
+		candidate.executor = nil
+		candidate.Cleanup(logger)
+		return errors.New("Keeping the old setup data. The new ones don't work: " + err.Error())
+	}
+
+	project.Cleanup(logger)
+	*project = candidate
+	// The git backend points to the copy
+	project.git = nil
+
+	if changes[0] == "repository url" {
+		return project.FetchProjectRepo(logger)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetupDataVersion(t *testing.T) {
+	cases := map[string]string{
+		`{"setup_data_version": 12}`:       "12",
+		`{"setup_data_version": "a1b2c3"}`: "a1b2c3",
+		`{"delete_test_runs": []}`:         "",
+		`[]`:                               "",
+	}
+	for response, expected := range cases {
+		var result interface{}
+		json.Unmarshal([]byte(response), &result)
+		if version := SetupDataVersion(result); version != expected {
+			t.Error("Expected ", expected, " for ", response, " but got ", version)
+		}
+	}
+}
+
+func TestSetupDataRefreshInterval(t *testing.T) {
+	config := DefaultConfig()
+	if interval, err := SetupDataRefreshInterval(config); err != nil || interval != DEFAULT_SETUP_DATA_REFRESH_SECONDS*time.Second {
+		t.Error("It should use the default interval but got: ", interval, err)
+	}
+
+	config.SetupDataRefreshSeconds = 0
+	if interval, err := SetupDataRefreshInterval(config); err != nil || interval != 0 {
+		t.Error("It should allow disabling the refresh but got: ", interval, err)
+	}
+
+	config.SetupDataRefreshSeconds = -5
+	if _, err := SetupDataRefreshInterval(config); err == nil {
+		t.Error("It should return an error for invalid values")
+	}
+}
+
+func TestSetupDataChanges(t *testing.T) {
+	project := Project{
+		setupRepositoryUrl: "git@github.com:ispyropoulos/katana.git",
+		currentWorkerGroup: map[string]string{"ssh_key_private": "key"},
+		files:              []map[string]interface{}{{"path": "a", "contents": "a"}},
+	}
+	updated := project
+
+	if changes := project.SetupDataChanges(&updated); len(changes) != 0 {
+		t.Error("It should not find any changes but got: ", changes)
+	}
+
+	updated.setupRepositoryUrl = "git@github.com:ispyropoulos/katana2.git"
+	updated.files = []map[string]interface{}{{"path": "a", "contents": "b"}}
+	expected := []string{"repository url", "files"}
+	if changes := project.SetupDataChanges(&updated); !reflect.DeepEqual(changes, expected) {
+		t.Error("Expected ", expected, " but got ", changes)
+	}
+}
+
+func TestApplySetupData(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Chdir(cwd)
+
+	dir, err := ioutil.TempDir("", "testributor_setup_data")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	remote, commits := prepareGitRemote(t, dir)
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+
+	project := &Project{
+		repositoryUrl:      "/nonexistent/repository",
+		setupRepositoryUrl: "/nonexistent/repository",
+		directory:          filepath.Join(dir, "project"),
+	}
+	os.Mkdir(project.directory, 0755)
+
+	// Only the files changed
+	updated := *project
+	updated.files = []map[string]interface{}{{"path": "a", "contents": "a"}}
+	updated.setupDataVersion = "2"
+	if err = project.ApplySetupData(&updated, logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(project.files, updated.files) || project.setupDataVersion != "2" {
+		t.Error("It should replace the files and the version")
+	}
+
+	// The new repository doesn't exist either. We keep the old one.
+	updated.repositoryUrl = "/another/nonexistent/repository"
+	updated.setupRepositoryUrl = updated.repositoryUrl
+	if err = project.ApplySetupData(&updated, logger); err == nil {
+		t.Error("It should return an error when the new repository is not accessible")
+	}
+	if project.repositoryUrl != "/nonexistent/repository" {
+		t.Error("It should keep the old repository but got: ", project.repositoryUrl)
+	}
+
+	updated.repositoryUrl = remote
+	updated.setupRepositoryUrl = remote
+	if err = project.ApplySetupData(&updated, logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	if project.repositoryUrl != remote {
+		t.Error("It should use the new repository but got: ", project.repositoryUrl)
+	}
+	if exists, err := project.CommitExists(commits[0]); err != nil || !exists {
+		t.Error("It should fetch the new repository")
+	}
+}
+
+func TestApplySetupDataKeepsTheExecutorWhenItFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_setup_data")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "docker.sock")
+	api, stop := startFakeDockerApi(t, socket)
+	defer stop()
+	config := DefaultConfig()
+	config.DockerSocket = socket
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+
+	project := &Project{
+		repositoryUrl:      "/nonexistent/repository",
+		setupRepositoryUrl: "/nonexistent/repository",
+		directory:          filepath.Join(dir, "project"),
+		dockerImage:        "ruby:2.4.0",
+		config:             config,
+	}
+	project.executor = &ContainerExecutor{project: project}
+	if err = project.Executor().Prepare(logger); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	updated := *project
+	updated.repositoryUrl = "/another/nonexistent/repository"
+	updated.setupRepositoryUrl = updated.repositoryUrl
+	if err = project.ApplySetupData(&updated, logger); err == nil {
+		t.Error("It should return an error when the new repository is not accessible")
+	}
+
+	// The next job runs in the same container
+	if len(api.containers) != 1 {
+		t.Error("It should keep the container but got: ", api.containers)
+	}
+	res, err := project.RunCommand("bin/rake test", nil, ioutil.Discard)
+	if err != nil || !strings.Contains(res.Output, "first line") {
+		t.Error("It should run the job in the container but got: ", res, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	TEMPLATE_ENV_PREFIX  = "env."
+	DEFAULT_WORKER_INDEX = "0"
+)
+
+// Variables are written as %{name} like %{file} in testributor.yml. %%{name}
+// is written as a literal %{name}.
+var TEMPLATE_VARIABLE_REGEXP = regexp.MustCompile(`%(%?)\{([A-Za-z0-9_.]+)\}`)
+
+// TemplateVariables returns the variables available to templated project
+// files. testRunId is 0 and commitSha is empty when the files are written
+// while initializing the worker.
+//
+// worker_index comes from the worker_index setting and is meant to tell apart
+// agents running on the same machine (e.g. to give each one its own database).
+func TemplateVariables(config *Config, testRunId int, commitSha string) map[string]string {
+	workerIndex := config.WorkerIndex
+	if workerIndex == "" {
+		workerIndex = DEFAULT_WORKER_INDEX
+	}
+
+	variables := map[string]string{
+		"worker_uuid":       WorkerUUID,
+		"worker_uuid_short": WorkerUUIDShort,
+		"worker_index":      workerIndex,
+		"cpu_count":         strconv.Itoa(runtime.NumCPU()),
+		"test_run_id":       "",
+		"commit_sha":        commitSha,
+	}
+	if testRunId != 0 {
+		variables["test_run_id"] = strconv.Itoa(testRunId)
+	}
+
+	return variables
+}
+
+// ExpandTemplate replaces the variables in contents with their values.
+// %{env.NAME} is replaced with the value of the NAME environment variable
+// (empty if not set). Unknown variables return an error.
+func ExpandTemplate(contents string, variables map[string]string) (string, error) {
+	var unknown []string
+
+	result := TEMPLATE_VARIABLE_REGEXP.ReplaceAllStringFunc(contents, func(match string) string {
+		parts := TEMPLATE_VARIABLE_REGEXP.FindStringSubmatch(match)
+		escaped, name := parts[1] != "", parts[2]
+		if escaped {
+			return match[1:]
+		}
+
+		if strings.HasPrefix(name, TEMPLATE_ENV_PREFIX) {
+			return os.Getenv(strings.TrimPrefix(name, TEMPLATE_ENV_PREFIX))
+		}
+		if value, ok := variables[name]; ok {
+			return value
+		}
+
+		unknown = append(unknown, name)
+		return match
+	})
+
+	if len(unknown) > 0 {
+		return "", errors.New("Unknown template variables: " + strings.Join(unknown, ", "))
+	}
+
+	return result, nil
+}
+
+// ProjectFileContents returns the contents to write for a project file. Only
+// files marked as "template" are expanded so files which happen to contain
+// %{...} (e.g. Ruby string literals) are written as they are.
+func ProjectFileContents(file map[string]interface{}, variables map[string]string) (string, error) {
+	contents := file["contents"].(string)
+
+	if template, _ := file["template"].(bool); !template {
+		return contents, nil
+	}
+
+	expanded, err := ExpandTemplate(contents, variables)
+	if err != nil {
+		return "", errors.New("Couldn't expand " + file["path"].(string) + ": " + err.Error())
+	}
+
+	return expanded, nil
+}
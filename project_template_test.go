@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestTemplateVariables(t *testing.T) {
+	config := DefaultConfig()
+	variables := TemplateVariables(config, 0, "")
+	if variables["worker_index"] != "0" || variables["test_run_id"] != "" ||
+		variables["cpu_count"] != strconv.Itoa(runtime.NumCPU()) {
+		t.Error("Unexpected variables: ", variables)
+	}
+
+	config.WorkerIndex = "3"
+	variables = TemplateVariables(config, 42, "abc123")
+	if variables["worker_index"] != "3" || variables["test_run_id"] != "42" || variables["commit_sha"] != "abc123" {
+		t.Error("Unexpected variables: ", variables)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	os.Setenv("TESTRIBUTOR_TEMPLATE_TEST", "postgres")
+	defer os.Unsetenv("TESTRIBUTOR_TEMPLATE_TEST")
+
+	variables := map[string]string{"worker_index": "2", "test_run_id": "42"}
+	contents := "host: %{env.TESTRIBUTOR_TEMPLATE_TEST}\n" +
+		"database: katana_test_%{worker_index}\n" +
+		"run: %{test_run_id} %%{worker_index} %{env.TESTRIBUTOR_TEMPLATE_MISSING}."
+	expected := "host: postgres\n" +
+		"database: katana_test_2\n" +
+		"run: 42 %{worker_index} ."
+
+	if result, err := ExpandTemplate(contents, variables); err != nil || result != expected {
+		t.Error("Expected ", expected, " but got ", result, err)
+	}
+
+	if _, err := ExpandTemplate("%{worker_idx} %{cpus}", variables); err == nil ||
+		err.Error() != "Unknown template variables: worker_idx, cpus" {
+		t.Error("It should return an error for unknown variables but got: ", err)
+	}
+}
+
+func TestProjectFileContents(t *testing.T) {
+	variables := map[string]string{"worker_index": "2"}
+
+	file := map[string]interface{}{"path": "a.rb", "contents": "x = %{worker_index}"}
+	if contents, err := ProjectFileContents(file, variables); err != nil || contents != "x = %{worker_index}" {
+		t.Error("It should not expand files which are not templates but got: ", contents, err)
+	}
+
+	file["template"] = true
+	if contents, err := ProjectFileContents(file, variables); err != nil || contents != "x = 2" {
+		t.Error("It should expand templates but got: ", contents, err)
+	}
+}
@@ -2,6 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -45,6 +49,26 @@ func prepareProjectBuilder() (ProjectBuilder, error) {
 	return ProjectBuilder(parsedResponse.(map[string]interface{})), nil
 }
 
+func TestNewProjectBuilderMalformedSetupData(t *testing.T) {
+	if _, err := NewProjectBuilder([]interface{}{}); err == nil {
+		t.Error("It should return an error when the setup data is not an object")
+	}
+
+	builder, err := prepareProjectBuilder()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	builder["current_worker_group"].(map[string]interface{})["ssh_key_private"] = float64(1)
+	if _, err := builder.NewProject(DefaultConfig()); err == nil {
+		t.Error("It should return an error for fields with the wrong type")
+	}
+
+	builder["current_project"] = "katana"
+	if _, err := builder.NewProject(DefaultConfig()); err == nil {
+		t.Error("It should return an error when current_project is missing")
+	}
+}
+
 func TestBuilderRepositoryUrl(t *testing.T) {
 	builder, err := prepareProjectBuilder()
 	if err != nil {
@@ -59,6 +83,41 @@ func TestBuilderRepositoryUrl(t *testing.T) {
 
 }
 
+func TestBuilderGenericRepositoryUrl(t *testing.T) {
+	builder, err := prepareProjectBuilder()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if repositoryUrl := builder.repositoryUrl(); repositoryUrl != "git@github.com:ispyropoulos/katana.git" {
+		t.Error("It should fall back to repository_ssh_url but got: ", repositoryUrl)
+	}
+
+	builder["current_project"].(map[string]interface{})["repository_url"] =
+		"https://github.com/ispyropoulos/katana.git"
+	if repositoryUrl := builder.repositoryUrl(); repositoryUrl != "https://github.com/ispyropoulos/katana.git" {
+		t.Error("It should prefer repository_url but got: ", repositoryUrl)
+	}
+}
+
+func TestBuilderDockerImage(t *testing.T) {
+	builder, err := prepareProjectBuilder()
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if dockerImage := builder.dockerImage(); dockerImage != "ruby:2.3.0" {
+		t.Error("It should return the docker image with its version but got: ", dockerImage)
+	}
+
+	delete(builder["current_project"].(map[string]interface{}), "docker_image")
+	if dockerImage := builder.dockerImage(); dockerImage != "" {
+		t.Error("It should return nothing when there is no docker image but got: ", dockerImage)
+	}
+}
+
 func TestBuilderCurrentWorkerGroup(t *testing.T) {
 	builder, err := prepareProjectBuilder()
 	if err != nil {
@@ -102,3 +161,46 @@ func TestBuilderFiles(t *testing.T) {
 		t.Error("It should return the correct contents but got: ", contents)
 	}
 }
+
+func TestCreateSshKeys(t *testing.T) {
+	project := Project{currentWorkerGroup: map[string]string{
+		"ssh_key_private": "private_key",
+		"ssh_key_public":  "public_key",
+	}}
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+
+	if err := project.CreateSshKeys(logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer project.Cleanup(logger)
+
+	dirInfo, err := os.Stat(project.sshDirectory)
+	if err != nil || dirInfo.Mode().Perm() != 0700 {
+		t.Error("It should create a private directory but got: ", dirInfo, err)
+	}
+
+	keyInfo, err := os.Stat(filepath.Join(project.sshDirectory, PRIVATE_KEY_NAME))
+	if err != nil || keyInfo.Mode().Perm() != 0600 {
+		t.Error("It should write the private key with 0600 mode but got: ", keyInfo, err)
+	}
+
+	if len(project.gitEnvironment) != 1 ||
+		!strings.HasPrefix(project.gitEnvironment[0], "GIT_SSH_COMMAND=ssh -i "+project.sshDirectory) {
+		t.Error("It should set GIT_SSH_COMMAND for git commands but got: ", project.gitEnvironment)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	project := Project{currentWorkerGroup: map[string]string{}}
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+	if err := project.CreateSshKeys(logger); err != nil {
+		t.Fatal(err.Error())
+	}
+	sshDir := project.sshDirectory
+
+	project.Cleanup(logger)
+
+	if _, err := os.Stat(sshDir); !os.IsNotExist(err) {
+		t.Error("It should remove the SSH directory")
+	}
+}
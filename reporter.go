@@ -6,12 +6,6 @@ import (
 	"time"
 )
 
-const (
-	REPORTING_FREQUENCY_SECONDS = 5
-	ACTIVE_SENDERS_LIMIT        = 3
-	BEACON_THRESHOLD_SECONDS    = 12
-)
-
 type Reporter struct {
 	reportsChannel          chan *TestJob
 	logger                  Logger
@@ -19,22 +13,31 @@ type Reporter struct {
 	reports                 []TestJob
 	lastServerCommunication time.Time
 	activeSenders           int // Counts how many go routines are activelly trying to send reports
+	activeSendersLimit      int
+	beaconThreshold         time.Duration
 	tickerChan              <-chan time.Time
 	activeSenderDone        chan bool // We reduce the active senders by sending to this channel
 	cancelledTestRunIdsChan chan []int
+	setupDataVersionChan    chan string // Tells the Worker about new versions of the setup data
+	statusRequestsChan      chan chan ReporterStatus
 }
 
 // NewReporter should be used to create a Reporter instances. It ensures the correct
 // initialization of all fields.
-func NewReporter(reportsChannel chan *TestJob, cancelledTestRunIdsChan chan []int) *Reporter {
-	logger := Logger{"Reporter", os.Stdout}
+func NewReporter(config *Config, reportsChannel chan *TestJob, cancelledTestRunIdsChan chan []int,
+	setupDataVersionChan chan string) *Reporter {
+	logger := Logger{prefix: "Reporter", writer: os.Stdout}
 	return &Reporter{
 		reportsChannel:          reportsChannel,
 		logger:                  logger,
-		client:                  NewClient(logger),
-		tickerChan:              time.NewTicker(time.Second * REPORTING_FREQUENCY_SECONDS).C,
+		client:                  NewClient(config, logger),
+		activeSendersLimit:      config.ActiveSendersLimit,
+		beaconThreshold:         time.Duration(config.BeaconThresholdSeconds) * time.Second,
+		tickerChan:              time.NewTicker(time.Duration(config.ReportingFrequencySeconds) * time.Second).C,
 		activeSenderDone:        make(chan bool),
 		cancelledTestRunIdsChan: cancelledTestRunIdsChan,
+		setupDataVersionChan:    setupDataVersionChan,
+		statusRequestsChan:      make(chan chan ReporterStatus),
 	}
 }
 
@@ -44,17 +47,22 @@ func (r *Reporter) ParseChannels() {
 		r.reports = append(r.reports, *testJob)
 	case <-r.activeSenderDone:
 		r.activeSenders -= 1
+	case reply := <-r.statusRequestsChan:
+		reply <- r.Status()
 	case <-r.tickerChan:
-		if r.activeSenders < ACTIVE_SENDERS_LIMIT && len(r.reports) > 0 {
+		if r.activeSenders < r.activeSendersLimit && len(r.reports) > 0 {
 			go r.SendReports(r.reports)
 			r.reports = []TestJob{}
 			r.activeSenders += 1
 		} else if r.NeedToBeacon() {
 			go func() {
-				if _, err := r.client.Beacon(); err != nil {
+				res, err := r.client.Beacon()
+				if err != nil {
 					panic("Tried to beacon but there was an error: " + err.Error())
 				}
 				r.lastServerCommunication = time.Now()
+				metricLastServerCommunication.Set(float64(r.lastServerCommunication.Unix()))
+				r.signalSetupDataVersion(res)
 			}()
 		}
 	}
@@ -67,10 +75,10 @@ func (r *Reporter) Start() {
 	}
 }
 
-// NeedToBeacon returns true if BEACON_THRESHOLD_SECONDS have passed since the
-// last beacon request.
+// NeedToBeacon returns true if beaconThreshold has passed since the last
+// beacon request.
 func (r *Reporter) NeedToBeacon() bool {
-	return time.Since(r.lastServerCommunication).Seconds() > BEACON_THRESHOLD_SECONDS
+	return time.Since(r.lastServerCommunication) > r.beaconThreshold
 }
 
 // SendReports takes a slice of TestJobs and sends it to Testributor. It will
@@ -83,17 +91,40 @@ func (r *Reporter) NeedToBeacon() bool {
 // trying to communicate with Testributor from a large number of different threads.
 // To avoid this issue, we keep a track of "active" SendReport routines (using
 // a counter which decrements through a channel when routines exit). We apply a
-// sane limit to the number of these routines (ACTIVE_SENDERS_LIMIT).
+// sane limit to the number of these routines (activeSendersLimit).
 func (r *Reporter) SendReports(reports []TestJob) error {
 	defer func() { r.activeSenderDone <- true }() // decrement activeSenders
 
 	r.logger.Log("Sending " + strconv.Itoa(len(reports)) + " reports")
-	res, err := r.client.UpdateTestJobs(reports)
+	metricReportBatchSize.Observe(float64(len(reports)))
+
+	// The report ends the trace of each job (see TestJob.span). Every trace gets
+	// a span for the request which is traced as a child of the first one.
+	spans := make([]*Span, len(reports))
+	for i, report := range reports {
+		spans[i] = StartSpan("Reporter.SendReports", report.span)
+		spans[i].SetAttribute("testributor.reports", len(reports))
+	}
+
+	var requestParent *Span
+	if len(spans) > 0 {
+		requestParent = spans[0]
+	}
+	res, err := r.client.UpdateTestJobs(reports, requestParent)
+	for i, report := range reports {
+		spans[i].SetError(err)
+		spans[i].End()
+		report.span.SetError(err)
+		report.span.End()
+	}
 	if err != nil {
-		r.logger.Log(err.Error())
+		metricReportFailuresTotal.Inc()
+		r.logger.Error(err.Error())
 		return err
 	}
 	r.lastServerCommunication = time.Now()
+	metricLastServerCommunication.Set(float64(r.lastServerCommunication.Unix()))
+	r.signalSetupDataVersion(res)
 
 	// Tell Manager to cancel these TestRuns since they were cancelled on Testributor
 	// NOTE: We could do this in a go routine to let this sender exit but it
@@ -112,3 +143,24 @@ func (r *Reporter) deleteTestRunIds(response interface{}) []int {
 
 	return deleteTestRunIds
 }
+
+// signalSetupDataVersion passes the setup data version found in a response
+// (if any) to the Worker. The channel is buffered and we never block on it.
+// If the Worker hasn't read the previous version yet we skip this one since
+// the Worker will fetch the latest setup data anyway.
+func (r *Reporter) signalSetupDataVersion(response interface{}) {
+	version := SetupDataVersion(response)
+	if version == "" {
+		return
+	}
+
+	// Replace a version the Worker hasn't read yet so it gets the newest one
+	select {
+	case <-r.setupDataVersionChan:
+	default:
+	}
+	select {
+	case r.setupDataVersionChan <- version:
+	default:
+	}
+}
@@ -8,7 +8,7 @@ import (
 
 func TestParseChannelsWhenThereIsANewReport(t *testing.T) {
 	reportsChan := make(chan *TestJob)
-	r := NewReporter(reportsChan, make(chan []int))
+	r := NewReporter(DefaultConfig(), reportsChan, make(chan []int), make(chan string, 1))
 
 	go func() {
 		reportsChan <- &TestJob{Id: 123}
@@ -22,7 +22,7 @@ func TestParseChannelsWhenThereIsANewReport(t *testing.T) {
 
 func TestParseChannelsWhenActiveServerIsDone(t *testing.T) {
 	reportsChan := make(chan *TestJob)
-	r := NewReporter(reportsChan, make(chan []int))
+	r := NewReporter(DefaultConfig(), reportsChan, make(chan []int), make(chan string, 1))
 	r.activeSenders = 2
 
 	go func() {
@@ -37,7 +37,7 @@ func TestParseChannelsWhenActiveServerIsDone(t *testing.T) {
 
 func TestDeleteTestRunIds(t *testing.T) {
 	reportsChan := make(chan *TestJob)
-	r := NewReporter(reportsChan, make(chan []int))
+	r := NewReporter(DefaultConfig(), reportsChan, make(chan []int), make(chan string, 1))
 
 	responseText := `{"delete_test_runs":[1976]}`
 	var result interface{}
@@ -50,3 +50,17 @@ func TestDeleteTestRunIds(t *testing.T) {
 		t.Error("It should return []int{1976}")
 	}
 }
+
+func TestSignalSetupDataVersion(t *testing.T) {
+	setupDataVersionChan := make(chan string, 1)
+	r := NewReporter(DefaultConfig(), make(chan *TestJob), make(chan []int), setupDataVersionChan)
+
+	r.signalSetupDataVersion(map[string]interface{}{"delete_test_runs": []interface{}{}})
+	r.signalSetupDataVersion(map[string]interface{}{"setup_data_version": float64(3)})
+	// It should not block when the Worker hasn't read the previous version
+	r.signalSetupDataVersion(map[string]interface{}{"setup_data_version": float64(4)})
+
+	if version := <-setupDataVersionChan; version != "4" {
+		t.Error("Expected the newest version 4 but got ", version)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	REPOSITORY_TRANSPORT_SSH   = "ssh"
+	REPOSITORY_TRANSPORT_HTTPS = "https"
+	REPOSITORY_TRANSPORT_LOCAL = "local"
+
+	// Username used when neither the setup data nor the environment specify one.
+	// GitHub ignores the username when a token is used as the password, other
+	// hosts (e.g. GitLab, Bitbucket) might need an explicit one.
+	DEFAULT_HTTPS_USERNAME = "x-access-token"
+
+	// The environment variables our credential helper reads the credentials
+	// from. They are set by the agent, users should use TESTRIBUTOR_REPOSITORY_TOKEN
+	// and TESTRIBUTOR_REPOSITORY_USERNAME instead.
+	GIT_CREDENTIAL_USERNAME_ENV = "TESTRIBUTOR_GIT_CREDENTIAL_USERNAME"
+	GIT_CREDENTIAL_PASSWORD_ENV = "TESTRIBUTOR_GIT_CREDENTIAL_PASSWORD"
+)
+
+// The credential helper git will call for HTTPS repositories. It answers
+// "get" requests using the environment variables above so the token is never
+// written in a file or in the repository's config.
+// https://git-scm.com/docs/gitcredentials#_custom_helpers
+const GIT_CREDENTIAL_HELPER = `!f() { test "$1" = get && ` +
+	`echo "username=$` + GIT_CREDENTIAL_USERNAME_ENV + `" && ` +
+	`echo "password=$` + GIT_CREDENTIAL_PASSWORD_ENV + `"; }; f`
+
+// RepositoryTransport returns the transport used to fetch the project's
+// repository based on the url's scheme. file:// urls and paths are local (bare)
+// repositories. Anything else that doesn't look like an HTTP(S) url is
+// considered an SSH url (e.g. git@github.com:user/repo.git).
+func (project *Project) RepositoryTransport() string {
+	repositoryUrl, err := ParseRepositoryUrl(project.repositoryUrl)
+	if err != nil {
+		// Let git complain about it
+		return REPOSITORY_TRANSPORT_SSH
+	}
+
+	switch repositoryUrl.Scheme {
+	case "https", "http":
+		return REPOSITORY_TRANSPORT_HTTPS
+	case "file":
+		return REPOSITORY_TRANSPORT_LOCAL
+	default:
+		return REPOSITORY_TRANSPORT_SSH
+	}
+}
+
+// isLocalPath follows the rule git uses to tell scp-like urls from paths:
+// a url without a scheme is scp-like only if there is a colon before the first
+// slash (e.g. host:path/to/repo.git). Anything else is a path.
+// https://git-scm.com/docs/git-clone#_git_urls
+func isLocalPath(url string) bool {
+	if strings.Contains(url, "://") {
+		return false
+	}
+
+	colon := strings.Index(url, ":")
+	slash := strings.Index(url, "/")
+
+	return colon == -1 || (slash != -1 && slash < colon)
+}
+
+// LocalRepositoryPath returns the absolute path of a local repository. Relative
+// paths are resolved against the current directory since the agent changes
+// directory to the project's directory before running git.
+func (project *Project) LocalRepositoryPath() (string, error) {
+	path := project.repositoryUrl
+	if strings.HasPrefix(strings.ToLower(path), "file://") {
+		path = path[len("file://"):]
+	}
+
+	return filepath.Abs(path)
+}
+
+// SetupRepositoryAccess prepares whatever is needed for git to be able to
+// fetch the project's repository using the transport implied by its url.
+func (project *Project) SetupRepositoryAccess(logger Logger) error {
+	switch project.RepositoryTransport() {
+	case REPOSITORY_TRANSPORT_HTTPS:
+		logger.Log("Repository will be fetched over HTTPS")
+		err := project.SetupHttpsCredentials(logger)
+		if err != nil {
+			return err
+		}
+
+		return project.CheckRepositoryAccess(logger)
+	case REPOSITORY_TRANSPORT_LOCAL:
+		logger.Log("Repository will be fetched from a local path")
+		return project.CheckLocalRepository(logger)
+	default:
+		logger.Log("Repository will be fetched over SSH")
+		err := project.CreateSshKeys(logger)
+		if err != nil {
+			return err
+		}
+
+		return project.CheckRepositoryAccess(logger)
+	}
+}
+
+// CheckLocalRepository makes sure the local repository exists and is a git
+// repository (bare or not). It also replaces relative paths with absolute
+// ones (see LocalRepositoryPath).
+func (project *Project) CheckLocalRepository(logger Logger) error {
+	path, err := project.LocalRepositoryPath()
+	if err != nil {
+		return err
+	}
+
+	if fileInfo, err := os.Stat(path); err != nil || !fileInfo.IsDir() {
+		return errors.New("The repository " + path + " doesn't exist or is not a directory.")
+	}
+
+	if _, err = project.Git().LsRemote(path); err != nil {
+		return errors.New(path + " doesn't seem to be a git repository: " + err.Error())
+	}
+
+	if !strings.HasPrefix(strings.ToLower(project.repositoryUrl), "file://") {
+		project.repositoryUrl = path
+	}
+	logger.Log("Found repository " + path)
+
+	return nil
+}
+
+// HttpsCredentials returns the username and the token to use for HTTPS
+// repositories. The repository_token and repository_username settings take
+// precedence over the values sent by Testributor.
+func (project *Project) HttpsCredentials() (string, string, error) {
+	token := project.Config().RepositoryToken
+	if token == "" {
+		token = project.currentWorkerGroup["repository_token"]
+	}
+	if token == "" {
+		return "", "", errors.New("No token found for the HTTPS repository. " +
+			"Set repository_token (TESTRIBUTOR_REPOSITORY_TOKEN) and run the agent again.")
+	}
+
+	username := project.Config().RepositoryUsername
+	if username == "" {
+		username = project.currentWorkerGroup["repository_username"]
+	}
+	if username == "" {
+		username = DEFAULT_HTTPS_USERNAME
+	}
+
+	return username, token, nil
+}
+
+// SetupHttpsCredentials configures git (through environment variables passed
+// to every git command) to use our credential helper. Any helper configured by
+// the user is reset first (an empty value clears the list) so only our
+// credentials are used.
+// https://git-scm.com/docs/git-config#Documentation/git-config.txt-GITCONFIGCOUNT
+func (project *Project) SetupHttpsCredentials(logger Logger) error {
+	username, token, err := project.HttpsCredentials()
+	if err != nil {
+		return err
+	}
+
+	// The builtin backend doesn't use the credential helper
+	if _, ok := project.Git().(*ShellGit); ok {
+		err = CheckGitVersion(MIN_GIT_VERSION_FOR_HTTPS, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	project.gitEnvironment = []string{
+		GIT_CREDENTIAL_USERNAME_ENV + "=" + username,
+		GIT_CREDENTIAL_PASSWORD_ENV + "=" + token,
+		// Fail instead of waiting for input if the credentials are wrong
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_CONFIG_COUNT=2",
+		"GIT_CONFIG_KEY_0=credential.helper",
+		"GIT_CONFIG_VALUE_0=",
+		"GIT_CONFIG_KEY_1=credential.helper",
+		"GIT_CONFIG_VALUE_1=" + GIT_CREDENTIAL_HELPER,
+	}
+	logger.Log("Configured git credentials for user " + username)
+
+	return nil
+}
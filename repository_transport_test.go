@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepositoryTransport(t *testing.T) {
+	urls := map[string]string{
+		"git@github.com:ispyropoulos/katana.git":         REPOSITORY_TRANSPORT_SSH,
+		"ssh://git@example.com:2222/katana.git":          REPOSITORY_TRANSPORT_SSH,
+		"https://github.com/ispyropoulos/katana.git":     REPOSITORY_TRANSPORT_HTTPS,
+		"HTTP://git.example.com/ispyropoulos/katana.git": REPOSITORY_TRANSPORT_HTTPS,
+		"file:///srv/git/katana.git":                     REPOSITORY_TRANSPORT_LOCAL,
+		"/srv/git/katana.git":                            REPOSITORY_TRANSPORT_LOCAL,
+		"../katana.git":                                  REPOSITORY_TRANSPORT_LOCAL,
+		"./foo:bar.git":                                  REPOSITORY_TRANSPORT_LOCAL,
+		"git.example.com:katana.git":                     REPOSITORY_TRANSPORT_SSH,
+	}
+
+	for url, expected := range urls {
+		project := Project{repositoryUrl: url}
+		if transport := project.RepositoryTransport(); transport != expected {
+			t.Error("Expected "+expected+" transport for "+url+" but got: ", transport)
+		}
+	}
+}
+
+func TestHttpsCredentialsFromSetupData(t *testing.T) {
+	project := Project{currentWorkerGroup: map[string]string{"repository_token": "secret"}}
+
+	username, token, err := project.HttpsCredentials()
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if username != DEFAULT_HTTPS_USERNAME || token != "secret" {
+		t.Error("It should use the token from setup data but got: ", username, token)
+	}
+}
+
+func TestHttpsCredentialsFromConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.RepositoryToken = "config_secret"
+	config.RepositoryUsername = "oauth2"
+	project := Project{currentWorkerGroup: map[string]string{"repository_token": "secret"}, config: config}
+
+	username, token, err := project.HttpsCredentials()
+	if err != nil {
+		t.Error(err.Error())
+	}
+	if username != "oauth2" || token != "config_secret" {
+		t.Error("The config should take precedence but got: ", username, token)
+	}
+}
+
+func TestHttpsCredentialsWithoutToken(t *testing.T) {
+	project := Project{currentWorkerGroup: map[string]string{}}
+
+	if _, _, err := project.HttpsCredentials(); err == nil {
+		t.Error("It should return an error when no token is available")
+	}
+}
+
+func TestCheckLocalRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_bare_repo")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	repoPath := filepath.Join(dir, "katana.git")
+	if err := exec.Command("git", "init", "--bare", repoPath).Run(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	project := Project{repositoryUrl: "file://" + repoPath}
+	if err := project.CheckLocalRepository(Logger{prefix: "test", writer: ioutil.Discard}); err != nil {
+		t.Error("It should accept a bare repository but got: ", err.Error())
+	}
+
+	project = Project{repositoryUrl: filepath.Join(dir, "missing.git")}
+	if err := project.CheckLocalRepository(Logger{prefix: "test", writer: ioutil.Discard}); err == nil {
+		t.Error("It should return an error when the repository doesn't exist")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RepositoryUrl is a parsed git url. Besides the urls with a scheme
+// (ssh://, https://, file:// etc) it understands the scp-like syntax
+// (git@github.com:user/repo.git) and local paths.
+// https://git-scm.com/docs/git-clone#_git_urls
+type RepositoryUrl struct {
+	Scheme string // "ssh" for scp-like urls, "file" for local paths
+	User   string
+	Host   string
+	Port   string
+	Path   string
+}
+
+// ParseRepositoryUrl parses any url git would accept as a remote.
+func ParseRepositoryUrl(rawUrl string) (RepositoryUrl, error) {
+	if rawUrl == "" {
+		return RepositoryUrl{}, errors.New("The repository url is empty.")
+	}
+
+	if strings.Contains(rawUrl, "://") {
+		parsed, err := url.Parse(rawUrl)
+		if err != nil {
+			return RepositoryUrl{}, errors.New("Invalid repository url " + rawUrl + ": " + err.Error())
+		}
+
+		scheme := strings.ToLower(parsed.Scheme)
+		// ssh+git:// and git+ssh:// are aliases for ssh://
+		if scheme == "git+ssh" || scheme == "ssh+git" {
+			scheme = "ssh"
+		}
+		if scheme != "file" && parsed.Hostname() == "" {
+			return RepositoryUrl{}, errors.New("Invalid repository url " + rawUrl + ": no host")
+		}
+
+		return RepositoryUrl{
+			Scheme: scheme,
+			User:   parsed.User.Username(),
+			Host:   parsed.Hostname(),
+			Port:   parsed.Port(),
+			Path:   parsed.Path,
+		}, nil
+	}
+
+	if isLocalPath(rawUrl) {
+		return RepositoryUrl{Scheme: "file", Path: rawUrl}, nil
+	}
+
+	// scp-like: [user@]host:path
+	colon := strings.Index(rawUrl, ":")
+	result := RepositoryUrl{Scheme: "ssh", Host: rawUrl[:colon], Path: rawUrl[colon+1:]}
+	if at := strings.LastIndex(result.Host, "@"); at != -1 {
+		result.User = result.Host[:at]
+		result.Host = result.Host[at+1:]
+	}
+	if result.Host == "" {
+		return RepositoryUrl{}, errors.New("Invalid repository url " + rawUrl + ": no host")
+	}
+
+	return result, nil
+}
+
+// HostWithPort returns the host followed by the port (if one is set).
+func (u RepositoryUrl) HostWithPort() string {
+	if u.Port == "" {
+		return u.Host
+	}
+
+	return u.Host + ":" + u.Port
+}
+
+const (
+	REPOSITORY_ACCESS_UNKNOWN_ERROR = iota
+	REPOSITORY_HOST_UNREACHABLE
+	REPOSITORY_HOST_KEY_REJECTED
+	REPOSITORY_AUTH_DENIED
+	REPOSITORY_NOT_FOUND
+)
+
+// RepositoryAccessError is returned when we can't list the repository's refs.
+// Kind tells what went wrong (one of the constants above) and Output holds
+// git's error output.
+type RepositoryAccessError struct {
+	Kind   int
+	Url    RepositoryUrl
+	Output string
+}
+
+func (e *RepositoryAccessError) Error() string {
+	host := e.Url.HostWithPort()
+
+	switch e.Kind {
+	case REPOSITORY_HOST_UNREACHABLE:
+		return "Couldn't connect to " + host + ". Check the repository url and your network."
+	case REPOSITORY_HOST_KEY_REJECTED:
+		return "The host key of " + host + " is unknown or has changed. " +
+			"Add the host's key to TESTRIBUTOR_SSH_KNOWN_HOSTS and run the agent again."
+	case REPOSITORY_AUTH_DENIED:
+		return host + " denied access. The keys or the token don't seem to be valid."
+	case REPOSITORY_NOT_FOUND:
+		return "The repository " + e.Url.Path + " was not found on " + host +
+			" (or the keys don't have access to it)."
+	default:
+		return "Couldn't access the repository: " + strings.TrimSpace(e.Output)
+	}
+}
+
+// The messages git (and ssh) print for each kind of error (regular
+// expressions matched against the lowercase output). They are checked in this
+// order since some errors print more than one of these. The generic "not
+// found" messages come last so that e.g. "ssh: command not found" or a
+// "Repository not found" printed after an authentication error don't hide
+// the actual problem.
+var repositoryAccessErrorMessages = []struct {
+	kind     int
+	messages []string
+}{
+	{REPOSITORY_HOST_KEY_REJECTED, []string{
+		"host key verification failed",
+		"knownhosts: key is unknown",
+		"knownhosts: key mismatch",
+	}},
+	{REPOSITORY_AUTH_DENIED, []string{
+		"permission denied",
+		"authentication failed",
+		"access denied",
+		"could not read username",
+		"could not read password",
+		"authentication required",
+		"authorization failed",
+		"unable to authenticate",
+	}},
+	{REPOSITORY_HOST_UNREACHABLE, []string{
+		"could not resolve hostname",
+		"could not resolve host",
+		"connection refused",
+		"connection timed out",
+		"operation timed out",
+		"network is unreachable",
+		"no route to host",
+		"failed to connect to",
+		"no such host",
+		"i/o timeout",
+	}},
+	{REPOSITORY_NOT_FOUND, []string{
+		"^(error: |remote: )?repository not found",
+		"fatal: repository '[^']*' not found",
+		"does not appear to be a git repository",
+	}},
+}
+
+// ClassifyRepositoryAccessError returns the kind of error based on the
+// output of a failed git command.
+func ClassifyRepositoryAccessError(output string) int {
+	output = strings.ToLower(output)
+
+	for _, errorMessages := range repositoryAccessErrorMessages {
+		for _, message := range errorMessages.messages {
+			if matched, _ := regexp.MatchString("(?m)"+message, output); matched {
+				return errorMessages.kind
+			}
+		}
+	}
+
+	return REPOSITORY_ACCESS_UNKNOWN_ERROR
+}
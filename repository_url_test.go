@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseRepositoryUrl(t *testing.T) {
+	urls := map[string]RepositoryUrl{
+		"git@github.com:ispyropoulos/katana.git": RepositoryUrl{
+			Scheme: "ssh", User: "git", Host: "github.com", Path: "ispyropoulos/katana.git"},
+		"git.example.com:katana.git": RepositoryUrl{
+			Scheme: "ssh", Host: "git.example.com", Path: "katana.git"},
+		"ssh://git@git.example.com:2222/srv/katana.git": RepositoryUrl{
+			Scheme: "ssh", User: "git", Host: "git.example.com", Port: "2222", Path: "/srv/katana.git"},
+		"git+ssh://git.example.com/katana.git": RepositoryUrl{
+			Scheme: "ssh", Host: "git.example.com", Path: "/katana.git"},
+		"https://oauth2@gitlab.com/ispyropoulos/katana.git": RepositoryUrl{
+			Scheme: "https", User: "oauth2", Host: "gitlab.com", Path: "/ispyropoulos/katana.git"},
+		"file:///srv/git/katana.git": RepositoryUrl{
+			Scheme: "file", Path: "/srv/git/katana.git"},
+		"../katana.git": RepositoryUrl{
+			Scheme: "file", Path: "../katana.git"},
+	}
+
+	for rawUrl, expected := range urls {
+		parsed, err := ParseRepositoryUrl(rawUrl)
+		if err != nil {
+			t.Error("It should parse "+rawUrl+" but got: ", err.Error())
+		}
+		if parsed != expected {
+			t.Error("Expected ", expected, " for "+rawUrl+" but got: ", parsed)
+		}
+	}
+}
+
+func TestParseRepositoryUrlWhenInvalid(t *testing.T) {
+	for _, rawUrl := range []string{"", "git@:katana.git", "ssh:///katana.git"} {
+		if _, err := ParseRepositoryUrl(rawUrl); err == nil {
+			t.Error("It should return an error for " + rawUrl)
+		}
+	}
+}
+
+func TestClassifyRepositoryAccessError(t *testing.T) {
+	outputs := map[string]int{
+		"ssh: Could not resolve hostname nope.invalid: Name or service not known\nfatal: Could not read from remote repository.": REPOSITORY_HOST_UNREACHABLE,
+		"ssh: connect to host git.example.com port 2222: Connection refused":                                                     REPOSITORY_HOST_UNREACHABLE,
+		"Host key verification failed.\nfatal: Could not read from remote repository.":                                           REPOSITORY_HOST_KEY_REJECTED,
+		"git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.":                          REPOSITORY_AUTH_DENIED,
+		"fatal: Authentication failed for 'https://github.com/ispyropoulos/katana.git/'":                                         REPOSITORY_AUTH_DENIED,
+		"ERROR: Repository not found.\nfatal: Could not read from remote repository.":                                            REPOSITORY_NOT_FOUND,
+		"fatal: '/srv/katana.git' does not appear to be a git repository":                                                        REPOSITORY_NOT_FOUND,
+		"remote: Repository not found.\nfatal: repository 'https://github.com/ispyropoulos/katana.git/' not found":               REPOSITORY_NOT_FOUND,
+		"repository not found": REPOSITORY_NOT_FOUND,
+		"git@github.com: Permission denied (publickey).\nERROR: Repository not found.": REPOSITORY_AUTH_DENIED,
+		"sh: 1: ssh: command not found\nfatal: Could not read from remote repository.": REPOSITORY_ACCESS_UNKNOWN_ERROR,
+		"fatal: something unexpected": REPOSITORY_ACCESS_UNKNOWN_ERROR,
+	}
+
+	for output, expected := range outputs {
+		if kind := ClassifyRepositoryAccessError(output); kind != expected {
+			t.Error("Expected ", expected, " for "+output+" but got: ", kind)
+		}
+	}
+}
+
+func TestCheckRepositoryAccessWhenRepositoryIsMissing(t *testing.T) {
+	project := Project{repositoryUrl: "file:///nonexistent/testributor/katana.git"}
+
+	err := project.CheckRepositoryAccess(Logger{prefix: "test", writer: ioutil.Discard})
+	accessErr, ok := err.(*RepositoryAccessError)
+	if !ok || accessErr.Kind != REPOSITORY_NOT_FOUND {
+		t.Error("It should return a REPOSITORY_NOT_FOUND error but got: ", err)
+	}
+}
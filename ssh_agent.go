@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+)
+
+const (
+	SSH_AGENT_SOCKET_NAME = "testributor_agent.sock"
+
+	// Values accepted by TESTRIBUTOR_SSH_AGENT. When empty, the private key is
+	// written to disk (in the project's private SSH directory).
+	// "builtin" serves the key from an ssh-agent running inside the agent process.
+	// "external" adds the key to the ssh-agent found in SSH_AUTH_SOCK.
+	SSH_AGENT_MODE_NONE     = ""
+	SSH_AGENT_MODE_BUILTIN  = "builtin"
+	SSH_AGENT_MODE_EXTERNAL = "external"
+)
+
+// SshAgent holds the project's private key in memory and makes it available
+// to ssh through an ssh-agent socket (SSH_AUTH_SOCK) so the key never needs
+// to be written to disk.
+type SshAgent struct {
+	socket    string
+	listener  net.Listener        // Only set for the builtin agent
+	client    agent.ExtendedAgent // Only set for an external agent
+	conn      net.Conn            // The connection of the client
+	publicKey ssh.PublicKey
+}
+
+// SshAgentMode returns the ssh-agent mode selected with the ssh_agent setting.
+func SshAgentMode(config *Config) (string, error) {
+	switch value := config.SshAgent; value {
+	case SSH_AGENT_MODE_NONE, SSH_AGENT_MODE_BUILTIN, SSH_AGENT_MODE_EXTERNAL:
+		return value, nil
+	default:
+		return "", errors.New("Invalid ssh_agent: " + value +
+			". Use \"" + SSH_AGENT_MODE_BUILTIN + "\" or \"" + SSH_AGENT_MODE_EXTERNAL + "\".")
+	}
+}
+
+// StartSshAgent starts an ssh-agent listening on socket which serves only
+// the given private key.
+func StartSshAgent(socket string, privateKey []byte, logger Logger) (*SshAgent, error) {
+	key, publicKey, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := agent.NewKeyring()
+	if err = keyring.Add(agent.AddedKey{PrivateKey: key, Comment: "testributor"}); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// The listener was closed (see Stop)
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	logger.Log("Started ssh-agent on " + socket)
+
+	return &SshAgent{socket: socket, listener: listener, publicKey: publicKey}, nil
+}
+
+// ConnectSshAgent adds the private key to the already running ssh-agent
+// listening on socket. The key is removed again when the SshAgent is stopped.
+func ConnectSshAgent(socket string, privateKey []byte, logger Logger) (*SshAgent, error) {
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set. Start an ssh-agent or use " +
+			"TESTRIBUTOR_SSH_AGENT=" + SSH_AGENT_MODE_BUILTIN + ".")
+	}
+
+	key, publicKey, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	client := agent.NewClient(conn)
+	if err = client.Add(agent.AddedKey{PrivateKey: key, Comment: "testributor"}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	logger.Log("Added the project's key to the ssh-agent on " + socket)
+
+	return &SshAgent{socket: socket, client: client, conn: conn, publicKey: publicKey}, nil
+}
+
+// AuthorizedKey returns the agent's public key in authorized_keys format.
+// We pass this to ssh with -i to make it pick our key from the agent.
+func (a *SshAgent) AuthorizedKey() []byte {
+	return ssh.MarshalAuthorizedKey(a.publicKey)
+}
+
+// Stop stops the builtin agent or removes our key from the external one.
+func (a *SshAgent) Stop(logger Logger) {
+	if a.listener != nil {
+		a.listener.Close()
+		logger.Log("Stopped ssh-agent on " + a.socket)
+	}
+
+	if a.client != nil {
+		if err := a.client.Remove(a.publicKey); err != nil {
+			logger.Warn("Couldn't remove the project's key from the ssh-agent: " + err.Error())
+		} else {
+			logger.Log("Removed the project's key from the ssh-agent on " + a.socket)
+		}
+		a.conn.Close()
+	}
+}
+
+func parsePrivateKey(privateKey []byte) (interface{}, ssh.PublicKey, error) {
+	key, err := ssh.ParseRawPrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, errors.New("Couldn't parse the project's private SSH key: " + err.Error())
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, signer.PublicKey(), nil
+}
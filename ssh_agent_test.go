@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func generatePrivateKey(t *testing.T) []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+}
+
+func listAgentKeys(t *testing.T, socket string) []*agent.Key {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	return keys
+}
+
+func TestStartSshAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_ssh_agent")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+
+	sshAgent, err := StartSshAgent(filepath.Join(dir, SSH_AGENT_SOCKET_NAME), generatePrivateKey(t), logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer sshAgent.Stop(logger)
+
+	keys := listAgentKeys(t, sshAgent.socket)
+	if len(keys) != 1 || !bytes.Equal(keys[0].Marshal(), sshAgent.publicKey.Marshal()) {
+		t.Error("The agent should serve the project's key but got: ", keys)
+	}
+}
+
+func TestConnectSshAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_ssh_agent")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	logger := Logger{prefix: "test", writer: ioutil.Discard}
+
+	// Use a builtin agent with an other key as the "external" one
+	external, err := StartSshAgent(filepath.Join(dir, SSH_AGENT_SOCKET_NAME), generatePrivateKey(t), logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer external.Stop(logger)
+
+	sshAgent, err := ConnectSshAgent(external.socket, generatePrivateKey(t), logger)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if keys := listAgentKeys(t, external.socket); len(keys) != 2 {
+		t.Error("It should add the project's key to the agent but got: ", keys)
+	}
+
+	sshAgent.Stop(logger)
+	if keys := listAgentKeys(t, external.socket); len(keys) != 1 {
+		t.Error("It should remove the project's key from the agent when stopped but got: ", keys)
+	}
+	if _, err := sshAgent.conn.Write([]byte{0}); err == nil {
+		t.Error("It should close the connection to the agent when stopped")
+	}
+}
+
+func TestSshAgentMode(t *testing.T) {
+	config := DefaultConfig()
+
+	config.SshAgent = "builtin"
+	if mode, err := SshAgentMode(config); err != nil || mode != SSH_AGENT_MODE_BUILTIN {
+		t.Error("It should return the builtin mode but got: ", mode, err)
+	}
+
+	config.SshAgent = "sometimes"
+	if _, err := SshAgentMode(config); err == nil {
+		t.Error("It should return an error for unknown modes")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	STATUS_PATH = "/status"
+	// How many of the latest cancelled test runs the status shows
+	MAX_CANCELLED_TEST_RUNS_IN_STATUS = 20
+	// How long we wait for the Manager and the Reporter to answer
+	STATUS_TIMEOUT_SECONDS = 5
+)
+
+// StatusAddress returns the address the status API listens on, set with the
+// status_address setting. The API is off by default (an empty address or
+// "off") so the agents on a machine don't compete for a port. A port of 0
+// picks a free one (the agent logs it).
+func StatusAddress(config *Config) string {
+	if address := config.StatusAddress; address != "off" {
+		return address
+	}
+
+	return ""
+}
+
+// QueuedJobStatus describes a job in the Manager's queue or the job the worker
+// is running. EstimatedSeconds is our estimate (see WorkloadModel.JobSeconds).
+// Predicted is true when Testributor sent a prediction for the job.
+type QueuedJobStatus struct {
+	Id               int     `json:"id"`
+	TestRunId        int     `json:"test_run_id"`
+	Command          string  `json:"command"`
+	EstimatedSeconds float64 `json:"estimated_seconds"`
+	Predicted        bool    `json:"predicted"`
+	// Only set for the current job
+	ElapsedSeconds float64 `json:"elapsed_seconds,omitempty"`
+	LogPath        string  `json:"log_path,omitempty"` // See JobLogs
+}
+
+type ManagerStatus struct {
+	JobOrder            string            `json:"job_order"`
+	CurrentJob          *QueuedJobStatus  `json:"current_job"`
+	Queue               []QueuedJobStatus `json:"queue"`
+	QueueSeconds        float64           `json:"queue_seconds"`
+	CancelledTestRunIds []int             `json:"cancelled_test_run_ids"`
+}
+
+type ReporterStatus struct {
+	LastServerCommunication *time.Time `json:"last_server_communication"`
+	ActiveSenders           int        `json:"active_senders"`
+	PendingReports          int        `json:"pending_reports"`
+}
+
+// AgentStatus is what the status API returns.
+type AgentStatus struct {
+	WorkerUUID string         `json:"worker_uuid"`
+	Time       time.Time      `json:"time"`
+	Manager    ManagerStatus  `json:"manager"`
+	Reporter   ReporterStatus `json:"reporter"`
+}
+
+func (m *Manager) jobStatus(job TestJob) QueuedJobStatus {
+	return QueuedJobStatus{
+		Id:               job.Id,
+		TestRunId:        job.TestRunId,
+		Command:          job.Command,
+		EstimatedSeconds: m.workload.JobSeconds(job),
+		Predicted:        job.CostPredictionSeconds != NO_PREDICTION_WORKLOAD_SECONDS,
+	}
+}
+
+// Status returns the queue and the job the worker is running. It should only
+// be called from the Manager's loop (see statusRequestsChan).
+func (m *Manager) Status() ManagerStatus {
+	status := ManagerStatus{
+		JobOrder:            m.jobOrder,
+		Queue:               []QueuedJobStatus{},
+		CancelledTestRunIds: append([]int{}, m.cancelledTestRunIds...),
+	}
+
+	if m.workerCurrentJob != nil {
+		current := m.jobStatus(*m.workerCurrentJob)
+		current.ElapsedSeconds = time.Since(m.workerCurrentJobStartedAt).Seconds()
+		current.LogPath = m.jobLogs.Path(current.TestRunId, current.Id)
+		status.CurrentJob = &current
+	}
+	for _, job := range m.jobs {
+		jobStatus := m.jobStatus(job)
+		status.Queue = append(status.Queue, jobStatus)
+		status.QueueSeconds += jobStatus.EstimatedSeconds
+	}
+
+	return status
+}
+
+// Status returns the state of the reports. It should only be called from the
+// Reporter's loop (see statusRequestsChan).
+func (r *Reporter) Status() ReporterStatus {
+	status := ReporterStatus{ActiveSenders: r.activeSenders, PendingReports: len(r.reports)}
+	if !r.lastServerCommunication.IsZero() {
+		lastServerCommunication := r.lastServerCommunication
+		status.LastServerCommunication = &lastServerCommunication
+	}
+
+	return status
+}
+
+// StatusServer serves the agent's status over HTTP.
+type StatusServer struct {
+	listener                   net.Listener
+	managerStatusRequestsChan  chan chan ManagerStatus
+	reporterStatusRequestsChan chan chan ReporterStatus
+	mux                        *http.ServeMux
+}
+
+// StartStatusServer starts serving the status on address. When serveMetrics
+// is true, the metrics are served too (see METRICS_PATH).
+func StartStatusServer(address string, manager *Manager, reporter *Reporter, serveMetrics bool) (*StatusServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &StatusServer{
+		listener:                   listener,
+		managerStatusRequestsChan:  manager.statusRequestsChan,
+		reporterStatusRequestsChan: reporter.statusRequestsChan,
+		mux:                        http.NewServeMux(),
+	}
+	server.mux.HandleFunc(STATUS_PATH, server.serveStatus)
+	if serveMetrics {
+		server.mux.Handle(METRICS_PATH, metrics)
+	}
+	go http.Serve(listener, server.mux)
+
+	return server, nil
+}
+
+// Address returns the address the server listens on.
+func (s *StatusServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *StatusServer) Close() error {
+	return s.listener.Close()
+}
+
+// Status asks the Manager and the Reporter for their status.
+func (s *StatusServer) Status() (AgentStatus, error) {
+	status := AgentStatus{WorkerUUID: WorkerUUID, Time: time.Now()}
+	timeout := time.After(STATUS_TIMEOUT_SECONDS * time.Second)
+
+	managerReply := make(chan ManagerStatus, 1)
+	select {
+	case s.managerStatusRequestsChan <- managerReply:
+		status.Manager = <-managerReply
+	case <-timeout:
+		return status, errors.New("The Manager didn't respond")
+	}
+
+	reporterReply := make(chan ReporterStatus, 1)
+	select {
+	case s.reporterStatusRequestsChan <- reporterReply:
+		status.Reporter = <-reporterReply
+	case <-timeout:
+		return status, errors.New("The Reporter didn't respond")
+	}
+
+	return status, nil
+}
+
+func (s *StatusServer) serveStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.Status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// RunStatusCommand implements the "status" subcommand which prints the status
+// of a running agent. It returns the exit code.
+func RunStatusCommand(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	flags.SetOutput(out)
+	// The agent's address as set in its config (the validation doesn't matter)
+	config, _ := LoadConfig(nil, ioutil.Discard)
+	address := flags.String("address", StatusAddress(config), "the address of the agent's status API")
+	printJson := flags.Bool("json", false, "print the status as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *address == "" {
+		fmt.Fprintln(out, "The status API is off. Give the address the agent serves it on with -address "+
+			"(see status_address).")
+		return 1
+	}
+
+	client := http.Client{Timeout: 2 * STATUS_TIMEOUT_SECONDS * time.Second}
+	resp, err := client.Get("http://" + *address + STATUS_PATH)
+	if err != nil {
+		fmt.Fprintln(out, "Couldn't connect to the agent on "+*address+": "+err.Error())
+		return 1
+	}
+	defer resp.Body.Close()
+	contents, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(out, "The agent on "+*address+" couldn't report its status: "+strings.TrimSpace(string(contents)))
+		return 1
+	}
+
+	if *printJson {
+		out.Write(contents)
+		return 0
+	}
+
+	var status AgentStatus
+	if err = json.Unmarshal(contents, &status); err != nil {
+		fmt.Fprintln(out, "Couldn't read the status: "+err.Error())
+		return 1
+	}
+	PrintStatus(status, out)
+
+	return 0
+}
+
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 1, 64) + "s"
+}
+
+func formatJobStatus(job QueuedJobStatus) string {
+	estimate := formatSeconds(job.EstimatedSeconds)
+	if !job.Predicted {
+		estimate += " (estimated)"
+	}
+
+	return "#" + strconv.Itoa(job.Id) + " (test run " + strconv.Itoa(job.TestRunId) + ") " + job.Command +
+		", " + estimate
+}
+
+// PrintStatus writes the status in a human readable form.
+func PrintStatus(status AgentStatus, out io.Writer) {
+	fmt.Fprintln(out, "Worker:      "+status.WorkerUUID)
+
+	if job := status.Manager.CurrentJob; job != nil {
+		fmt.Fprintln(out, "Running:     "+formatJobStatus(*job)+", running for "+formatSeconds(job.ElapsedSeconds))
+		if job.LogPath != "" {
+			fmt.Fprintln(out, "Log:         "+job.LogPath)
+		}
+	} else {
+		fmt.Fprintln(out, "Running:     nothing")
+	}
+
+	fmt.Fprintln(out, "Queue:       "+strconv.Itoa(len(status.Manager.Queue))+" jobs, "+
+		formatSeconds(status.Manager.QueueSeconds)+" ("+status.Manager.JobOrder+")")
+	for _, job := range status.Manager.Queue {
+		fmt.Fprintln(out, "  "+formatJobStatus(job))
+	}
+
+	lastServerCommunication := "never"
+	if status.Reporter.LastServerCommunication != nil {
+		lastServerCommunication = formatSeconds(status.Time.Sub(*status.Reporter.LastServerCommunication).Seconds()) + " ago"
+	}
+	fmt.Fprintln(out, "Testributor: last contacted "+lastServerCommunication+", "+
+		strconv.Itoa(status.Reporter.PendingReports)+" reports pending, "+
+		strconv.Itoa(status.Reporter.ActiveSenders)+" being sent")
+
+	if len(status.Manager.CancelledTestRunIds) > 0 {
+		ids := []string{}
+		for _, id := range status.Manager.CancelledTestRunIds {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		fmt.Fprintln(out, "Cancelled:   test runs "+strings.Join(ids, ", "))
+	}
+}
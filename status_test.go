@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusAddress(t *testing.T) {
+	config := DefaultConfig()
+	for value, expected := range map[string]string{
+		"":               "",
+		"off":            "",
+		"127.0.0.1:0":    "127.0.0.1:0",
+		"0.0.0.0:9000":   "0.0.0.0:9000",
+		"localhost:8000": "localhost:8000",
+	} {
+		config.StatusAddress = value
+		if address := StatusAddress(config); address != expected {
+			t.Error("Expected", expected, "for", value, "but got:", address)
+		}
+	}
+
+	defer setConfigEnv(map[string]string{"TESTRIBUTOR_CONFIG": os.DevNull})()
+	var out bytes.Buffer
+	if code := RunStatusCommand(nil, &out); code != 1 || !strings.Contains(out.String(), "The status API is off") {
+		t.Error("Expected the status command to need an address but got:", code, out.String())
+	}
+}
+
+func TestManagerStatus(t *testing.T) {
+	manager := Manager{
+		logger:   Logger{prefix: "", writer: ioutil.Discard},
+		jobOrder: JOB_ORDER_FIFO,
+		jobs: []TestJob{
+			TestJob{Id: 1, TestRunId: 5, Command: "bin/rspec a", CostPredictionSeconds: 3},
+			TestJob{Id: 2, TestRunId: 5, Command: "bin/rspec b", CostPredictionSeconds: 4},
+			TestJob{Id: 3, TestRunId: 5, Command: "bin/rspec c", CostPredictionSeconds: NO_PREDICTION_WORKLOAD_SECONDS},
+		},
+	}
+
+	status := manager.Status()
+	if status.CurrentJob != nil {
+		t.Error("Expected no current job but got:", status.CurrentJob)
+	}
+
+	manager.AssignJobToWorker()
+	manager.workerCurrentJobStartedAt = time.Now().Add(-2 * time.Second)
+	manager.CancelTestRuns([]int{4})
+	manager.jobs = append(manager.jobs, TestJob{Id: 4, TestRunId: 4})
+	manager.CancelTestRuns([]int{4})
+
+	status = manager.Status()
+	if job := status.CurrentJob; job == nil || job.Id != 1 || job.EstimatedSeconds != 3 || !job.Predicted ||
+		job.ElapsedSeconds < 2 || job.LogPath != "" {
+		t.Error("Expected job 1 to be running for 2 seconds but got:", job)
+	}
+	manager.jobLogs = &JobLogs{directory: filepath.Join("project", JOB_LOGS_DIRECTORY)}
+	if job := manager.Status().CurrentJob; job.LogPath != filepath.Join("project", JOB_LOGS_DIRECTORY, "5", "1.log") {
+		t.Error("Expected the path of job 1's log but got:", job.LogPath)
+	}
+	expectedQueue := []QueuedJobStatus{
+		QueuedJobStatus{Id: 2, TestRunId: 5, Command: "bin/rspec b", EstimatedSeconds: 4, Predicted: true},
+		QueuedJobStatus{Id: 3, TestRunId: 5, Command: "bin/rspec c", EstimatedSeconds: UNKNOWN_JOB_WORKLOAD_SECONDS},
+	}
+	if !reflect.DeepEqual(status.Queue, expectedQueue) || status.QueueSeconds != 4+UNKNOWN_JOB_WORKLOAD_SECONDS {
+		t.Error("Expected the queue to be", expectedQueue, "but got:", status.Queue, status.QueueSeconds)
+	}
+	if !reflect.DeepEqual(status.CancelledTestRunIds, []int{4}) {
+		t.Error("Expected test run 4 to be cancelled but got:", status.CancelledTestRunIds)
+	}
+
+	manager.workerIdlingChannel = make(chan *TestJob)
+	go func() { manager.workerIdlingChannel <- &TestJob{Id: 1} }()
+	manager.ParseChannels()
+	if status = manager.Status(); status.CurrentJob != nil {
+		t.Error("Expected no current job after the worker finished but got:", status.CurrentJob)
+	}
+}
+
+func TestStatusServer(t *testing.T) {
+	defer func(uuid string) { WorkerUUID = uuid }(WorkerUUID)
+	WorkerUUID = "3fd7c48e-1b8a-4f37-9d0c-2a5f4c1e8b6d"
+
+	manager := &Manager{
+		jobOrder:            JOB_ORDER_LONGEST_FIRST,
+		jobs:                []TestJob{TestJob{Id: 2, TestRunId: 5, Command: "bin/rspec b", CostPredictionSeconds: 4}},
+		statusRequestsChan:  make(chan chan ManagerStatus),
+		cancelledTestRunIds: []int{3},
+	}
+	lastServerCommunication := time.Now().Add(-3 * time.Second)
+	reporter := &Reporter{
+		statusRequestsChan:      make(chan chan ReporterStatus),
+		lastServerCommunication: lastServerCommunication,
+		reports:                 []TestJob{TestJob{Id: 1}},
+		activeSenders:           1,
+	}
+
+	server, err := StartStatusServer("127.0.0.1:0", manager, reporter, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// The Manager and the Reporter answer from their loops
+	go func() {
+		for i := 0; i < 2; i++ {
+			manager.ParseChannels()
+		}
+	}()
+	go func() {
+		for i := 0; i < 2; i++ {
+			reporter.ParseChannels()
+		}
+	}()
+
+	var out bytes.Buffer
+	if code := RunStatusCommand([]string{"-address", server.Address(), "-json"}, &out); code != 0 {
+		t.Fatal("Expected the status but got:", out.String())
+	}
+	var status AgentStatus
+	if err := json.Unmarshal(out.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.WorkerUUID != WorkerUUID || len(status.Manager.Queue) != 1 || status.Reporter.ActiveSenders != 1 ||
+		status.Reporter.PendingReports != 1 || status.Reporter.LastServerCommunication == nil {
+		t.Error("Unexpected status:", out.String())
+	}
+
+	out.Reset()
+	if code := RunStatusCommand([]string{"-address", server.Address()}, &out); code != 0 {
+		t.Fatal("Expected the status but got:", out.String())
+	}
+	for _, expected := range []string{
+		"Worker:      " + WorkerUUID,
+		"Running:     nothing",
+		"Queue:       1 jobs, 4.0s (longest_first)",
+		"  #2 (test run 5) bin/rspec b, 4.0s",
+		"Testributor: last contacted 3.",
+		"1 reports pending, 1 being sent",
+		"Cancelled:   test runs 3",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Error("Expected the status to contain", expected, "but got:", out.String())
+		}
+	}
+}
+
+func TestRunStatusCommandWithoutAgent(t *testing.T) {
+	var out bytes.Buffer
+	if code := RunStatusCommand([]string{"-address", "127.0.0.1:1"}, &out); code != 1 ||
+		!strings.Contains(out.String(), "Couldn't connect to the agent on 127.0.0.1:1") {
+		t.Error("Expected an error but got:", code, out.String())
+	}
+}
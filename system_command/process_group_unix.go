@@ -0,0 +1,21 @@
+//go:build !windows
+
+package system_command
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the command the leader of a new process group so we
+// can kill it along with the processes it starts.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		// A negative pid means the whole process group
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -2,8 +2,10 @@ package system_command
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"runtime"
 	"strings"
@@ -37,8 +39,34 @@ type CommandResult struct {
 // struct (which formats the output) and ioutil.Discard when we don't want to
 // print the output.
 func Run(command string, logger io.Writer) (CommandResult, error) {
+	return RunWithEnv(command, nil, logger)
+}
+
+// RunWithEnv is like Run but the command also gets the variables in env
+// (in "KEY=value" form) on top of the current process' environment. This
+// allows passing variables to a single command without leaking them to every
+// other command we run.
+func RunWithEnv(command string, env []string, logger io.Writer) (CommandResult, error) {
+	return RunWithContext(context.Background(), command, env, logger)
+}
+
+// RunWithContext is like RunWithEnv but the command (along with any processes
+// it started) is killed when ctx is done.
+func RunWithContext(ctx context.Context, command string, env []string, logger io.Writer) (CommandResult, error) {
+	return RunWithInput(ctx, command, env, nil, logger)
+}
+
+// RunWithInput is like RunWithContext but the command reads input from its
+// standard input (nil means no input). Unlike the command line, the input is
+// not visible to other users.
+func RunWithInput(ctx context.Context, command string, env []string, input io.Reader, logger io.Writer) (CommandResult, error) {
 	commandStart := time.Now()
 	cmd := GenerateCommandForCurrentOS(command)
+	setProcessGroup(cmd)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdin = input
 
 	errPipe, err := cmd.StderrPipe()
 	if err != nil {
@@ -71,7 +99,19 @@ func Run(command string, logger io.Writer) (CommandResult, error) {
 		}, startErr
 	}
 
+	// Kill the command when the context is done
+	commandDone := make(chan struct{})
+	defer close(commandDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-commandDone:
+		}
+	}()
+
 	// Capture the combined output too
+	combinedDone := make(chan bool)
 	go func(result *string) {
 		for {
 			newString, more := <-combinedOutputChannel
@@ -80,6 +120,7 @@ func Run(command string, logger io.Writer) (CommandResult, error) {
 				break
 			}
 		}
+		combinedDone <- true
 	}(&combined)
 
 	go ReadUntilEOF(outPipe, &output, outputDone, combinedOutputChannel, logger)
@@ -99,6 +140,7 @@ func Run(command string, logger io.Writer) (CommandResult, error) {
 	_ = <-errorsDone
 
 	close(combinedOutputChannel) // Nothing more to read. Let the reading go routine exit.
+	<-combinedDone
 
 	waitResult := cmd.Wait()
 
@@ -116,22 +158,11 @@ func Run(command string, logger io.Writer) (CommandResult, error) {
 		}
 	}
 
-	// TODO: This doesn't seem to work correctly. We get errors with a status FAILED.
-	var resultType int
-	switch {
-	case waitResult == nil:
-		resultType = RESULT_TYPES["passed"]
-	case strings.TrimSpace(errors) == "":
-		resultType = RESULT_TYPES["failed"]
-	default:
-		resultType = RESULT_TYPES["error"]
-	}
-
 	return CommandResult{
 		Output:          output,
 		Errors:          errors,
 		CombinedOutput:  combined,
-		ResultType:      resultType,
+		ResultType:      ResultType(waitResult == nil, errors),
 		Success:         (waitResult == nil),
 		CommandErr:      waitResult,
 		ExitCode:        exitCode,
@@ -139,6 +170,20 @@ func Run(command string, logger io.Writer) (CommandResult, error) {
 	}, nil
 }
 
+// ResultType returns the result type (see RESULT_TYPES) of a command which
+// succeeded or not and printed errors to stderr.
+// TODO: This doesn't seem to work correctly. We get errors with a status FAILED.
+func ResultType(success bool, errors string) int {
+	switch {
+	case success:
+		return RESULT_TYPES["passed"]
+	case strings.TrimSpace(errors) == "":
+		return RESULT_TYPES["failed"]
+	default:
+		return RESULT_TYPES["error"]
+	}
+}
+
 // Reads from stream until EOF. The result is written on outVar.
 // When EOF is reached, true is sent on doneChannel.
 // To be used as a go routine.
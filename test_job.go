@@ -2,6 +2,7 @@ package main
 
 import (
 	"github.com/testributor/agent/system_command"
+	"io"
 	"strconv"
 	"time"
 )
@@ -22,8 +23,12 @@ type TestJob struct {
 	TestRunId                  int       `json:"test_run_id"`
 	WorkerInQueueSeconds       int64     `json:"worker_in_queue_seconds"`
 	WorkerCommandRunSeconds    int64     `json:"worker_command_run_seconds"`
+	DurationP50Seconds         float64   `json:"duration_p50_seconds,omitempty"` // From the DurationHistory
+	DurationP95Seconds         float64   `json:"duration_p95_seconds,omitempty"`
 	QueuedAtSecondsSinceEpoch  int64
+	RunSeconds                 float64 `json:"-"` // Not rounded like WorkerCommandRunSeconds
 	CommitSha                  string
+	span                       *Span // The job's trace. It ends when the job is reported.
 }
 
 // This is a custom type based on the type return my APIClient's FetchJobs
@@ -56,8 +61,8 @@ func (builder *TestJobBuilder) costPredictionSeconds() float64 {
 			panic("Invalid format for cost prediction: " + err.Error())
 		}
 
-		// If no prediction is available use the default "huge" value to avoid
-		// fetching more jobs.
+		// If no prediction is available use the default "huge" value. The
+		// Manager estimates these jobs itself (see WorkloadModel.JobSeconds).
 		if costPredictionSeconds == 0 {
 			return NO_PREDICTION_WORKLOAD_SECONDS
 		} else {
@@ -102,12 +107,32 @@ func NewTestJob(jobData map[string]interface{}) TestJob {
 	return testJob
 }
 
-func (testJob *TestJob) Run(logger Logger) {
+// startSpan starts the job's span (see TestJob.span) as a child of the fetch
+// that brought it.
+func (testJob *TestJob) startSpan(fetchSpan *Span) {
+	testJob.span = StartSpan("TestJob", fetchSpan)
+	testJob.span.SetAttribute("testributor.job.id", testJob.Id)
+	testJob.span.SetAttribute("testributor.test_run.id", testJob.TestRunId)
+	testJob.span.SetAttribute("testributor.command", testJob.Command)
+	testJob.span.SetAttribute("testributor.commit_sha", testJob.CommitSha)
+}
+
+// Run runs the job's command with run (e.g. Project.RunCommand). The output is
+// also written to logFile unless it is nil (see JobLogs).
+func (testJob *TestJob) Run(run CommandRunner, logger Logger, logFile io.Writer) {
 	testJob.StartedAtSecondsSinceEpoch = time.Now().Unix()
 
 	logger.Log("Running " + testJob.Command)
 
-	res, err := system_command.Run(testJob.Command, logger)
+	output := io.Writer(logger)
+	if logFile != nil {
+		output = &jobLogWriter{logger: logger, file: logFile}
+	}
+	span := StartSpan("TestJob.Run", testJob.span)
+	res, err := run(testJob.Command, nil, output)
+	span.SetError(err)
+	span.SetAttribute("testributor.job.success", res.Success)
+	span.End()
 
 	if err != nil {
 		testJob.Result = err.Error()
@@ -119,5 +144,6 @@ func (testJob *TestJob) Run(logger Logger) {
 
 	testJob.WorkerInQueueSeconds =
 		testJob.StartedAtSecondsSinceEpoch - testJob.QueuedAtSecondsSinceEpoch
+	testJob.RunSeconds = res.DurationSeconds
 	testJob.WorkerCommandRunSeconds = int64(res.DurationSeconds)
 }
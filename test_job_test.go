@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"github.com/testributor/agent/system_command"
 	"io/ioutil"
 	"strconv"
 	"testing"
@@ -115,7 +116,7 @@ func TestRunSettingWorkerInQueueSeconds(t *testing.T) {
 		Command:                   "ls",
 		QueuedAtSecondsSinceEpoch: time.Now().Unix() - 2,
 	}
-	testJob.Run(Logger{"test", ioutil.Discard})
+	testJob.Run(system_command.RunWithEnv, Logger{prefix: "test", writer: ioutil.Discard}, nil)
 
 	// Calling Run should only take some milliseconds so rounded it should be 2 seconds.
 	if testJob.WorkerInQueueSeconds != 2 {
@@ -132,7 +133,7 @@ func TestRunSettingWorkerCommandRunSeconds(t *testing.T) {
 		Command:                   "sleep 1",
 		QueuedAtSecondsSinceEpoch: time.Now().Unix() - 2,
 	}
-	testJob.Run(Logger{"test", ioutil.Discard})
+	testJob.Run(system_command.RunWithEnv, Logger{prefix: "test", writer: ioutil.Discard}, nil)
 
 	// Calling Run should only take some milliseconds so rounded it should be 1 seconds.
 	if testJob.WorkerCommandRunSeconds != 1 {
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The OTLP/HTTP path of the traces (appended to the collector's address)
+	OTLP_TRACES_PATH = "/v1/traces"
+	// How often the finished spans are sent to the collector
+	TRACE_EXPORT_INTERVAL_SECONDS = 5
+	// Spans waiting to be sent. The oldest ones are dropped when the collector
+	// is unreachable for long.
+	MAX_PENDING_SPANS    = 4096
+	TRACING_SERVICE_NAME = "testributor-agent"
+
+	// https://opentelemetry.io/docs/specs/otlp/ (SpanKind and StatusCode)
+	SPAN_KIND_INTERNAL = 1
+	SPAN_KIND_CLIENT   = 3
+	SPAN_STATUS_ERROR  = 2
+)
+
+// The agent's tracer. It is nil (and no spans are recorded) unless a collector
+// is set with the tracing_endpoint setting.
+var tracer *Tracer
+
+// TracingEndpoint returns the URL the spans are sent to (OTLP over HTTP with
+// JSON). The collector's address (e.g. http://localhost:4318) is set with
+// the tracing_endpoint setting or the standard OTEL_EXPORTER_OTLP_ENDPOINT.
+// It returns an empty string when tracing is off.
+func TracingEndpoint(config *Config) (string, error) {
+	name := "tracing_endpoint"
+	endpoint := config.TracingEndpoint
+	if endpoint == "" {
+		name = "OTEL_EXPORTER_OTLP_ENDPOINT"
+		endpoint = os.Getenv(name)
+	}
+	if endpoint == "" {
+		return "", nil
+	}
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", errors.New("Invalid " + name + ": " + endpoint +
+			". Use the collector's address, e.g. http://localhost:4318.")
+	}
+
+	return strings.TrimSuffix(endpoint, "/") + OTLP_TRACES_PATH, nil
+}
+
+// Tracer keeps the finished spans and sends them to the collector.
+type Tracer struct {
+	endpoint string
+	client   http.Client
+	logger   Logger
+	mutex    sync.Mutex
+	spans    []*Span // Finished and not sent yet
+}
+
+func NewTracer(endpoint string, logger Logger) *Tracer {
+	return &Tracer{
+		endpoint: endpoint,
+		client:   http.Client{Timeout: TRACE_EXPORT_INTERVAL_SECONDS * time.Second},
+		logger:   logger,
+	}
+}
+
+// Start sends the finished spans every TRACE_EXPORT_INTERVAL_SECONDS.
+func (t *Tracer) Start() {
+	for range time.Tick(TRACE_EXPORT_INTERVAL_SECONDS * time.Second) {
+		if err := t.Export(); err != nil {
+			t.logger.Warn("Couldn't send the traces: " + err.Error())
+		}
+	}
+}
+
+func (t *Tracer) finish(span *Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.spans = append(t.spans, span)
+	if len(t.spans) > MAX_PENDING_SPANS {
+		t.spans = t.spans[len(t.spans)-MAX_PENDING_SPANS:]
+	}
+}
+
+// Export sends the finished spans to the collector. They are dropped if the
+// collector can't take them.
+func (t *Tracer) Export() error {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mutex.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(otlpTraces(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		contents, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("The collector responded with " + resp.Status + ": " + strings.TrimSpace(string(contents)))
+	}
+
+	return nil
+}
+
+// Span is a timed operation in a trace. All the methods work on a nil span
+// (nothing is recorded) so the code doesn't need to check if tracing is on.
+type Span struct {
+	tracer       *Tracer
+	traceId      [16]byte
+	spanId       [8]byte
+	parentSpanId [8]byte // Zero for the root span of a trace
+	name         string
+	kind         int
+	start        time.Time
+	mutex        sync.Mutex
+	end          time.Time
+	attributes   map[string]interface{}
+	err          string
+}
+
+// StartSpan starts a span now. See StartSpanAt.
+func StartSpan(name string, parent *Span) *Span {
+	return StartSpanAt(name, parent, time.Now())
+}
+
+// StartSpanAt starts a span which started at start. Without a parent the span
+// starts a new trace. It returns nil when tracing is off.
+func StartSpanAt(name string, parent *Span, start time.Time) *Span {
+	span := &Span{name: name, kind: SPAN_KIND_INTERNAL, start: start, attributes: make(map[string]interface{})}
+	if parent != nil {
+		span.tracer = parent.tracer
+		span.traceId = parent.traceId
+		span.parentSpanId = parent.spanId
+	} else if tracer != nil {
+		span.tracer = tracer
+		rand.Read(span.traceId[:])
+	} else {
+		return nil
+	}
+	rand.Read(span.spanId[:])
+
+	return span
+}
+
+// StartedAt returns when the span started (the zero time for a nil span).
+func (s *Span) StartedAt() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+
+	return s.start
+}
+
+// SetAttribute sets a string, int, float64 or bool attribute.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed. A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.err = err.Error()
+}
+
+// End finishes the span. Only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if !s.end.IsZero() {
+		s.mutex.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mutex.Unlock()
+
+	s.tracer.finish(s)
+}
+
+// Traceparent returns the W3C trace context header of the span.
+// https://www.w3.org/TR/trace-context/#traceparent-header
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+
+	return "00-" + hex.EncodeToString(s.traceId[:]) + "-" + hex.EncodeToString(s.spanId[:]) + "-01"
+}
+
+// trace runs f in a new span (a child of parent) which fails if f fails.
+func trace(name string, parent *Span, f func(span *Span) error) error {
+	span := StartSpan(name, parent)
+	err := f(span)
+	span.SetError(err)
+	span.End()
+
+	return err
+}
+
+// The OTLP/JSON request (only what we use).
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/examples/trace.json
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+func otlpAttributeValue(value interface{}) map[string]interface{} {
+	switch value := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": value}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": value}
+	case string:
+		return map[string]interface{}{"stringValue": value}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, otlpAttribute{Key: key, Value: otlpAttributeValue(attributes[key])})
+	}
+
+	return result
+}
+
+func otlpTraces(spans []*Span) map[string]interface{} {
+	exported := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mutex.Lock()
+		exportedSpan := otlpSpan{
+			TraceId:           hex.EncodeToString(span.traceId[:]),
+			SpanId:            hex.EncodeToString(span.spanId[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.attributes),
+		}
+		if span.parentSpanId != [8]byte{} {
+			exportedSpan.ParentSpanId = hex.EncodeToString(span.parentSpanId[:])
+		}
+		if span.err != "" {
+			exportedSpan.Status = otlpStatus{Code: SPAN_STATUS_ERROR, Message: span.err}
+		}
+		span.mutex.Unlock()
+		exported = append(exported, exportedSpan)
+	}
+
+	resource := map[string]interface{}{
+		"attributes": otlpAttributes(map[string]interface{}{
+			"service.name":        TRACING_SERVICE_NAME,
+			"service.instance.id": WorkerUUID,
+		}),
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": resource,
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": TRACING_SERVICE_NAME},
+						"spans": exported,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestTracingEndpoint(t *testing.T) {
+	defer os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	config := DefaultConfig()
+
+	for _, c := range []struct {
+		endpoint string
+		otel     string
+		expected string
+		valid    bool
+	}{
+		{"", "", "", true},
+		{"http://localhost:4318", "", "http://localhost:4318/v1/traces", true},
+		{"https://collector:4318/", "", "https://collector:4318/v1/traces", true},
+		{"", "http://otel:4318", "http://otel:4318/v1/traces", true},
+		{"http://localhost:4318", "http://otel:4318", "http://localhost:4318/v1/traces", true},
+		{"localhost:4318", "", "", false},
+	} {
+		config.TracingEndpoint = c.endpoint
+		os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", c.otel)
+		endpoint, err := TracingEndpoint(config)
+		if endpoint != c.expected || (err == nil) != c.valid {
+			t.Error("Expected", c.expected, "for", c.endpoint, c.otel, "but got:", endpoint, err)
+		}
+	}
+}
+
+func TestSpansWithoutTracer(t *testing.T) {
+	defer func(t *Tracer) { tracer = t }(tracer)
+	tracer = nil
+
+	span := StartSpan("Manager.FetchJobs", nil)
+	if span != nil || StartSpan("TestJob", span) != nil {
+		t.Error("Expected no spans when tracing is off")
+	}
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("failed"))
+	span.End()
+	if span.Traceparent() != "" || !span.StartedAt().IsZero() {
+		t.Error("Expected nothing from a nil span")
+	}
+}
+
+// otlpRequest is the part of an OTLP/JSON request the tests check.
+type otlpRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []otlpAttribute
+		}
+		ScopeSpans []struct {
+			Spans []otlpSpan
+		}
+	}
+}
+
+// startCollector returns a collector which sends the requests it gets to the
+// channel and makes it the agent's tracer.
+func startCollector(t *testing.T) (*httptest.Server, chan otlpRequest) {
+	requests := make(chan otlpRequest, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request otlpRequest
+		if r.URL.Path != OTLP_TRACES_PATH || r.Header.Get("Content-Type") != "application/json" ||
+			json.NewDecoder(r.Body).Decode(&request) != nil {
+			t.Error("Unexpected request to the collector:", r.URL.Path, r.Header)
+		}
+		requests <- request
+	}))
+	tracer = NewTracer(collector.URL+OTLP_TRACES_PATH, Logger{prefix: "", writer: ioutil.Discard})
+
+	return collector, requests
+}
+
+func spansByName(request otlpRequest) map[string]otlpSpan {
+	spans := make(map[string]otlpSpan)
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			for _, span := range scopeSpans.Spans {
+				spans[span.Name] = span
+			}
+		}
+	}
+
+	return spans
+}
+
+func TestTracerExport(t *testing.T) {
+	defer func(t *Tracer) { tracer = t }(tracer)
+	collector, requests := startCollector(t)
+	defer collector.Close()
+
+	fetch := StartSpan("Manager.FetchJobs", nil)
+	fetch.End()
+	job := TestJob{Id: 23, TestRunId: 12, Command: "bin/rspec"}
+	job.startSpan(fetch)
+	err := trace("Project.SetupTestEnvironment", job.span, func(span *Span) error {
+		return trace("git.fetch", span, func(*Span) error { return errors.New("No route to host") })
+	})
+	if err == nil || err.Error() != "No route to host" {
+		t.Error("Expected trace to return the error but got:", err)
+	}
+	job.span.End()
+	job.span.End() // Only the first End counts
+
+	if err := tracer.Export(); err != nil {
+		t.Fatal(err.Error())
+	}
+	request := <-requests
+	if attributes := request.ResourceSpans[0].Resource.Attributes; len(attributes) != 2 ||
+		attributes[0].Key != "service.instance.id" || attributes[1].Value["stringValue"] != TRACING_SERVICE_NAME {
+		t.Error("Expected the agent's service attributes but got:", attributes)
+	}
+
+	spans := spansByName(request)
+	if len(spans) != 4 {
+		t.Fatal("Expected 4 spans but got:", spans)
+	}
+	traceId := hex.EncodeToString(fetch.traceId[:])
+	for name, parent := range map[string]string{
+		"Manager.FetchJobs":            "",
+		"TestJob":                      "Manager.FetchJobs",
+		"Project.SetupTestEnvironment": "TestJob",
+		"git.fetch":                    "Project.SetupTestEnvironment",
+	} {
+		span := spans[name]
+		if span.TraceId != traceId || span.ParentSpanId != spans[parent].SpanId || span.Kind != SPAN_KIND_INTERNAL {
+			t.Error("Expected", name, "to be a child of", parent, "but got:", span)
+		}
+		if span.StartTimeUnixNano == "" || span.EndTimeUnixNano < span.StartTimeUnixNano {
+			t.Error("Expected", name, "to have its times but got:", span)
+		}
+	}
+	for _, name := range []string{"Project.SetupTestEnvironment", "git.fetch"} {
+		if status := spans[name].Status; status.Code != SPAN_STATUS_ERROR || status.Message != "No route to host" {
+			t.Error("Expected", name, "to have failed but got:", status)
+		}
+	}
+	if attributes := spans["TestJob"].Attributes; len(attributes) != 4 ||
+		attributes[0].Key != "testributor.command" || attributes[0].Value["stringValue"] != "bin/rspec" ||
+		attributes[2].Key != "testributor.job.id" || attributes[2].Value["intValue"] != "23" {
+		t.Error("Expected the job's attributes but got:", attributes)
+	}
+
+	// Nothing left to send
+	if err := tracer.Export(); err != nil || len(requests) > 0 {
+		t.Error("Expected no more requests to the collector")
+	}
+}
+
+func TestPerformRequestTraceparent(t *testing.T) {
+	defer func(t *Tracer) { tracer = t }(tracer)
+	collector, requests := startCollector(t)
+	defer collector.Close()
+
+	traceparents := make(chan string, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.Write([]byte("[]"))
+	}))
+	defer api.Close()
+
+	client := &APIClient{logger: Logger{prefix: "", writer: ioutil.Discard}, apiUrl: api.URL + "/"}
+	fetch := StartSpan("Manager.FetchJobs", nil)
+	if _, err := client.FetchJobs(fetch); err != nil {
+		t.Fatal(err.Error())
+	}
+	fetch.End()
+
+	traceparent := <-traceparents
+	traceId := hex.EncodeToString(fetch.traceId[:])
+	matches := regexp.MustCompile("^00-" + traceId + "-([0-9a-f]{16})-01$").FindStringSubmatch(traceparent)
+	if matches == nil {
+		t.Fatal("Expected a traceparent in the trace of the fetch but got:", traceparent)
+	}
+
+	tracer.Export()
+	span := spansByName(<-requests)["PATCH test_jobs/bind_next_batch"]
+	if span.SpanId != matches[1] || span.ParentSpanId != hex.EncodeToString(fetch.spanId[:]) ||
+		span.Kind != SPAN_KIND_CLIENT {
+		t.Error("Expected the request's span in the traceparent but got:", span, traceparent)
+	}
+
+	// Requests without a span aren't traced
+	if _, err := client.Beacon(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if traceparent = <-traceparents; traceparent != "" {
+		t.Error("Expected no traceparent but got:", traceparent)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// How long we wait for another agent to answer (it has to reassign the
+	// jobs on Testributor before it answers)
+	WORK_STEALING_TIMEOUT_SECONDS = 30
+	WORK_STEALING_SOCKET_SUFFIX   = ".sock"
+)
+
+// CoordinationDir returns the directory where the agents of the project that
+// run on this machine find each other. It can be set with the
+// coordination_dir setting. By default it is a directory in the temporary
+// directory named after the project's APP_ID so agents of different projects
+// never share jobs.
+func CoordinationDir(config *Config) string {
+	if config.CoordinationDir != "" {
+		return config.CoordinationDir
+	}
+
+	hash := sha1.Sum([]byte(config.TestributorUrl + config.AppId))
+
+	return filepath.Join(os.TempDir(), "testributor-"+hex.EncodeToString(hash[:])[:12])
+}
+
+// The messages exchanged over the socket
+type workStealingRequest struct {
+	WorkerUUID string `json:"worker_uuid"`
+}
+
+type workStealingResponse struct {
+	Jobs []TestJob `json:"jobs"`
+}
+
+// The agent taking the jobs confirms it got them
+type workStealingAck struct {
+	Received bool `json:"received"`
+}
+
+// WorkStealer lets the agents running on the same machine share their queued
+// jobs. Every agent listens on a unix socket in the coordination directory.
+// An agent with no jobs (even on Testributor) asks the others for some of the
+// jobs they haven't started. The agent giving the jobs away reassigns them
+// to the other one on Testributor first so the results are accepted from
+// their new worker. If the other agent doesn't confirm it got them, we take
+// them back. All the methods work on a nil WorkStealer (no jobs are shared).
+type WorkStealer struct {
+	dir               string
+	socket            string
+	listener          net.Listener
+	stealRequestsChan chan chan []TestJob // Asks the Manager for jobs to give away
+	newJobsChannel    chan []TestJob      // Gives jobs back to the Manager
+	client            *APIClient
+	logger            Logger
+}
+
+// StartWorkStealer starts listening for requests from the other agents in dir.
+// The directory has to be private to the agent's user (see checkPrivateDir)
+// since we run the jobs we get from the sockets in it.
+func StartWorkStealer(dir string, manager *Manager, logger Logger) (*WorkStealer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, errors.New("The coordination directory " + dir + " is not a directory (or it is a symlink).")
+	}
+	if err = checkPrivateDir(dir, info); err != nil {
+		return nil, err
+	}
+
+	socket := filepath.Join(dir, WorkerUUID+WORK_STEALING_SOCKET_SUFFIX)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	// Only the agent's user can take our jobs
+	if err = os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	stealer := &WorkStealer{
+		dir:               dir,
+		socket:            socket,
+		listener:          listener,
+		stealRequestsChan: manager.stealRequestsChan,
+		newJobsChannel:    manager.newJobsChannel,
+		client:            manager.client,
+		logger:            logger,
+	}
+	go stealer.serve()
+
+	return stealer, nil
+}
+
+// Close stops listening and removes the socket.
+func (s *WorkStealer) Close() error {
+	if s == nil {
+		return nil
+	}
+
+	return s.listener.Close()
+}
+
+func (s *WorkStealer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			// The listener was closed
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle gives some of the queued jobs to the agent on the other side of conn.
+func (s *WorkStealer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(WORK_STEALING_TIMEOUT_SECONDS * time.Second))
+
+	decoder := json.NewDecoder(conn)
+	var request workStealingRequest
+	if err := decoder.Decode(&request); err != nil || request.WorkerUUID == "" {
+		return
+	}
+
+	jobs, ok := s.requestJobs()
+	if !ok {
+		s.logger.Warn("The manager didn't answer the request of " + request.WorkerUUID + " in time")
+		return
+	}
+
+	given, kept, err := s.reassign(jobs, request.WorkerUUID)
+	if err != nil {
+		s.logger.Warn("Couldn't give jobs to " + request.WorkerUUID + ": " + err.Error())
+	}
+	s.giveBack(kept)
+
+	// Reassigning might have taken long. The other agent decides if it still
+	// wants the jobs.
+	conn.SetDeadline(time.Now().Add(WORK_STEALING_TIMEOUT_SECONDS * time.Second))
+	err = json.NewEncoder(conn).Encode(workStealingResponse{Jobs: given})
+	if len(given) == 0 {
+		return
+	}
+	var ack workStealingAck
+	if err == nil {
+		err = decoder.Decode(&ack)
+	}
+	if err == nil && !ack.Received {
+		err = errors.New("The jobs were refused.")
+	}
+	if err != nil {
+		// The other agent didn't get them (e.g. it stopped waiting). Take
+		// them back.
+		s.logger.Warn("Couldn't give the jobs to " + request.WorkerUUID + ": " + err.Error())
+		taken, _, err := s.reassign(given, WorkerUUID)
+		if err != nil {
+			s.logger.Warn("Couldn't take the jobs back: " + err.Error())
+		}
+		s.giveBack(taken)
+		return
+	}
+	s.logger.Log("Gave " + strconv.Itoa(len(given)) + " jobs to " + request.WorkerUUID)
+	for _, job := range given {
+		job.span.SetAttribute("testributor.job.given_to", request.WorkerUUID)
+		job.span.End()
+	}
+}
+
+// reassign assigns the jobs to the worker on Testributor. It returns the jobs
+// reassigned and the ones which weren't (e.g. Testributor cancelled them).
+func (s *WorkStealer) reassign(jobs []TestJob, workerUuid string) ([]TestJob, []TestJob, error) {
+	if len(jobs) == 0 {
+		return nil, nil, nil
+	}
+
+	ids := make([]int, 0, len(jobs))
+	for _, job := range jobs {
+		ids = append(ids, job.Id)
+	}
+	reassignedIds, err := s.client.ReassignTestJobs(ids, workerUuid)
+	if err != nil {
+		return nil, jobs, err
+	}
+
+	var reassigned, kept []TestJob
+	for _, job := range jobs {
+		if _, ok := reassignedIds[job.Id]; ok {
+			reassigned = append(reassigned, job)
+		} else {
+			kept = append(kept, job)
+		}
+	}
+
+	return reassigned, kept, nil
+}
+
+// giveBack puts the jobs back in the Manager's queue.
+// requestJobs asks the Manager for jobs to give away. ok is false when the
+// Manager doesn't answer within WORK_STEALING_TIMEOUT_SECONDS. Jobs it gives
+// after that are given back to it.
+func (s *WorkStealer) requestJobs() (jobs []TestJob, ok bool) {
+	// Buffered so the Manager never waits for us
+	reply := make(chan []TestJob, 1)
+	timeout := time.After(WORK_STEALING_TIMEOUT_SECONDS * time.Second)
+
+	select {
+	case s.stealRequestsChan <- reply:
+	case <-timeout:
+		return nil, false
+	}
+
+	select {
+	case jobs = <-reply:
+		return jobs, true
+	case <-timeout:
+		go func() {
+			s.giveBack(<-reply)
+		}()
+		return nil, false
+	}
+}
+
+func (s *WorkStealer) giveBack(jobs []TestJob) {
+	if len(jobs) > 0 {
+		go func() {
+			s.newJobsChannel <- jobs
+		}()
+	}
+}
+
+// StealJobs asks the other agents for jobs until one of them gives us some.
+// Sockets of agents which are gone are removed.
+func (s *WorkStealer) StealJobs() []TestJob {
+	if s == nil {
+		return nil
+	}
+
+	sockets, err := filepath.Glob(filepath.Join(s.dir, "*"+WORK_STEALING_SOCKET_SUFFIX))
+	if err != nil {
+		return nil
+	}
+
+	for _, socket := range sockets {
+		if socket == s.socket {
+			continue
+		}
+
+		jobs, err := s.stealFrom(socket)
+		if err != nil {
+			if isConnectionRefused(err) {
+				os.Remove(socket)
+			}
+			continue
+		}
+		if len(jobs) > 0 {
+			s.logger.Log("Took " + strconv.Itoa(len(jobs)) + " jobs from " +
+				strings.TrimSuffix(filepath.Base(socket), WORK_STEALING_SOCKET_SUFFIX))
+			return jobs
+		}
+	}
+
+	return nil
+}
+
+func (s *WorkStealer) stealFrom(socket string) ([]TestJob, error) {
+	conn, err := net.DialTimeout("unix", socket, WORK_STEALING_TIMEOUT_SECONDS*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(WORK_STEALING_TIMEOUT_SECONDS * time.Second))
+
+	encoder := json.NewEncoder(conn)
+	if err = encoder.Encode(workStealingRequest{WorkerUUID: WorkerUUID}); err != nil {
+		return nil, err
+	}
+	var response workStealingResponse
+	if err = json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, err
+	}
+	// The jobs are ours only when the other agent knows we got them
+	if len(response.Jobs) > 0 {
+		if err = encoder.Encode(workStealingAck{Received: true}); err != nil {
+			return nil, err
+		}
+	}
+
+	queuedAt := time.Now().Unix()
+	for i := range response.Jobs {
+		response.Jobs[i].QueuedAtSecondsSinceEpoch = queuedAt
+	}
+
+	return response.Jobs, nil
+}
+
+// isConnectionRefused returns true when nobody listens on the socket (the
+// agent which created it is gone).
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
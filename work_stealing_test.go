@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestGiveAwayJobs(t *testing.T) {
+	manager := Manager{jobs: []TestJob{TestJob{Id: 1}, TestJob{Id: 2}, TestJob{Id: 3}}}
+
+	if ids := jobIds(manager.GiveAwayJobs()); !reflect.DeepEqual(ids, []int{3}) {
+		t.Error("Expected to give away the last job but got:", ids)
+	}
+	if ids := jobIds(manager.jobs); !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Error("Expected to keep the first jobs but got:", ids)
+	}
+
+	manager.jobs = []TestJob{TestJob{Id: 1}}
+	if given := manager.GiveAwayJobs(); len(given) != 0 || len(manager.jobs) != 1 {
+		t.Error("Expected to keep the only job but gave away:", given)
+	}
+}
+
+func TestWorkStealer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_stealing_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := Logger{prefix: "", writer: ioutil.Discard}
+
+	// Testributor reassigns job 3 but not job 4 (e.g. it was cancelled)
+	var reassignForm url.Values
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/test_jobs/reassign" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		reassignForm, _ = url.ParseQuery(string(body))
+		w.Write([]byte(`{"reassigned_ids":[3]}`))
+	}))
+	defer api.Close()
+	defer func(uuid string) { WorkerUUID = uuid }(WorkerUUID)
+
+	// An agent which is gone
+	stale, err := net.Listen("unix", filepath.Join(dir, "a_stale.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	giver := &Manager{
+		jobs:              []TestJob{TestJob{Id: 1}, TestJob{Id: 2}, TestJob{Id: 3}, TestJob{Id: 4}},
+		stealRequestsChan: make(chan chan []TestJob),
+		newJobsChannel:    make(chan []TestJob),
+		client:            &APIClient{logger: logger, apiUrl: api.URL + "/"},
+	}
+	WorkerUUID = "giver"
+	giverStealer, err := StartWorkStealer(dir, giver, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer giverStealer.Close()
+	go func() {
+		reply := <-giver.stealRequestsChan
+		reply <- giver.GiveAwayJobs()
+	}()
+
+	WorkerUUID = "taker"
+	taker, err := StartWorkStealer(dir, &Manager{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taker.Close()
+
+	stolen := taker.StealJobs()
+	if ids := jobIds(stolen); !reflect.DeepEqual(ids, []int{3}) {
+		t.Error("Expected to take job 3 but got:", ids)
+	}
+	if len(stolen) > 0 && stolen[0].QueuedAtSecondsSinceEpoch == 0 {
+		t.Error("Expected the taken jobs to be queued now")
+	}
+	if !reflect.DeepEqual(reassignForm["worker_uuid"], []string{"taker"}) ||
+		!reflect.DeepEqual(reassignForm["ids[]"], []string{"3", "4"}) {
+		t.Error("Expected jobs 3 and 4 to be reassigned to the taker but got:", reassignForm)
+	}
+
+	select {
+	case kept := <-giver.newJobsChannel:
+		if ids := jobIds(kept); !reflect.DeepEqual(ids, []int{4}) {
+			t.Error("Expected job 4 to be given back to the giver but got:", ids)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected job 4 to be given back to the giver")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "a_stale.sock")); !os.IsNotExist(err) {
+		t.Error("Expected the socket of the agent which is gone to be removed")
+	}
+}
+
+func TestStartWorkStealerInAnUnsafeDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The modes of directories don't control access on Windows")
+	}
+	dir, err := ioutil.TempDir("", "testributor_stealing_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := Logger{prefix: "", writer: ioutil.Discard}
+
+	shared := filepath.Join(dir, "shared")
+	os.Mkdir(shared, 0777)
+	os.Chmod(shared, 0777)
+	if _, err := StartWorkStealer(shared, &Manager{}, logger); err == nil {
+		t.Error("Expected an error for a directory other users can write to")
+	}
+
+	private := filepath.Join(dir, "private")
+	os.Mkdir(private, 0700)
+	link := filepath.Join(dir, "link")
+	os.Symlink(private, link)
+	if _, err := StartWorkStealer(link, &Manager{}, logger); err == nil {
+		t.Error("Expected an error for a symlink")
+	}
+
+	stealer, err := StartWorkStealer(private, &Manager{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stealer.Close()
+}
+
+func TestWorkStealerTakesBackUnconfirmedJobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testributor_stealing_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logger := Logger{prefix: "", writer: ioutil.Discard}
+
+	reassignedTo := make(chan string, 2)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		reassignedTo <- form.Get("worker_uuid")
+		w.Write([]byte(`{"reassigned_ids":[2]}`))
+	}))
+	defer api.Close()
+	defer func(uuid string) { WorkerUUID = uuid }(WorkerUUID)
+
+	giver := &Manager{
+		stealRequestsChan: make(chan chan []TestJob),
+		newJobsChannel:    make(chan []TestJob),
+		client:            &APIClient{logger: logger, apiUrl: api.URL + "/"},
+	}
+	WorkerUUID = "giver"
+	stealer, err := StartWorkStealer(dir, giver, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stealer.Close()
+	go func() {
+		reply := <-giver.stealRequestsChan
+		reply <- []TestJob{TestJob{Id: 2}}
+	}()
+
+	// An agent which gives up before it confirms it got the jobs
+	conn, err := net.Dial("unix", stealer.socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.NewEncoder(conn).Encode(workStealingRequest{WorkerUUID: "taker"})
+	var response workStealingResponse
+	if err = json.NewDecoder(conn).Decode(&response); err != nil || len(response.Jobs) != 1 {
+		t.Fatal("Expected job 2 but got:", response, err)
+	}
+	conn.Close()
+
+	if first, second := <-reassignedTo, <-reassignedTo; first != "taker" || second != "giver" {
+		t.Error("Expected the job to be reassigned to the taker and back but got:", first, second)
+	}
+	select {
+	case jobs := <-giver.newJobsChannel:
+		if ids := jobIds(jobs); !reflect.DeepEqual(ids, []int{2}) {
+			t.Error("Expected job 2 to be back in the queue but got:", ids)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected job 2 to be back in the queue")
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// checkPrivateDir returns an error unless the directory belongs to the
+// agent's user and nobody else can use it. Otherwise another user could put
+// a socket in it and have us run the jobs it gives us.
+func checkPrivateDir(dir string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != os.Geteuid() {
+		return errors.New("The coordination directory " + dir + " belongs to another user.")
+	}
+	if info.Mode().Perm() != 0700 {
+		return errors.New("The coordination directory " + dir + " has mode " + info.Mode().Perm().String() +
+			". It must be accessible only by its owner (0700).")
+	}
+
+	return nil
+}
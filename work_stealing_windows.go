@@ -0,0 +1,13 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// checkPrivateDir always returns an error on Windows. The file modes don't
+// control access there so we can't tell whether other users can put sockets
+// in the directory (and give us jobs to run).
+func checkPrivateDir(dir string, info os.FileInfo) error {
+	return errors.New("Work stealing is not supported on Windows.")
+}
@@ -2,30 +2,49 @@ package main
 
 //import "time"
 import (
+	"github.com/testributor/agent/system_command"
+	"io"
 	"os"
+	"time"
 )
 
 type Worker struct {
-	jobsChannel         chan *TestJob
-	reportsChannel      chan *TestJob
-	workerIdlingChannel chan bool
-	logger              Logger
-	client              *APIClient
-	lastTestRunId       int
-	project             *Project
+	jobsChannel              chan *TestJob
+	reportsChannel           chan *TestJob
+	workerIdlingChannel      chan *TestJob
+	setupDataVersionChan     chan string
+	logger                   Logger
+	client                   *APIClient
+	lastTestRunId            int
+	project                  *Project
+	setupDataRefreshedAt     time.Time
+	setupDataRefreshInterval time.Duration
+	latestSetupDataVersion   string // The latest version Testributor told us about
+	jobLogs                  *JobLogs
 }
 
 // NewWorker should be used to create a Worker instances. It ensures the correct
 // initialization of all fields.
-func NewWorker(jobsChannel chan *TestJob, reportsChannel chan *TestJob, workerIdlingChannel chan bool, project *Project) *Worker {
-	logger := Logger{"Worker", os.Stdout}
+func NewWorker(config *Config, jobsChannel chan *TestJob, reportsChannel chan *TestJob,
+	workerIdlingChannel chan *TestJob, setupDataVersionChan chan string, project *Project) *Worker {
+	logger := Logger{prefix: "Worker", writer: os.Stdout}
+
+	refreshInterval, err := SetupDataRefreshInterval(config)
+	if err != nil {
+		logger.Warn(err.Error())
+		refreshInterval = DEFAULT_SETUP_DATA_REFRESH_SECONDS * time.Second
+	}
+
 	return &Worker{
-		jobsChannel:         jobsChannel,
-		reportsChannel:      reportsChannel,
-		workerIdlingChannel: workerIdlingChannel,
-		logger:              logger,
-		client:              NewClient(logger),
-		project:             project,
+		jobsChannel:              jobsChannel,
+		reportsChannel:           reportsChannel,
+		workerIdlingChannel:      workerIdlingChannel,
+		setupDataVersionChan:     setupDataVersionChan,
+		logger:                   logger,
+		client:                   NewClient(config, logger),
+		project:                  project,
+		setupDataRefreshedAt:     time.Now(),
+		setupDataRefreshInterval: refreshInterval,
 	}
 }
 
@@ -39,20 +58,108 @@ func (w *Worker) Start() {
 // RunJobs reads a job from the jobsChannel and runs it.
 func (w *Worker) RunJob() {
 	nextJob := <-w.jobsChannel
+	StartSpanAt("Manager.queue", nextJob.span, nextJob.span.StartedAt()).End()
+	testRunLogger := w.logger.With("test_run_id", nextJob.TestRunId).With("commit_sha", nextJob.CommitSha)
 
 	if w.lastTestRunId != nextJob.TestRunId {
-		w.project.SetupTestEnvironment(nextJob.CommitSha, w.logger)
+		if w.SetupDataRefreshNeeded() {
+			w.RefreshSetupData()
+		}
+		w.project.SetupTestEnvironment(nextJob.CommitSha, nextJob.TestRunId, testRunLogger, nextJob.span)
+	}
+
+	jobLogger := testRunLogger.With("job_id", nextJob.Id)
+	logFile, err := w.jobLogs.Create(nextJob.TestRunId, nextJob.Id)
+	if err != nil {
+		jobLogger.Warn("Couldn't create the job's log file: " + err.Error())
+	}
+	if w.lastTestRunId != nextJob.TestRunId {
+		// After creating the new test run's logs so they are the latest ones
+		if err = w.jobLogs.Prune(); err != nil {
+			w.logger.Warn("Couldn't remove the old job logs: " + err.Error())
+		}
 	}
 
-	nextJob.Run(w.logger)
+	var logWriter io.Writer // A nil *os.File would not be a nil io.Writer
+	if logFile != nil {
+		logWriter = logFile
+	}
+	nextJob.Run(w.project.RunCommand, jobLogger, logWriter)
+	if logFile != nil {
+		logFile.Close()
+	}
+	observeJob(nextJob)
 
 	w.lastTestRunId = nextJob.TestRunId
 
 	// Inform manager that we are done in order to set
-	// workerCurrentJobCostPredictionSeconds back to zero
-	w.workerIdlingChannel <- true
+	// workerCurrentJobCostPredictionSeconds back to zero and learn the job's
+	// duration
+	w.workerIdlingChannel <- nextJob
 
 	go func() {
 		w.reportsChannel <- nextJob
 	}()
 }
+
+// observeJob updates the metrics of the jobs run.
+func observeJob(job *TestJob) {
+	result := "unknown"
+	for name, resultType := range system_command.RESULT_TYPES {
+		if resultType == job.ResultType {
+			result = name
+		}
+	}
+	metricJobsTotal.Inc(result)
+
+	if job.RunSeconds > 0 {
+		metricJobDuration.Observe(job.RunSeconds)
+		if job.CostPredictionSeconds > 0 && job.CostPredictionSeconds != NO_PREDICTION_WORKLOAD_SECONDS {
+			metricJobPredictionRatio.Observe(job.RunSeconds / job.CostPredictionSeconds)
+		}
+	}
+}
+
+// SetupDataRefreshNeeded returns true when Testributor told us about a new
+// version of the setup data or when setupDataRefreshInterval has passed since
+// we last fetched them.
+func (w *Worker) SetupDataRefreshNeeded() bool {
+	select {
+	case version := <-w.setupDataVersionChan:
+		w.latestSetupDataVersion = version
+	default:
+	}
+
+	if w.latestSetupDataVersion != "" && w.latestSetupDataVersion != w.project.setupDataVersion {
+		return true
+	}
+
+	return w.setupDataRefreshInterval > 0 && time.Since(w.setupDataRefreshedAt) >= w.setupDataRefreshInterval
+}
+
+// RefreshSetupData fetches the project's setup data and applies any changes
+// (see Project.ApplySetupData). Errors are logged and the worker goes on with
+// the setup data it has.
+func (w *Worker) RefreshSetupData() {
+	w.logger.Log("Refreshing the setup data")
+	w.setupDataRefreshedAt = time.Now()
+
+	setupData, err := w.client.ProjectSetupData()
+	if err != nil {
+		w.logger.Warn("Couldn't fetch the setup data: " + err.Error())
+		return
+	}
+	var updated *Project
+	builder, err := NewProjectBuilder(setupData)
+	if err == nil {
+		updated, err = builder.NewProject(w.project.Config())
+	}
+	if err != nil {
+		w.logger.Warn("Couldn't read the setup data: " + err.Error())
+		return
+	}
+
+	if err = w.project.ApplySetupData(updated, w.logger); err != nil {
+		w.logger.Warn(err.Error())
+	}
+}
@@ -9,10 +9,11 @@ import (
 func TestRunJobSendingToWorkerIdlingChannel(t *testing.T) {
 	jobsChannel := make(chan *TestJob)
 	reportsChannel := make(chan *TestJob)
-	workerIdlingChannel := make(chan bool)
-	worker := NewWorker(jobsChannel, reportsChannel, workerIdlingChannel, &Project{})
-	worker.logger = Logger{"", ioutil.Discard}
-	workerIdling := false
+	workerIdlingChannel := make(chan *TestJob)
+	worker := NewWorker(DefaultConfig(), jobsChannel, reportsChannel, workerIdlingChannel, make(chan string, 1),
+		&Project{})
+	worker.logger = Logger{prefix: "", writer: ioutil.Discard}
+	var finishedJob *TestJob
 
 	go func() {
 		jobsChannel <- &TestJob{Command: "ls"}
@@ -24,10 +25,42 @@ func TestRunJobSendingToWorkerIdlingChannel(t *testing.T) {
 	timer := time.NewTimer(time.Second * 1).C
 	select {
 	case <-timer:
-	case workerIdling = <-workerIdlingChannel:
+	case finishedJob = <-workerIdlingChannel:
 	}
 
-	if !workerIdling {
-		t.Error("It should send true to worker idling channel")
+	if finishedJob == nil || finishedJob.Command != "ls" {
+		t.Error("It should send the finished job to worker idling channel but got:", finishedJob)
+	}
+}
+
+func TestSetupDataRefreshNeeded(t *testing.T) {
+	setupDataVersionChan := make(chan string, 1)
+	worker := NewWorker(DefaultConfig(), make(chan *TestJob), make(chan *TestJob), make(chan *TestJob),
+		setupDataVersionChan, &Project{setupDataVersion: "1"})
+	worker.setupDataRefreshInterval = time.Hour
+
+	if worker.SetupDataRefreshNeeded() {
+		t.Error("It should not refresh the setup data before the interval passes")
+	}
+
+	setupDataVersionChan <- "1"
+	if worker.SetupDataRefreshNeeded() {
+		t.Error("It should not refresh the setup data when the version didn't change")
+	}
+
+	setupDataVersionChan <- "2"
+	if !worker.SetupDataRefreshNeeded() {
+		t.Error("It should refresh the setup data when the version changed")
+	}
+
+	worker.project.setupDataVersion = "2"
+	worker.setupDataRefreshedAt = time.Now().Add(-2 * time.Hour)
+	if !worker.SetupDataRefreshNeeded() {
+		t.Error("It should refresh the setup data when the interval passed")
+	}
+
+	worker.setupDataRefreshInterval = 0
+	if worker.SetupDataRefreshNeeded() {
+		t.Error("It should not refresh the setup data periodically when the interval is 0")
 	}
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	// How much the latest measurement counts in the learned averages (the
+	// rest comes from the previous ones)
+	WORKLOAD_SMOOTHING = 0.3
+	// The workload of a job without a prediction when we haven't run any jobs
+	// yet
+	UNKNOWN_JOB_WORKLOAD_SECONDS = 30
+	// The queue should have enough work for this many fetches so a slow
+	// Testributor doesn't leave the worker idling
+	FETCH_LATENCY_WORKLOAD_FACTOR = 2
+)
+
+// WorkloadModel estimates how long the queued jobs will take. Jobs without a
+// prediction from Testributor are estimated from the durations of the jobs
+// with the same command we ran before. It also decides how much work the
+// queue needs so the next batch arrives before the worker runs out of jobs.
+// The Manager's loop and FetchJobs use it from different goroutines.
+type WorkloadModel struct {
+	mutex               sync.Mutex
+	commandSeconds      map[string]float64 // Learned duration per command
+	fetchLatencySeconds float64            // Learned duration of FetchJobs calls
+	minWorkloadSeconds  float64            // See Config.MinWorkloadSeconds (0 for the default)
+}
+
+// smooth returns the exponential moving average after the latest measurement.
+func smooth(average float64, latest float64) float64 {
+	if average == 0 {
+		return latest
+	}
+	return WORKLOAD_SMOOTHING*latest + (1-WORKLOAD_SMOOTHING)*average
+}
+
+// LearnDuration records how long the job's command ran. Jobs which couldn't
+// run (e.g. cancelled or the executor failed) are ignored.
+func (w *WorkloadModel) LearnDuration(job *TestJob) {
+	if job == nil || job.Command == "" || job.RunSeconds <= 0 {
+		return
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.commandSeconds == nil {
+		w.commandSeconds = make(map[string]float64)
+	}
+	w.commandSeconds[job.Command] = smooth(w.commandSeconds[job.Command], job.RunSeconds)
+}
+
+// LearnFetchLatency records how long fetching a batch of jobs took.
+func (w *WorkloadModel) LearnFetchLatency(seconds float64) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.fetchLatencySeconds = smooth(w.fetchLatencySeconds, seconds)
+}
+
+// JobSeconds returns how long we expect the job to run: the learned duration
+// of its command, its median duration in the DurationHistory, Testributor's
+// prediction, the average of all the learned durations or
+// UNKNOWN_JOB_WORKLOAD_SECONDS (in that order). What we measured on this
+// machine comes before the prediction.
+func (w *WorkloadModel) JobSeconds(job TestJob) float64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if seconds, ok := w.commandSeconds[job.Command]; ok {
+		return seconds
+	}
+	if job.DurationP50Seconds > 0 {
+		return job.DurationP50Seconds
+	}
+	if job.CostPredictionSeconds != NO_PREDICTION_WORKLOAD_SECONDS {
+		return job.CostPredictionSeconds
+	}
+	if len(w.commandSeconds) > 0 {
+		total := float64(0)
+		for _, seconds := range w.commandSeconds {
+			total += seconds
+		}
+		return total / float64(len(w.commandSeconds))
+	}
+
+	return UNKNOWN_JOB_WORKLOAD_SECONDS
+}
+
+// MinWorkloadSeconds returns the workload below which we fetch more jobs.
+// The remaining work has to last until the next workload check plus the
+// time fetching takes (FETCH_LATENCY_WORKLOAD_FACTOR times to allow for slower
+// fetches). It is never lower than the configured minimum.
+func (w *WorkloadModel) MinWorkloadSeconds() float64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	minWorkloadSeconds := w.minWorkloadSeconds
+	if minWorkloadSeconds == 0 {
+		minWorkloadSeconds = DEFAULT_MIN_WORKLOAD_SECONDS
+	}
+
+	return math.Max(minWorkloadSeconds,
+		REMAINING_WORKLOAD_CHECK_TIMOUT_SECONDS+FETCH_LATENCY_WORKLOAD_FACTOR*w.fetchLatencySeconds)
+}
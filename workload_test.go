@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWorkloadModelJobSeconds(t *testing.T) {
+	workload := WorkloadModel{}
+	unpredicted := TestJob{Command: "bin/rspec spec/a_spec.rb", CostPredictionSeconds: NO_PREDICTION_WORKLOAD_SECONDS}
+
+	if seconds := workload.JobSeconds(TestJob{CostPredictionSeconds: 4}); seconds != 4 {
+		t.Error("Expected the prediction (4) but got:", seconds)
+	}
+	if seconds := workload.JobSeconds(unpredicted); seconds != UNKNOWN_JOB_WORKLOAD_SECONDS {
+		t.Error("Expected", UNKNOWN_JOB_WORKLOAD_SECONDS, "without any history but got:", seconds)
+	}
+
+	workload.LearnDuration(&TestJob{Command: "bin/rspec spec/b_spec.rb", RunSeconds: 2})
+	workload.LearnDuration(&TestJob{Command: "bin/rspec spec/c_spec.rb", RunSeconds: 4})
+	if seconds := workload.JobSeconds(unpredicted); seconds != 3 {
+		t.Error("Expected the average of the learned durations (3) but got:", seconds)
+	}
+
+	workload.LearnDuration(&TestJob{Command: unpredicted.Command, RunSeconds: 10})
+	if seconds := workload.JobSeconds(unpredicted); seconds != 10 {
+		t.Error("Expected the learned duration of the command (10) but got:", seconds)
+	}
+	predicted := unpredicted
+	predicted.CostPredictionSeconds = 4
+	if seconds := workload.JobSeconds(predicted); seconds != 10 {
+		t.Error("Expected the learned duration (10) instead of the prediction but got:", seconds)
+	}
+	workload.LearnDuration(&TestJob{Command: unpredicted.Command, RunSeconds: 20})
+	if seconds := workload.JobSeconds(unpredicted); seconds != 13 {
+		t.Error("Expected the smoothed duration (13) but got:", seconds)
+	}
+
+	// Jobs which didn't run are ignored
+	workload.LearnDuration(&TestJob{Command: unpredicted.Command})
+	workload.LearnDuration(nil)
+	if seconds := workload.JobSeconds(unpredicted); seconds != 13 {
+		t.Error("Expected the duration to stay 13 but got:", seconds)
+	}
+}
+
+func TestWorkloadModelMinWorkloadSeconds(t *testing.T) {
+	workload := WorkloadModel{}
+	if seconds := workload.MinWorkloadSeconds(); seconds != DEFAULT_MIN_WORKLOAD_SECONDS {
+		t.Error("Expected", DEFAULT_MIN_WORKLOAD_SECONDS, "but got:", seconds)
+	}
+
+	// Fast fetches don't lower the minimum
+	workload.LearnFetchLatency(0.5)
+	if seconds := workload.MinWorkloadSeconds(); seconds != DEFAULT_MIN_WORKLOAD_SECONDS {
+		t.Error("Expected", DEFAULT_MIN_WORKLOAD_SECONDS, "but got:", seconds)
+	}
+
+	workload = WorkloadModel{}
+	workload.LearnFetchLatency(10)
+	if seconds := workload.MinWorkloadSeconds(); seconds != 25 {
+		t.Error("Expected 25 (check interval plus twice the fetch latency) but got:", seconds)
+	}
+}